@@ -0,0 +1,76 @@
+package backoff
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// Policy describes how the delay between retries grows, ex: starting at 1s
+// and doubling up to 1m, each delay randomly 20% shorter or longer so a
+// fleet of operators doesn't retry in lockstep
+type Policy struct {
+	Initial    time.Duration
+	Max        time.Duration
+	Multiplier float64
+	// Jitter is the fraction, between 0 and 1, a delay may randomly vary by
+	Jitter float64
+}
+
+var DefaultPolicy = Policy{
+	Initial:    time.Second,
+	Max:        time.Minute,
+	Multiplier: 2,
+	Jitter:     0.2,
+}
+
+// Backoff hands out the delays of one thing being retried
+type Backoff struct {
+	Policy   Policy
+	attempts int
+	current  time.Duration
+	// random returns a number in [0, 1), swappable in tests
+	random func() float64
+}
+
+func New(p Policy) *Backoff {
+	return &Backoff{Policy: p, random: rand.Float64}
+}
+
+// Next returns how long to wait before the next attempt, which is longer
+// each time until Reset is called
+func (b *Backoff) Next() time.Duration {
+	p := b.Policy
+	delay := float64(p.Initial) * math.Pow(p.Multiplier, float64(b.attempts))
+
+	if delay > float64(p.Max) {
+		delay = float64(p.Max)
+	}
+
+	delay = delay * (1 + p.Jitter*(2*b.random()-1))
+
+	if delay > float64(p.Max) {
+		delay = float64(p.Max)
+	}
+
+	b.attempts++
+	b.current = time.Duration(delay)
+
+	return b.current
+}
+
+// Current is the delay Next returned last, or 0 after a Reset
+func (b *Backoff) Current() time.Duration {
+	return b.current
+}
+
+func (b *Backoff) Attempts() int {
+	return b.attempts
+}
+
+// Reset is called after a success, so the next failure starts over at the
+// initial delay
+func (b *Backoff) Reset() {
+	b.attempts = 0
+	b.current = 0
+}
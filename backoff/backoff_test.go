@@ -0,0 +1,51 @@
+package backoff
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNext(t *testing.T) {
+	b := New(Policy{Initial: time.Second, Max: 5 * time.Second, Multiplier: 2})
+
+	expected := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}
+
+	for i, e := range expected {
+		if d := b.Next(); d != e {
+			t.Errorf("Expected attempt %d to wait %v but was %v", i, e, d)
+		}
+	}
+
+	if b.Current() != 5*time.Second {
+		t.Errorf("Expected the current backoff to be 5s but was %v", b.Current())
+	}
+
+	b.Reset()
+
+	if d := b.Next(); d != time.Second {
+		t.Errorf("Expected a reset backoff to start over at 1s but was %v", d)
+	}
+}
+
+func TestJitter(t *testing.T) {
+	b := New(Policy{Initial: 10 * time.Second, Max: time.Minute, Multiplier: 2, Jitter: 0.5})
+
+	b.random = func() float64 { return 0 }
+
+	if d := b.Next(); d != 5*time.Second {
+		t.Errorf("Expected the shortest jittered delay to be 5s but was %v", d)
+	}
+
+	b.random = func() float64 { return 0.75 }
+
+	if d := b.Next(); d != 25*time.Second {
+		t.Errorf("Expected the jittered delay to be 25s but was %v", d)
+	}
+
+	b.random = func() float64 { return 0.99 }
+	b.Next() // 40s, jittered to 59.6s
+
+	if d := b.Next(); d != time.Minute {
+		t.Errorf("Expected the jittered delay to be capped at 1m but was %v", d)
+	}
+}
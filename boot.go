@@ -1,9 +1,10 @@
 package main
 
 import (
+	"context"
 	"errors"
-	"fmt"
 	"github.com/wakeful-deployment/operator/consul"
+	"github.com/wakeful-deployment/operator/container"
 	"github.com/wakeful-deployment/operator/docker"
 	"github.com/wakeful-deployment/operator/global"
 	"github.com/wakeful-deployment/operator/logger"
@@ -25,64 +26,75 @@ func LoadBootStateFromFile(path string) *State {
 	return state
 }
 
-func Boot(dockerClient docker.Client, consulClient consul.Client, bootState *State) {
+func Boot(ctx context.Context, dockerClient docker.Client, consulClient consul.Client, bootState *State) {
 	if !global.Machine.IsCurrently(global.Booting) {
 		logger.Info("booting up...")
 		global.Machine.Transition(global.Booting, nil)
 	}
 
 	logger.Info("checking status of consul...")
-	err := detectOrBootConsul(dockerClient, consulClient, bootState)
+	err := detectOrBootConsul(ctx, dockerClient, consulClient, bootState)
 
 	if err != nil {
 		global.Machine.Transition(global.ConsulFailed, err)
-		logger.Error(fmt.Sprintf("detecting or booting consul failed with error: %v", err))
+		logger.Error("detecting or booting consul failed", logger.Fields{"error": err})
 		return
 	}
 
-	logger.Info(fmt.Sprintf("posting metadata to consul. Metadata = %v", bootState.Metadata))
-	err = consulClient.PostMetadata(bootState.NodeName, bootState.Metadata)
+	logger.Info("posting metadata to consul", logger.Fields{"metadata": bootState.Metadata})
+	err = consulClient.PostMetadata(ctx, bootState.NodeName, bootState.Metadata)
 
 	if err != nil {
 		global.Machine.Transition(global.PostingMetadataFailed, err)
-		logger.Error(fmt.Sprintf("posting metadata failed with error: %v", err))
+		logger.Error("posting metadata failed", logger.Fields{"error": err})
 		return
 	}
 
+	recallInvalidServices(ctx, consulClient, bootState.NodeName)
+	recallFailedUpgrades(ctx, consulClient, bootState.NodeName)
+
 	global.Machine.Transition(global.Booted, nil)
 	logger.Info("booted!")
 }
 
-func detectOrBootConsul(dockerClient docker.Client, consulClient consul.Client, state *State) error {
-	logger.Info("checking consul...")
+func detectOrBootConsul(ctx context.Context, dockerClient docker.Client, consulClient consul.Client, state *State) error {
+	logger.Debug("checking consul...")
 
-	err := consulClient.Detect()
+	err := consulClient.Detect(ctx)
 
 	if err == nil {
 		logger.Info("consul detected!")
 		return nil
 	}
 
-	logger.Error(fmt.Sprintf("detecting consul failed with error: %v. Let's check docker to see if it's running", err))
+	logger.Warn("detecting consul failed. Let's check docker to see if it's running", logger.Fields{"error": err})
 
-	containers, err := docker.RunningContainers(dockerClient)
+	containers, err := docker.RunningContainers(ctx, dockerClient)
 
 	if err != nil {
-		logger.Error(fmt.Sprintf("detecting docker failed also with error: %v.", err))
+		logger.Error("detecting docker failed also", logger.Fields{"error": err})
 		return errors.New("consul and docker are both not responding")
 	}
 
-	running := false
-	for _, container := range containers {
-		if container.Name == "consul" {
-			running = true
-			break
+	var stopped *container.Container
+
+	for _, c := range containers {
+		if c.Name != "consul" {
+			continue
+		}
+
+		if docker.Running(c) {
+			logger.Error("consul is running, but we already detected it is not responding on port 8500")
+			return errors.New("consul is running, but not responding on port 8500")
 		}
-	}
 
-	if running {
-		logger.Error("consul is running, but we already detected it is not responding on port 8500")
-		return errors.New("consul is running, but not responding on port 8500")
+		if c.State == "restarting" {
+			logger.Error("consul is restarting, leaving it to docker")
+			return errors.New("consul is restarting")
+		}
+
+		stopped = &c
+		break
 	}
 
 	logger.Info("consul not running. Attempting now to boot it up")
@@ -99,11 +111,37 @@ func detectOrBootConsul(dockerClient docker.Client, consulClient consul.Client,
 		return errors.New("consul is not running. It is also not listed as a service, so cannot attempt to boot it")
 	}
 
+	// only create consul's networks, removing the others is up to the first tick
+	if consulNetworks := state.ServiceNetworks(*consulService); len(consulNetworks) > 0 {
+		networks, err := docker.PlanNetworks(ctx, dockerClient, consulNetworks)
+
+		if err == nil {
+			err = docker.CreateNetworks(ctx, dockerClient, docker.NetworkPlan{Create: networks.Create})
+		}
+
+		if err != nil {
+			logger.Error("creating the networks of consul failed", logger.Fields{"error": err})
+			return err
+		}
+	}
+
+	// a consul container which exited would otherwise hold on to the name
+	if stopped != nil {
+		logger.Warn("consul container is not running, removing it", logger.Fields{"state": stopped.State})
+		err = docker.Stop(ctx, dockerClient, *stopped)
+
+		if err != nil {
+			logger.Error("removing the stopped consul container failed", logger.Fields{"error": err})
+			return err
+		}
+	}
+
 	consulContainer := consulService.Container(state.NodeName, consulClient.ConsulHost())
-	err = dockerClient.Run(consulContainer)
+	consulContainer.Auth = state.registryAuth(consulContainer.Image)
+	err = docker.Run(ctx, dockerClient, consulContainer)
 
 	if err != nil {
-		logger.Error(fmt.Sprintf("attemping to run consul with docker failed with error: %v", err))
+		logger.Error("attemping to run consul with docker failed", logger.Fields{"error": err})
 		return err
 	}
 
@@ -1,11 +1,19 @@
 package main
 
 import (
+	"context"
+	"encoding/base64"
 	"errors"
+	"github.com/wakeful-deployment/operator/backoff"
+	"github.com/wakeful-deployment/operator/consul"
+	"github.com/wakeful-deployment/operator/container"
 	"github.com/wakeful-deployment/operator/global"
+	"github.com/wakeful-deployment/operator/service"
 	"github.com/wakeful-deployment/operator/test"
 	"io/ioutil"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestValidLoadBootStateFromFile(t *testing.T) {
@@ -33,7 +41,11 @@ func TestValidLoadBootStateFromFile(t *testing.T) {
 		"env": {},
 		"restart": "always",
 		"tags": ["statsd", "udp"],
-		"checks": []
+		"checks": [{
+			"name": "statsite udp",
+			"docker": true,
+			"args": ["nc", "-uz", "localhost", "8125"]
+		}]
 	  }
 	}
 }`)
@@ -72,6 +84,14 @@ func TestValidLoadBootStateFromFile(t *testing.T) {
 	if s.Image != expectedImage {
 		t.Errorf("Expected image to be %s, but got %s", expectedImage, s.Image)
 	}
+
+	if len(s.Checks) != 1 {
+		t.Fatalf("Expected 1 check, but got %d", len(s.Checks))
+	}
+
+	if s.Checks[0].Type() != service.DockerCheck {
+		t.Errorf("Expected a %s check, but got %s", service.DockerCheck, s.Checks[0].Type())
+	}
 }
 
 func TestInvalidLoadBootStateFromFile(t *testing.T) {
@@ -106,7 +126,7 @@ func TestBootFailedConsulCheck(t *testing.T) {
 	defer global.Machine.ForceTransition(global.Initial, nil)
 
 	dockerClient := test.DockerClient{
-		RunningContainersResponse: func() (string, error) { return "", nil },
+		RunningContainersResponse: func() ([]container.Container, error) { return nil, nil },
 	}
 
 	consulClient := test.ConsulClient{
@@ -115,7 +135,7 @@ func TestBootFailedConsulCheck(t *testing.T) {
 
 	state := &State{}
 
-	Boot(dockerClient, consulClient, state)
+	Boot(context.Background(), dockerClient, consulClient, state)
 
 	if !global.Machine.IsCurrently(global.ConsulFailed) {
 		t.Errorf("Expected machine to be %s but was %v", global.ConsulFailed, global.Machine.CurrentState)
@@ -127,7 +147,7 @@ func TestBootFailedMetadataPost(t *testing.T) {
 	defer global.Machine.ForceTransition(global.Initial, nil)
 
 	dockerClient := test.DockerClient{
-		RunningContainersResponse: func() (string, error) { return "", nil },
+		RunningContainersResponse: func() ([]container.Container, error) { return nil, nil },
 	}
 
 	consulClient := test.ConsulClient{
@@ -137,9 +157,132 @@ func TestBootFailedMetadataPost(t *testing.T) {
 
 	state := &State{}
 
-	Boot(dockerClient, consulClient, state)
+	Boot(context.Background(), dockerClient, consulClient, state)
 
 	if !global.Machine.IsCurrently(global.PostingMetadataFailed) {
 		t.Errorf("Expected machine to be %s but was %v", global.PostingMetadataFailed, global.Machine.CurrentState)
 	}
 }
+
+func TestBootGivesUpAfterAttempts(t *testing.T) {
+	global.Machine.ForceTransition(global.Initial, nil)
+	defer global.Machine.ForceTransition(global.Initial, nil)
+
+	retryPolicy = backoff.Policy{Initial: time.Millisecond, Max: time.Millisecond, Multiplier: 1}
+	defer func() { retryPolicy = backoff.DefaultPolicy }()
+
+	dockerClient := test.DockerClient{
+		RunningContainersResponse: func() ([]container.Container, error) { return nil, nil },
+	}
+
+	attempts := 0
+	consulClient := test.ConsulClient{
+		DetectResponse: func() error {
+			attempts++
+			return errors.New("Not Detected")
+		},
+	}
+
+	if boot(context.Background(), dockerClient, consulClient, &State{}, 3) {
+		t.Error("Expected booting to fail")
+	}
+
+	if attempts != 3 {
+		t.Errorf("Expected 3 boot attempts but there were %d", attempts)
+	}
+}
+
+func TestBootRecallsReportedKeys(t *testing.T) {
+	global.Machine.ForceTransition(global.Initial, nil)
+	defer global.Machine.ForceTransition(global.Initial, nil)
+	defer func() { reportedInvalid = make(map[string]string) }()
+	defer func() {
+		failedUpgrades = make(map[string]failedUpgrade)
+		global.KeepServices(nil)
+	}()
+
+	dockerClient := test.DockerClient{
+		RunningContainersResponse: func() ([]container.Container, error) { return nil, nil },
+	}
+
+	var deletedKeys []string
+	consulClient := test.ConsulClient{
+		DetectResponse:       func() error { return nil },
+		PostMetadataResponse: func() error { return nil },
+		ListKeysResponse: func(prefix string) ([]consul.KV, error) {
+			switch prefix {
+			case consul.InvalidKey("abc", ""):
+				return []consul.KV{consul.KV{Key: consul.InvalidKey("abc", "web"), Value: base64.StdEncoding.EncodeToString([]byte(`{"error":"image is required"}`))}}, nil
+			case consul.FailureKey("abc", ""):
+				return []consul.KV{consul.KV{Key: consul.FailureKey("abc", "worker"), Value: base64.StdEncoding.EncodeToString([]byte(`{"image":"plum/worker:2","hash":"abc","error":"container exited"}`))}}, nil
+			}
+			return nil, nil
+		},
+		DeleteKeyResponse: func(key string) error {
+			deletedKeys = append(deletedKeys, key)
+			return nil
+		},
+	}
+
+	Boot(context.Background(), dockerClient, consulClient, &State{NodeName: "abc"})
+
+	if !global.Machine.IsCurrently(global.Booted) {
+		t.Fatalf("Expected machine to be %s but was %v", global.Booted, global.Machine.CurrentState)
+	}
+
+	if reportedInvalid["web"] != "image is required" {
+		t.Errorf("Expected the invalid web service to be recalled but was %v", reportedInvalid)
+	}
+
+	if failedUpgrades["worker"].Hash != "abc" {
+		t.Errorf("Expected the failed worker upgrade to be recalled but was %v", failedUpgrades)
+	}
+
+	reportInvalidServices(context.Background(), consulClient, "abc", map[string]string{})
+
+	if len(deletedKeys) != 1 || deletedKeys[0] != consul.InvalidKey("abc", "web") {
+		t.Errorf("Expected the stale invalid key to be deleted but deleted %v", deletedKeys)
+	}
+}
+
+func TestBootReplacesStoppedConsul(t *testing.T) {
+	global.Machine.ForceTransition(global.Initial, nil)
+	defer global.Machine.ForceTransition(global.Initial, nil)
+
+	var events []string
+	dockerClient := test.DockerClient{
+		RunningContainersResponse: func() ([]container.Container, error) {
+			return []container.Container{container.Container{Name: "consul", Image: "plum/wake-consul-server:latest", State: "exited"}}, nil
+		},
+		InspectResponse: func(c container.Container) (container.Container, error) {
+			c.ExitCode = 1
+			return c, nil
+		},
+		StopResponse: func(c container.Container) error {
+			events = append(events, "stop "+c.Name)
+			return nil
+		},
+		RunResponse: func(c container.Container) error {
+			events = append(events, "run "+c.Name)
+			return nil
+		},
+		ImageIDResponse: func(image string) (string, error) { return "sha256:abc", nil },
+	}
+
+	consulClient := test.ConsulClient{
+		DetectResponse:     func() error { return errors.New("Not Detected") },
+		ConsulHostResponse: func() string { return "127.0.0.1" },
+	}
+
+	state := &State{Services: map[string]*service.Service{"consul": &service.Service{Name: "consul", Image: "plum/wake-consul-server:latest"}}}
+
+	Boot(context.Background(), dockerClient, consulClient, state)
+
+	if !global.Machine.IsCurrently(global.ConsulFailed) {
+		t.Errorf("Expected machine to be %s while consul boots but was %v", global.ConsulFailed, global.Machine.CurrentState)
+	}
+
+	if strings.Join(events, ", ") != "stop consul, run consul" {
+		t.Errorf("Expected the stopped consul container to be replaced but got %v", events)
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/wakeful-deployment/operator/global"
+	"github.com/wakeful-deployment/operator/logger"
+	"io"
+	"net/http"
+	"os"
+	"time"
+)
+
+// applyCommand boots and runs a single tick, without serving the HTTP API.
+// It exits with 0 when the node ends up running as desired.
+func applyCommand(args []string) int {
+	flags, o := newFlagSet("apply")
+	bootAttempts := flags.Int("boot-attempts", 5, "How many times to try booting before giving up, 0 to keep trying")
+	flags.Parse(args)
+
+	state := o.configure()
+	state.ShouldLoop = false
+	dockerClient, consulClient := clients(state)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go handleSignals(cancel)
+
+	if boot(ctx, dockerClient, consulClient, state, *bootAttempts) {
+		Once(ctx, dockerClient, consulClient, state)
+	}
+
+	if !global.Machine.IsCurrently(global.Running) {
+		logger.Error("applying failed", logger.Fields{"state": global.Machine.CurrentState.Name, "error": global.Machine.CurrentState.Error})
+		return 1
+	}
+
+	return 0
+}
+
+// planCommand prints what a tick would change, see runPlan
+func planCommand(args []string) int {
+	flags, o := newFlagSet("plan")
+	format := flags.String("format", "text", "Print the plan as text or json")
+	flags.Parse(args)
+
+	return printPlan(o, *format)
+}
+
+func printPlan(o *options, format string) int {
+	// stdout is for the plan itself
+	logger.Output = os.Stderr
+
+	state := o.configure()
+	dockerClient, consulClient := clients(state)
+
+	return runPlan(context.Background(), dockerClient, consulClient, state, format, os.Stdout)
+}
+
+// diffCommand prints how the node differs from the desired state, see runDiff
+func diffCommand(args []string) int {
+	flags, o := newFlagSet("diff")
+	format := flags.String("format", "text", "Print the differences as text or json")
+	flags.Parse(args)
+
+	// stdout is for the diff itself
+	logger.Output = os.Stderr
+
+	state := o.configure()
+	dockerClient, consulClient := clients(state)
+
+	return runDiff(context.Background(), dockerClient, consulClient, state, *format, os.Stdout)
+}
+
+// statusCommand asks an operator for its state over the HTTP API. It exits
+// with 0 when that operator is running, 1 otherwise.
+func statusCommand(args []string) int {
+	flags := flag.NewFlagSet("status", flag.ExitOnError)
+	url := flags.String("url", "http://localhost:8000", "The address of the operator to ask")
+	format := flags.String("format", "text", "Print the status as text or json")
+	flags.Parse(args)
+
+	report, err := fetchReport(*url)
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+		return 1
+	}
+
+	if *format == "json" {
+		json.NewEncoder(os.Stdout).Encode(report)
+	} else {
+		writeReport(os.Stdout, report)
+	}
+
+	if report.State != global.Running.Name {
+		return 1
+	}
+
+	return 0
+}
+
+func fetchReport(url string) (Report, error) {
+	var report Report
+
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(fmt.Sprintf("%s/api/state", url))
+
+	if err != nil {
+		return report, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return report, errors.New(fmt.Sprintf("%s/api/state returned non-200 response: %d", url, resp.StatusCode))
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(&report)
+
+	return report, err
+}
+
+func writeReport(w io.Writer, report Report) {
+	fmt.Fprintf(w, "state: %s\n", report.State)
+
+	if report.Error != "" {
+		fmt.Fprintf(w, "error: %s\n", report.Error)
+	}
+
+	if report.LastSuccessfulTick != nil {
+		fmt.Fprintf(w, "last successful tick: %s\n", report.LastSuccessfulTick.Format(time.RFC3339))
+	} else {
+		fmt.Fprintln(w, "last successful tick: never")
+	}
+
+	fmt.Fprintf(w, "index: %d\n", report.Index)
+
+	if report.Backoff != "" && report.Backoff != "0s" {
+		fmt.Fprintf(w, "retrying in: %s\n", report.Backoff)
+	}
+
+	if len(report.Services) > 0 {
+		fmt.Fprintln(w, "services:")
+	}
+
+	for _, s := range report.Services {
+		line := fmt.Sprintf("  %s: %s", s.Name, s.Status)
+
+		if s.Error != "" {
+			line = fmt.Sprintf("%s (%s)", line, s.Error)
+		}
+
+		fmt.Fprintln(w, line)
+	}
+}
@@ -2,51 +2,101 @@ package consul
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/wakeful-deployment/operator/service"
+	"io"
 	"io/ioutil"
 	"net/http"
-	"strconv"
 	"strings"
 	"time"
 )
 
 type Client interface {
-	RegisteredServices() (string, error)
-	Register(service.Service) error
-	Deregister(service.Service) error
-	PostMetadata(string, map[string]string) error
-	Detect() error
-	GetDirectoryState(string, int, string) (*DirectoryState, error)
+	RegisteredServices(context.Context) (string, error)
+	Checks(context.Context) (string, error)
+	Register(context.Context, service.Service) error
+	Deregister(context.Context, service.Service) error
+	PostMetadata(context.Context, string, map[string]string) error
+	PutKey(context.Context, string, string) error
+	GetKey(context.Context, string) (string, error)
+	DeleteKey(context.Context, string) error
+	ListKeys(context.Context, string) ([]KV, error)
+	Detect(context.Context) error
+	GetDirectoryState(context.Context, string, int, string) (*DirectoryState, error)
 	ConsulHost() string
+	NodeAddress() string
 }
 
+// DefaultTimeout is how long a request to consul may take when the client
+// doesn't say otherwise
+const DefaultTimeout = 10 * time.Second
+
 type HttpClient struct {
 	Host string
+	// Address services are registered with. When empty consul uses the
+	// address of the agent's node.
+	Address string
+	// Timeout is how long each request may take, DefaultTimeout when zero.
+	// Blocking queries get this much longer than their wait.
+	Timeout time.Duration
 }
 
 func (h HttpClient) ConsulHost() string {
 	return h.Host
 }
 
-func (h HttpClient) Register(s service.Service) error {
-	rep := ServiceRepresentation{Name: s.Name, Address: h.ConsulHost()}
+func (h HttpClient) NodeAddress() string {
+	return h.Address
+}
+
+func (h HttpClient) timeout() time.Duration {
+	if h.Timeout <= 0 {
+		return DefaultTimeout
+	}
+
+	return h.Timeout
+}
+
+// request sends a request which is given up on when ctx is done. Callers
+// must close the body of the response.
+func (h HttpClient) request(ctx context.Context, method string, url string, body io.Reader) (*http.Response, error) {
+	request, err := http.NewRequest(method, url, body)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+
+	return http.DefaultClient.Do(request.WithContext(ctx))
+}
+
+func (h HttpClient) Register(ctx context.Context, s service.Service) error {
+	rep := NewServiceRepresentation(s, h.NodeAddress())
 	json, err := json.Marshal(rep)
 
 	if err != nil {
 		return err
 	}
 
-	reader := bytes.NewReader(json)
+	ctx, cancel := context.WithTimeout(ctx, h.timeout())
+	defer cancel()
 
-	resp, err := http.Post(h.serviceRegisterURL(), "application/json", reader)
+	resp, err := h.request(ctx, "POST", h.serviceRegisterURL(), bytes.NewReader(json))
 
 	if err != nil {
 		return err
 	}
 
+	defer resp.Body.Close()
+
 	if resp.StatusCode != 200 {
 		return errors.New(fmt.Sprintf("service failed to register: %v", s))
 	}
@@ -54,15 +104,18 @@ func (h HttpClient) Register(s service.Service) error {
 	return nil
 }
 
-func (h HttpClient) Deregister(s service.Service) error {
-	reader := bytes.NewReader([]byte{})
-	url := h.serviceDeregisterURL(s)
-	resp, err := http.Post(url, "application/json", reader)
+func (h HttpClient) Deregister(ctx context.Context, s service.Service) error {
+	ctx, cancel := context.WithTimeout(ctx, h.timeout())
+	defer cancel()
+
+	resp, err := h.request(ctx, "POST", h.serviceDeregisterURL(s), nil)
 
 	if err != nil {
 		return err
 	}
 
+	defer resp.Body.Close()
+
 	if resp.StatusCode != 200 {
 		return errors.New(fmt.Sprintf("service failed to deregister: %v", s))
 	}
@@ -70,17 +123,20 @@ func (h HttpClient) Deregister(s service.Service) error {
 	return nil
 }
 
-func (h HttpClient) RegisteredServices() (string, error) {
-	resp, err := http.Get(h.servicesURL())
+func (h HttpClient) RegisteredServices(ctx context.Context) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, h.timeout())
+	defer cancel()
+
+	resp, err := h.request(ctx, "GET", h.servicesURL(), nil)
 
 	if err != nil {
 		return "", err
 	}
 
+	defer resp.Body.Close()
+
 	if resp.StatusCode == 200 {
-		reader := resp.Body
-		defer reader.Close()
-		contents, err := ioutil.ReadAll(reader)
+		contents, err := ioutil.ReadAll(resp.Body)
 
 		if err != nil {
 			return "", err
@@ -92,37 +148,141 @@ func (h HttpClient) RegisteredServices() (string, error) {
 	}
 }
 
-func (h HttpClient) PostMetadata(nodeName string, metadata map[string]string) error {
+func (h HttpClient) Checks(ctx context.Context) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, h.timeout())
+	defer cancel()
+
+	resp, err := h.request(ctx, "GET", h.checksURL(), nil)
+
+	if err != nil {
+		return "", err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return "", errors.New("Could not fetch checks")
+	}
+
+	contents, err := ioutil.ReadAll(resp.Body)
+
+	if err != nil {
+		return "", err
+	}
+
+	return string(contents), nil
+}
+
+func (h HttpClient) PostMetadata(ctx context.Context, nodeName string, metadata map[string]string) error {
 	for key, value := range metadata {
-		client := &http.Client{}
-		request, err := http.NewRequest("PUT", h.metadataURL(key, nodeName), strings.NewReader(value))
+		err := h.PutKey(ctx, MetadataKey(nodeName, key), value)
 
 		if err != nil {
 			return err
 		}
+	}
+
+	return nil
+}
+
+func (h HttpClient) PutKey(ctx context.Context, key string, value string) error {
+	return h.kvRequest(ctx, "PUT", key, strings.NewReader(value))
+}
+
+// GetKey returns the raw value of the key, which must exist
+func (h HttpClient) GetKey(ctx context.Context, key string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, h.timeout())
+	defer cancel()
+
+	resp, err := h.request(ctx, "GET", h.kvURL(key)+"?raw", nil)
+
+	if err != nil {
+		return "", err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return "", errors.New(fmt.Sprintf("GET request for key '%s' returned non-200 response: %d", key, resp.StatusCode))
+	}
+
+	b, err := ioutil.ReadAll(resp.Body)
+
+	if err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
+
+func (h HttpClient) DeleteKey(ctx context.Context, key string) error {
+	return h.kvRequest(ctx, "DELETE", key, nil)
+}
+
+// ListKeys returns every key under the prefix with its value, none when
+// there are no such keys
+func (h HttpClient) ListKeys(ctx context.Context, prefix string) ([]KV, error) {
+	ctx, cancel := context.WithTimeout(ctx, h.timeout())
+	defer cancel()
+
+	resp, err := h.request(ctx, "GET", h.kvURL(prefix)+"?recurse=true", nil)
+
+	if err != nil {
+		return nil, err
+	}
 
-		resp, err := client.Do(request)
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case 200:
+		var keys []KV
+		err = json.NewDecoder(resp.Body).Decode(&keys)
 
 		if err != nil {
-			return err
+			return nil, err
 		}
 
-		if resp.StatusCode != 200 {
-			return errors.New(fmt.Sprintf("Metadata request return non-200 response: %d", resp.StatusCode))
-		}
+		return keys, nil
+	case 404:
+		return nil, nil
+	default:
+		return nil, errors.New(fmt.Sprintf("GET request for keys under '%s' returned non-200 response: %d", prefix, resp.StatusCode))
+	}
+}
+
+func (h HttpClient) kvRequest(ctx context.Context, method string, key string, body io.Reader) error {
+	ctx, cancel := context.WithTimeout(ctx, h.timeout())
+	defer cancel()
+
+	resp, err := h.request(ctx, method, h.kvURL(key), body)
+
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return errors.New(fmt.Sprintf("%s request for key '%s' returned non-200 response: %d", method, key, resp.StatusCode))
 	}
 
 	return nil
 }
 
-func (h HttpClient) GetDirectoryState(nodeName string, index int, wait string) (*DirectoryState, error) {
-	url := h.directoryStateURL(nodeName, index, wait)
-	resp, err := http.Get(url)
+// GetDirectoryState blocks until the directory changes, wait passes or ctx
+// is cancelled
+func (h HttpClient) GetDirectoryState(ctx context.Context, nodeName string, index int, wait string) (*DirectoryState, error) {
+	ctx, cancel := context.WithTimeout(ctx, blockingTimeout(wait)+h.timeout())
+	defer cancel()
+
+	resp, err := h.request(ctx, "GET", h.directoryStateURL(nodeName, index, wait), nil)
 
 	if err != nil {
 		return nil, err
 	}
 
+	defer resp.Body.Close()
+
 	state, err := handleDirectoryResponse(resp)
 
 	if err != nil {
@@ -132,8 +292,16 @@ func (h HttpClient) GetDirectoryState(nodeName string, index int, wait string) (
 	return state, nil
 }
 
-func getDirectoryIndex(resp *http.Response) (int, error) {
-	return strconv.Atoi(resp.Header["X-Consul-Index"][0])
+// blockingTimeout is the longest consul will hold a blocking query open for
+// the given wait, which it adds up to wait/16 of jitter to
+func blockingTimeout(wait string) time.Duration {
+	d, err := time.ParseDuration(wait)
+
+	if err != nil {
+		return 0
+	}
+
+	return d + d/16
 }
 
 func handleDirectoryResponse(resp *http.Response) (*DirectoryState, error) {
@@ -141,7 +309,7 @@ func handleDirectoryResponse(resp *http.Response) (*DirectoryState, error) {
 
 	switch resp.StatusCode {
 	case 200:
-		index, err := getDirectoryIndex(resp)
+		index, err := QueryIndex(resp)
 
 		if err != nil {
 			return nil, err
@@ -159,7 +327,7 @@ func handleDirectoryResponse(resp *http.Response) (*DirectoryState, error) {
 
 		return &state, nil
 	case 404:
-		index, err := getDirectoryIndex(resp)
+		index, err := QueryIndex(resp)
 
 		if err != nil {
 			return nil, err
@@ -175,26 +343,137 @@ func handleDirectoryResponse(resp *http.Response) (*DirectoryState, error) {
 
 const consulCheckTimeout = 5 * time.Second
 
-func (h HttpClient) Detect() error {
-	url := h.consulCheckURL()
-
-	client := http.Client{Timeout: consulCheckTimeout}
-	resp, err := client.Get(url)
+func (h HttpClient) Detect(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, consulCheckTimeout)
+	defer cancel()
 
-	if err == nil && resp.StatusCode == 200 {
-		return nil
-	}
+	resp, err := h.request(ctx, "GET", h.consulCheckURL(), nil)
 
 	if err != nil {
 		return err
 	}
 
+	defer resp.Body.Close()
+
+	if resp.StatusCode == 200 {
+		return nil
+	}
+
 	return errors.New(fmt.Sprintf("consul check failed with non-200 response: %d", resp.StatusCode))
 }
 
+// ChecksMetaKey is the service meta key the checks are fingerprinted in,
+// since /v1/agent/services doesn't report checks
+const ChecksMetaKey = "wakeful_checks"
+
+// ServiceRepresentation is a service as the consul agent API knows it
 type ServiceRepresentation struct {
+	ID      string
 	Name    string
+	Tags    []string
 	Address string
+	Port    int
+	Meta    map[string]string     `json:",omitempty"`
+	Checks  []CheckRepresentation `json:",omitempty"`
+}
+
+func NewServiceRepresentation(s service.Service, address string) ServiceRepresentation {
+	rep := ServiceRepresentation{
+		ID:      s.Name,
+		Name:    s.Name,
+		Tags:    s.Tags,
+		Address: address,
+		Port:    s.Port(),
+		Checks:  CheckRepresentations(s),
+	}
+
+	if len(rep.Checks) > 0 {
+		rep.Meta = map[string]string{ChecksMetaKey: checksHash(rep.Checks)}
+	}
+
+	return rep
+}
+
+// checksHash is a short fingerprint of the checks
+func checksHash(checks []CheckRepresentation) string {
+	// marshaling a slice of structs of strings can't fail
+	b, _ := json.Marshal(checks)
+	sum := sha256.Sum256(b)
+
+	return hex.EncodeToString(sum[:])[:16]
+}
+
+// Equal compares everything /v1/agent/services reports back. Checks are not
+// part of that response, so they are compared by their fingerprint in Meta.
+func (r ServiceRepresentation) Equal(other ServiceRepresentation) bool {
+	if r.ID != other.ID || r.Name != other.Name || r.Address != other.Address || r.Port != other.Port {
+		return false
+	}
+
+	if r.Meta[ChecksMetaKey] != other.Meta[ChecksMetaKey] {
+		return false
+	}
+
+	if len(r.Tags) != len(other.Tags) {
+		return false
+	}
+
+	for i := range r.Tags {
+		if r.Tags[i] != other.Tags[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// CheckRepresentation is a check as the consul agent API expects it when
+// registering a service
+type CheckRepresentation struct {
+	CheckID           string   `json:",omitempty"`
+	Name              string   `json:",omitempty"`
+	Notes             string   `json:",omitempty"`
+	HTTP              string   `json:",omitempty"`
+	TCP               string   `json:",omitempty"`
+	Script            string   `json:",omitempty"`
+	Args              []string `json:",omitempty"`
+	DockerContainerID string   `json:",omitempty"`
+	Shell             string   `json:",omitempty"`
+	TTL               string   `json:",omitempty"`
+	Interval          string   `json:",omitempty"`
+	Timeout           string   `json:",omitempty"`
+}
+
+func CheckRepresentations(s service.Service) []CheckRepresentation {
+	var checks []CheckRepresentation
+
+	for _, c := range s.Checks {
+		c = c.WithDefaults()
+
+		rep := CheckRepresentation{
+			CheckID:  c.ID,
+			Name:     c.Name,
+			Notes:    c.Notes,
+			HTTP:     c.HTTP,
+			TCP:      c.TCP,
+			Script:   c.Script,
+			Args:     c.Args,
+			TTL:      c.TTL,
+			Interval: c.Interval,
+			Timeout:  c.Timeout,
+		}
+
+		if c.Type() == service.DockerCheck {
+			// the container is named after the service, and docker
+			// accepts a name anywhere it accepts an id
+			rep.DockerContainerID = s.Name
+			rep.Shell = c.Shell
+		}
+
+		checks = append(checks, rep)
+	}
+
+	return checks
 }
 
 func (h HttpClient) consulCheckURL() string {
@@ -205,16 +484,22 @@ func (h HttpClient) servicesURL() string {
 	return fmt.Sprintf("http://%s:8500/v1/agent/services", h.ConsulHost())
 }
 
+func (h HttpClient) checksURL() string {
+	return fmt.Sprintf("http://%s:8500/v1/agent/checks", h.ConsulHost())
+}
+
+// serviceRegisterURL replaces the checks of a service registered again, so
+// checks which were removed from the service go away
 func (h HttpClient) serviceRegisterURL() string {
-	return fmt.Sprintf("http://%s:8500/v1/agent/service/register", h.ConsulHost())
+	return fmt.Sprintf("http://%s:8500/v1/agent/service/register?replace-existing-checks=true", h.ConsulHost())
 }
 
 func (h HttpClient) serviceDeregisterURL(s service.Service) string {
 	return fmt.Sprintf("http://%s:8500/v1/agent/service/deregister/%s", h.ConsulHost(), s.Name)
 }
 
-func (h HttpClient) metadataURL(key string, nodeName string) string {
-	return fmt.Sprintf("http://%s:8500/v1/kv/_wakeful/nodes/%s/metadata/%s", h.ConsulHost(), nodeName, key)
+func (h HttpClient) kvURL(key string) string {
+	return fmt.Sprintf("http://%s:8500/v1/kv/%s", h.ConsulHost(), key)
 }
 
 func (h HttpClient) directoryStateURL(nodeName string, index int, wait string) string {
@@ -1,16 +1,18 @@
 package consul
 
 import (
+	"context"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"github.com/wakeful-deployment/operator/logger"
+	"github.com/wakeful-deployment/operator/metrics"
 	"github.com/wakeful-deployment/operator/service"
+	"sort"
 	"strings"
 )
 
-func RegisteredServices(client Client) ([]service.Service, error) {
-	output, err := client.RegisteredServices()
+func RegisteredServices(ctx context.Context, client Client) ([]ServiceRepresentation, error) {
+	output, err := client.RegisteredServices(ctx)
 
 	if err != nil {
 		return nil, err
@@ -24,40 +26,195 @@ func RegisteredServices(client Client) ([]service.Service, error) {
 	return services, nil
 }
 
-func NormalizeServices(client Client, desired []service.Service, current []service.Service) error {
-	removed := Diff(current, desired)
-	added := Diff(desired, current)
+// CheckPassing is the status of a check which passed the last time it ran
+const CheckPassing = "passing"
 
-	logger.Info(fmt.Sprintf("removed services: %v", removed))
-	logger.Info(fmt.Sprintf("added services: %v", added))
+// CheckStatus is a check as reported by /v1/agent/checks
+type CheckStatus struct {
+	CheckID   string
+	ServiceID string
+	Status    string
+	Output    string
+}
+
+// ServiceChecks returns the checks the agent runs for the service, sorted
+// by their id
+func ServiceChecks(ctx context.Context, client Client, serviceID string) ([]CheckStatus, error) {
+	output, err := client.Checks(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return parseChecks(output, serviceID)
+}
+
+type checksByID []CheckStatus
+
+func (c checksByID) Len() int           { return len(c) }
+func (c checksByID) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+func (c checksByID) Less(i, j int) bool { return c[i].CheckID < c[j].CheckID }
+
+func parseChecks(body string, serviceID string) ([]CheckStatus, error) {
+	var checks map[string]CheckStatus
+	var result []CheckStatus
+
+	if strings.TrimSpace(body) == "" {
+		return result, nil
+	}
+
+	err := json.NewDecoder(strings.NewReader(body)).Decode(&checks)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, c := range checks {
+		if c.ServiceID == serviceID {
+			result = append(result, c)
+		}
+	}
+
+	sort.Sort(checksByID(result))
+
+	return result, nil
+}
+
+// Register registers the service, keeping count for the metrics
+func Register(ctx context.Context, client Client, s service.Service) error {
+	metrics.ConsulRegistrations.Inc()
+	err := client.Register(ctx, s)
+
+	if err != nil {
+		metrics.ConsulRegistrationFailures.Inc()
+	}
+
+	return err
+}
+
+// Deregister deregisters the service, keeping count for the metrics
+func Deregister(ctx context.Context, client Client, s service.Service) error {
+	metrics.ConsulDeregistrations.Inc()
+	err := client.Deregister(ctx, s)
+
+	if err != nil {
+		metrics.ConsulDeregistrationFailures.Inc()
+	}
+
+	return err
+}
+
+// ServicePlan is what NormalizeServices would do. Services which changed are
+// registered again, which replaces the old registration.
+type ServicePlan struct {
+	Register   []ServiceRepresentation
+	Deregister []ServiceRepresentation
+}
+
+func (p ServicePlan) Empty() bool {
+	return len(p.Register) == 0 && len(p.Deregister) == 0
+}
 
-	errs := []error{}
-	for _, service := range added {
-		err := client.Register(service)
+// PlanServices works out which services need to be registered or
+// deregistered without changing anything
+func PlanServices(client Client, desired []service.Service, current []ServiceRepresentation) ServicePlan {
+	var desiredReps []ServiceRepresentation
+
+	for _, s := range desired {
+		desiredReps = append(desiredReps, NewServiceRepresentation(s, client.NodeAddress()))
+	}
+
+	return ServicePlan{
+		Register:   append(Diff(desiredReps, current), Changed(desiredReps, current)...),
+		Deregister: Diff(current, desiredReps),
+	}
+}
+
+func NormalizeServices(ctx context.Context, client Client, desired []service.Service, current []ServiceRepresentation) error {
+	desiredServices := make(map[string]service.Service)
+
+	for _, s := range desired {
+		desiredServices[s.Name] = s
+	}
+
+	plan := PlanServices(client, desired, current)
+
+	logger.Debug("normalizing services", logger.Fields{"register": IDs(plan.Register), "deregister": IDs(plan.Deregister)})
+
+	errs := Errors{}
+	for _, rep := range plan.Register {
+		// registering again with the same ID replaces the old registration
+		logger.Info("registering service", logger.Fields{"service": rep.ID, "port": rep.Port, "tags": rep.Tags})
+		err := Register(ctx, client, desiredServices[rep.ID])
 
 		if err != nil {
-			errs = append(errs, err)
+			logger.Error("registering service failed", logger.Fields{"service": rep.ID, "error": err})
+			errs[rep.ID] = err
 		}
 	}
 
-	for _, service := range removed {
-		err := client.Deregister(service)
+	for _, rep := range plan.Deregister {
+		// services are deregistered by ID, which isn't necessarily the
+		// name for services someone else registered
+		logger.Info("deregistering service", logger.Fields{"service": rep.ID})
+		err := Deregister(ctx, client, service.Service{Name: rep.ID})
+
 		if err != nil {
-			errs = append(errs, err)
+			logger.Error("deregistering service failed", logger.Fields{"service": rep.ID, "error": err})
+			errs[rep.ID] = err
 		}
 	}
 
 	if len(errs) > 0 {
-		errMsg := fmt.Sprintf("ERROR: At least 1 error normalizing services: %v", errs)
-		return errors.New(errMsg)
+		return errs
 	}
 
 	return nil
 }
 
-func parseResponse(body string) ([]service.Service, error) {
-	var serviceDescriptions map[string]service.Service
-	var services []service.Service
+// Errors are the failures of normalizing services, by service ID
+type Errors map[string]error
+
+func (e Errors) Error() string {
+	return fmt.Sprintf("ERROR: At least 1 error normalizing services: %v", sortedErrors(e))
+}
+
+func sortedErrors(errs map[string]error) []string {
+	var result []string
+
+	for name, err := range errs {
+		result = append(result, fmt.Sprintf("%s: %v", name, err))
+	}
+
+	sort.Strings(result)
+
+	return result
+}
+
+// IDs returns the IDs of the services
+func IDs(reps []ServiceRepresentation) []string {
+	var result []string
+
+	for _, rep := range reps {
+		result = append(result, rep.ID)
+	}
+
+	return result
+}
+
+// agentService is a service as reported by /v1/agent/services
+type agentService struct {
+	ID      string
+	Service string
+	Tags    []string
+	Address string
+	Port    int
+	Meta    map[string]string
+}
+
+func parseResponse(body string) ([]ServiceRepresentation, error) {
+	var serviceDescriptions map[string]agentService
+	var services []ServiceRepresentation
 
 	body = strings.Trim(body, "")
 
@@ -72,23 +229,30 @@ func parseResponse(body string) ([]service.Service, error) {
 		return nil, err
 	}
 
-	for name, service := range serviceDescriptions {
-		service.Name = name
-		services = append(services, service)
+	for id, s := range serviceDescriptions {
+		rep := ServiceRepresentation{
+			ID:      id,
+			Name:    s.Service,
+			Tags:    s.Tags,
+			Address: s.Address,
+			Port:    s.Port,
+			Meta:    s.Meta,
+		}
+		services = append(services, rep)
 	}
 
 	return services, nil
 }
 
-func Diff(left []service.Service, right []service.Service) []service.Service {
-	var result []service.Service
+func Diff(left []ServiceRepresentation, right []ServiceRepresentation) []ServiceRepresentation {
+	var result []ServiceRepresentation
 
 	for _, leftItem := range left {
 		// Let's assume at first it is missing
 		isMissing := true
 
 		for _, rightItem := range right {
-			if leftItem.Name == rightItem.Name {
+			if leftItem.ID == rightItem.ID {
 				// If we find a match, then it's not missing
 				isMissing = false
 				break
@@ -103,3 +267,22 @@ func Diff(left []service.Service, right []service.Service) []service.Service {
 
 	return result
 }
+
+// Changed returns the desired services which are registered, but with a
+// different name, address, port, tags or checks
+func Changed(desired []ServiceRepresentation, current []ServiceRepresentation) []ServiceRepresentation {
+	var result []ServiceRepresentation
+
+	for _, d := range desired {
+		for _, c := range current {
+			if d.ID == c.ID {
+				if !d.Equal(c) {
+					result = append(result, d)
+				}
+				break
+			}
+		}
+	}
+
+	return result
+}
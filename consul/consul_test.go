@@ -0,0 +1,58 @@
+package consul
+
+import (
+	"github.com/wakeful-deployment/operator/service"
+	"testing"
+)
+
+func TestChangedChecks(t *testing.T) {
+	web := service.Service{Name: "web", Ports: []service.PortPair{service.PortPair{Incoming: 8000, Outgoing: 8000}}}
+	registered := []ServiceRepresentation{NewServiceRepresentation(web, "")}
+
+	if changed := Changed(registered, registered); len(changed) != 0 {
+		t.Errorf("Expected nothing to have changed but got %v", changed)
+	}
+
+	web.Checks = []service.Check{service.Check{HTTP: "http://localhost:8000/_health"}}
+	desired := []ServiceRepresentation{NewServiceRepresentation(web, "")}
+
+	if changed := Changed(desired, registered); len(changed) != 1 {
+		t.Errorf("Expected an added check to change the service but got %v", changed)
+	}
+
+	if changed := Changed(registered, desired); len(changed) != 1 {
+		t.Errorf("Expected a removed check to change the service but got %v", changed)
+	}
+
+	web.Checks[0].Interval = "30s"
+	changedCheck := []ServiceRepresentation{NewServiceRepresentation(web, "")}
+
+	if changed := Changed(changedCheck, desired); len(changed) != 1 {
+		t.Errorf("Expected a changed check to change the service but got %v", changed)
+	}
+
+	services, err := parseResponse(`{"web":{"ID":"web","Service":"web","Tags":null,"Address":"","Port":8000,"Meta":{"wakeful_checks":"` + desired[0].Meta[ChecksMetaKey] + `"}}}`)
+
+	if err != nil || len(Changed(desired, services)) != 0 {
+		t.Errorf("Expected the checks registered in consul to match but got %v, %v", services, err)
+	}
+}
+
+func TestParseChecks(t *testing.T) {
+	body := `{
+		"service:web:2": {"CheckID": "service:web:2", "ServiceID": "web", "Status": "critical", "Output": "connection refused"},
+		"service:web:1": {"CheckID": "service:web:1", "ServiceID": "web", "Status": "passing"},
+		"service:redis": {"CheckID": "service:redis", "ServiceID": "redis", "Status": "passing"},
+		"serfHealth": {"CheckID": "serfHealth", "Status": "passing"}
+	}`
+
+	checks, err := parseChecks(body, "web")
+
+	if err != nil {
+		t.Fatalf("Expected the checks to parse but got %v", err)
+	}
+
+	if len(checks) != 2 || checks[0].CheckID != "service:web:1" || checks[1].Status != "critical" {
+		t.Errorf("Expected the two checks of web sorted by id but got %v", checks)
+	}
+}
@@ -0,0 +1,149 @@
+package consul
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+func NodeKey(nodeName string) string {
+	return fmt.Sprintf("_wakeful/nodes/%s", nodeName)
+}
+
+func MetadataKey(nodeName string, key string) string {
+	return fmt.Sprintf("%s/metadata/%s", NodeKey(nodeName), key)
+}
+
+func FailureKey(nodeName string, serviceName string) string {
+	return fmt.Sprintf("%s/failures/%s", NodeKey(nodeName), serviceName)
+}
+
+func StatusKey(nodeName string) string {
+	return fmt.Sprintf("%s/status", NodeKey(nodeName))
+}
+
+func InvalidKey(nodeName string, serviceName string) string {
+	return fmt.Sprintf("%s/invalid/%s", NodeKey(nodeName), serviceName)
+}
+
+// UpgradeFailure is written to FailureKey when a service's new image never
+// became healthy, so whoever deployed it can see why it didn't roll out
+type UpgradeFailure struct {
+	Image string `json:"image"`
+	// Hash is the spec hash of the container which failed, so the same spec
+	// isn't tried or planned again
+	Hash  string    `json:"hash"`
+	Error string    `json:"error"`
+	Time  time.Time `json:"time"`
+}
+
+func PostUpgradeFailure(ctx context.Context, client Client, nodeName string, serviceName string, failure UpgradeFailure) error {
+	b, err := json.Marshal(failure)
+
+	if err != nil {
+		return err
+	}
+
+	return client.PutKey(ctx, FailureKey(nodeName, serviceName), string(b))
+}
+
+// UpgradeFailures are the failures written for the node, by service name.
+// A failure which can't be decoded is still listed, so it can be cleared.
+func UpgradeFailures(ctx context.Context, client Client, nodeName string) (map[string]UpgradeFailure, error) {
+	keys, err := client.ListKeys(ctx, FailureKey(nodeName, ""))
+
+	if err != nil {
+		return nil, err
+	}
+
+	failures := make(map[string]UpgradeFailure)
+
+	for _, kv := range keys {
+		var failure UpgradeFailure
+		json.Unmarshal(kv.DecodedValue(), &failure)
+		failures[kv.Name()] = failure
+	}
+
+	return failures, nil
+}
+
+func ClearUpgradeFailure(ctx context.Context, client Client, nodeName string, serviceName string) error {
+	return client.DeleteKey(ctx, FailureKey(nodeName, serviceName))
+}
+
+// InvalidService is written to InvalidKey while a service's key can't be
+// decoded or validated, so whoever wrote it can see why it isn't running
+type InvalidService struct {
+	Error string    `json:"error"`
+	Time  time.Time `json:"time"`
+}
+
+func PostInvalidService(ctx context.Context, client Client, nodeName string, serviceName string, invalid InvalidService) error {
+	b, err := json.Marshal(invalid)
+
+	if err != nil {
+		return err
+	}
+
+	return client.PutKey(ctx, InvalidKey(nodeName, serviceName), string(b))
+}
+
+// ReportedInvalidServices are the invalid services written for the node, by name
+func ReportedInvalidServices(ctx context.Context, client Client, nodeName string) (map[string]InvalidService, error) {
+	keys, err := client.ListKeys(ctx, InvalidKey(nodeName, ""))
+
+	if err != nil {
+		return nil, err
+	}
+
+	invalid := make(map[string]InvalidService)
+
+	for _, kv := range keys {
+		var service InvalidService
+		json.Unmarshal(kv.DecodedValue(), &service)
+		invalid[kv.Name()] = service
+	}
+
+	return invalid, nil
+}
+
+func ClearInvalidService(ctx context.Context, client Client, nodeName string, serviceName string) error {
+	return client.DeleteKey(ctx, InvalidKey(nodeName, serviceName))
+}
+
+const (
+	ServiceRunning = "running"
+	ServiceFailed  = "failed"
+	ServicePending = "pending"
+	ServiceExited  = "exited"
+)
+
+// NodeStatus is written to StatusKey after every tick, so deploys can watch
+// consul to see a rollout finish instead of asking every node
+type NodeStatus struct {
+	State              string                   `json:"state"`
+	Error              string                   `json:"error,omitempty"`
+	LastTick           time.Time                `json:"last_tick"`
+	LastSuccessfulTick *time.Time               `json:"last_successful_tick"`
+	Version            string                   `json:"version"`
+	Services           map[string]ServiceStatus `json:"services"`
+}
+
+// ServiceStatus is one of ServiceRunning, ServiceFailed, ServicePending or
+// ServiceExited, with the error of a failed service and its container
+type ServiceStatus struct {
+	Status    string `json:"status"`
+	Error     string `json:"error,omitempty"`
+	Container string `json:"container,omitempty"`
+}
+
+func PostNodeStatus(ctx context.Context, client Client, nodeName string, status NodeStatus) error {
+	b, err := json.Marshal(status)
+
+	if err != nil {
+		return err
+	}
+
+	return client.PutKey(ctx, StatusKey(nodeName), string(b))
+}
@@ -25,17 +25,25 @@ func (kv KV) DecodedValue() []byte {
 	return decoded
 }
 
+// DecodeService decodes and validates the service stored in the key,
+// rejecting fields which are not part of service.Service
 func (kv KV) DecodeService() (*service.Service, error) {
 	service := &service.Service{}
 	b := kv.DecodedValue()
-	reader := bytes.NewReader(b)
-	err := json.NewDecoder(reader).Decode(&service)
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&service)
 
 	if err != nil {
 		return nil, err
 	}
 
 	service.Name = kv.Name()
+	err = service.Validate()
+
+	if err != nil {
+		return nil, err
+	}
 
 	return service, nil
 }
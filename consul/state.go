@@ -1,6 +1,7 @@
 package consul
 
 import (
+	"fmt"
 	"github.com/wakeful-deployment/operator/service"
 )
 
@@ -9,18 +10,30 @@ type DirectoryState struct {
 	KVs   []KV
 }
 
-func (s DirectoryState) Services() ([]*service.Service, error) {
+// InvalidServices are the keys which could not be decoded or validated, by
+// service name
+type InvalidServices map[string]error
+
+func (e InvalidServices) Error() string {
+	return fmt.Sprintf("ERROR: At least 1 invalid service: %v", sortedErrors(e))
+}
+
+// Services returns every valid service, and the invalid ones separately so
+// one bad key doesn't stop the others from being run
+func (s DirectoryState) Services() ([]*service.Service, InvalidServices) {
 	var services []*service.Service
+	invalid := InvalidServices{}
 
 	for _, kv := range s.KVs {
 		service, err := kv.DecodeService()
 
 		if err != nil {
-			return nil, err
+			invalid[kv.Name()] = err
+			continue
 		}
 
 		services = append(services, service)
 	}
 
-	return services, nil
+	return services, invalid
 }
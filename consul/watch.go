@@ -0,0 +1,115 @@
+package consul
+
+import (
+	"context"
+	"errors"
+	"github.com/wakeful-deployment/operator/logger"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// DefaultMinInterval is the least time between two queries of a watch
+const DefaultMinInterval = time.Second
+
+// DefaultWaitJitter is the most a watch adds to its wait, as a fraction of it
+const DefaultWaitJitter = 1.0 / 16
+
+// QueryFunc runs one blocking query from index, which consul holds open for
+// at most wait. The caller passes the index of the response on to Advance.
+type QueryFunc func(ctx context.Context, index int, wait string) error
+
+// Watch runs a blocking query over and over the way consul asks clients to:
+//
+//   - when the index it advances to goes backwards (ex: a snapshot was
+//     restored) it starts over from 0, instead of blocking until consul
+//     catches back up
+//   - otherwise the index it advances to is never less than 1, since 0
+//     doesn't block
+//   - queries are at least MinInterval apart, so something which changes
+//     constantly, or a query which fails straight away, doesn't spin
+//   - a little jitter is added to the wait, so nodes started together don't
+//     all query at the same moment
+//
+// It can watch anything which returns an X-Consul-Index, ex: the services
+// of a node, health checks or the catalog.
+type Watch struct {
+	Wait        string
+	MinInterval time.Duration
+	WaitJitter  float64
+
+	index  int
+	last   time.Time
+	random func() float64
+}
+
+func NewWatch(wait string) *Watch {
+	return &Watch{Wait: wait, MinInterval: DefaultMinInterval, WaitJitter: DefaultWaitJitter, random: rand.Float64}
+}
+
+// Index is the index the next query will block on
+func (w *Watch) Index() int {
+	return w.index
+}
+
+// Query waits out MinInterval since the last query, then runs query from
+// the current index. The index is not moved forward until Advance is
+// called, so a result which couldn't be handled is fetched again.
+func (w *Watch) Query(ctx context.Context, query QueryFunc) error {
+	if !w.last.IsZero() {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(w.MinInterval - time.Since(w.last)):
+		}
+	}
+
+	w.last = time.Now()
+	return query(ctx, w.index, w.jitteredWait())
+}
+
+// Advance moves the watch on to index, once its result has been handled.
+// An index less than the current one starts the watch over from 0.
+func (w *Watch) Advance(index int) {
+	if index < w.index {
+		logger.Warn("consul index went backwards, starting the watch over", logger.Fields{"index": index, "previous_index": w.index})
+		w.index = 0
+		return
+	}
+
+	if index < 1 {
+		index = 1
+	}
+
+	w.index = index
+}
+
+func (w *Watch) jitteredWait() string {
+	d, err := time.ParseDuration(w.Wait)
+
+	if err != nil || d <= 0 || w.WaitJitter <= 0 {
+		return w.Wait
+	}
+
+	random := w.random
+
+	if random == nil {
+		random = rand.Float64
+	}
+
+	d += time.Duration(random() * w.WaitJitter * float64(d))
+
+	return d.Truncate(time.Millisecond).String()
+}
+
+// QueryIndex is the X-Consul-Index of a response to a blocking query
+func QueryIndex(resp *http.Response) (int, error) {
+	header := resp.Header.Get("X-Consul-Index")
+
+	if header == "" {
+		return 0, errors.New("response has no X-Consul-Index header")
+	}
+
+	return strconv.Atoi(header)
+}
@@ -0,0 +1,117 @@
+package consul
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestWatchResetsWhenTheIndexGoesBackwards(t *testing.T) {
+	w := NewWatch("5m")
+	w.MinInterval = 0
+
+	var queried []int
+	query := func(ctx context.Context, from int, wait string) error {
+		queried = append(queried, from)
+		return nil
+	}
+
+	w.Query(context.Background(), query)
+	w.Advance(42)
+	w.Query(context.Background(), query)
+	w.Advance(7)
+
+	if w.Index() != 0 {
+		t.Errorf("expected the watch to start over from 0, but it is at %d", w.Index())
+	}
+
+	w.Query(context.Background(), query)
+	w.Advance(7)
+
+	if w.Index() != 7 {
+		t.Errorf("expected the watch to move on to 7, but it is at %d", w.Index())
+	}
+
+	expected := []int{0, 42, 0}
+
+	for i, index := range expected {
+		if queried[i] != index {
+			t.Errorf("expected query %d to be from index %d, but was from %d", i, index, queried[i])
+		}
+	}
+}
+
+func TestWatchKeepsTheIndexWhenNotAdvanced(t *testing.T) {
+	w := NewWatch("5m")
+	w.MinInterval = 0
+	w.Advance(0)
+
+	if w.Index() != 1 {
+		t.Errorf("expected the index to never be less than 1, but was %d", w.Index())
+	}
+
+	w.Advance(42)
+
+	err := w.Query(context.Background(), func(ctx context.Context, index int, wait string) error {
+		return errors.New("boom")
+	})
+
+	if err == nil || w.Index() != 42 {
+		t.Errorf("expected a failed query to keep index 42, but got %d and %v", w.Index(), err)
+	}
+}
+
+func TestWatchWaitsBetweenQueries(t *testing.T) {
+	w := NewWatch("5m")
+	w.MinInterval = 50 * time.Millisecond
+
+	query := func(ctx context.Context, index int, wait string) error {
+		return nil
+	}
+
+	start := time.Now()
+	w.Query(context.Background(), query)
+	w.Query(context.Background(), query)
+
+	if elapsed := time.Since(start); elapsed < w.MinInterval {
+		t.Errorf("expected the second query to wait at least %v, but it ran after %v", w.MinInterval, elapsed)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := w.Query(ctx, query); err != context.Canceled {
+		t.Errorf("expected a cancelled watch to return straight away, but got %v", err)
+	}
+}
+
+func TestWatchJittersTheWait(t *testing.T) {
+	w := NewWatch("4m")
+	w.random = func() float64 { return 0.5 }
+
+	var waited string
+	w.Query(context.Background(), func(ctx context.Context, index int, wait string) error {
+		waited = wait
+		return nil
+	})
+
+	if waited != "4m7.5s" {
+		t.Errorf("expected the wait to be 4m7.5s, but was %s", waited)
+	}
+}
+
+func TestQueryIndex(t *testing.T) {
+	resp := &http.Response{Header: http.Header{}}
+
+	if _, err := QueryIndex(resp); err == nil {
+		t.Error("expected a missing X-Consul-Index to be an error")
+	}
+
+	resp.Header.Set("X-Consul-Index", "42")
+
+	if index, err := QueryIndex(resp); err != nil || index != 42 {
+		t.Errorf("expected index 42, but got %d and %v", index, err)
+	}
+}
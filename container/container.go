@@ -1,12 +1,165 @@
 package container
 
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+)
+
 type Container struct {
-	Name    string
-	Image   string
-	Ports   []string
-	Env     map[string]string
-	Restart string
-	Tags    []string
+	ID           string            `json:"id,omitempty"`
+	Name         string            `json:"name"`
+	Image        string            `json:"image"`
+	ImageID      string            `json:"image_id,omitempty"`
+	Ports        []string          `json:"ports,omitempty"`
+	Env          map[string]string `json:"env,omitempty"`
+	Restart      string            `json:"restart,omitempty"`
+	Tags         []string          `json:"tags,omitempty"`
+	Labels       map[string]string `json:"labels,omitempty"`
+	State        string            `json:"state,omitempty"`
+	Health       string            `json:"health,omitempty"`
+	ExitCode     int               `json:"exit_code,omitempty"`
+	RestartCount int               `json:"restart_count,omitempty"`
+	Mounts       []Mount           `json:"mounts,omitempty"`
+	Resources    Resources         `json:"resources"`
+	Command      []string          `json:"command,omitempty"`
+	Entrypoint   []string          `json:"entrypoint,omitempty"`
+	Workdir      string            `json:"workdir,omitempty"`
+	User         string            `json:"user,omitempty"`
+	Hostname     string            `json:"hostname,omitempty"`
+	NetworkMode  string            `json:"network_mode,omitempty"`
+	Networks     []Network         `json:"networks,omitempty"`
+	PullPolicy   string            `json:"pull_policy,omitempty"`
+	Auth         *RegistryAuth     `json:"-"`
+}
+
+// Mount types
+const (
+	NamedVolume = "volume"
+	BindMount   = "bind"
+	TmpfsMount  = "tmpfs"
+)
+
+// Mount is storage mounted into the container: a named volume, a bind
+// mount of a host path or a tmpfs
+type Mount struct {
+	Type      string `json:"type"`
+	Source    string `json:"source,omitempty"`
+	Target    string `json:"target"`
+	ReadOnly  bool   `json:"read_only,omitempty"`
+	Ephemeral bool   `json:"ephemeral,omitempty"`
+}
+
+// Pull policies, when to pull the image before running the container
+const (
+	PullAlways       = "always"
+	PullIfNotPresent = "if-not-present"
+	PullNever        = "never"
+)
+
+// RegistryAuth are the credentials for a private registry, ex:
+// {"username": "deploy", "password": "s3cret"}. A container carries the
+// ones for its image in Auth, which is never encoded.
+type RegistryAuth struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// Redacted stands in for secrets in logs and the status api
+const Redacted = "<redacted>"
+
+func (a RegistryAuth) String() string {
+	return fmt.Sprintf("{%s %s}", a.Username, Redacted)
+}
+
+// MarshalJSON leaves out the password, since the desired state is logged
+// and served by the status api
+func (a RegistryAuth) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]string{"username": a.Username, "password": Redacted})
+}
+
+// Network is a user-defined docker network the container is attached to,
+// under its name and any aliases. Networks are sorted by name.
+type Network struct {
+	Name    string   `json:"name"`
+	Aliases []string `json:"aliases,omitempty"`
+}
+
+// Resources are the limits of the container, with sizes in bytes. Zero
+// means unlimited.
+type Resources struct {
+	CPUShares         int64    `json:"cpu_shares,omitempty"`
+	CPUQuota          int64    `json:"cpu_quota,omitempty"`
+	Memory            int64    `json:"memory,omitempty"`
+	MemoryReservation int64    `json:"memory_reservation,omitempty"`
+	PidsLimit         int64    `json:"pids_limit,omitempty"`
+	Ulimits           []Ulimit `json:"ulimits,omitempty"`
+}
+
+// Ulimit is one ulimit, ulimits are sorted by name
+type Ulimit struct {
+	Name string `json:"name"`
+	Soft int64  `json:"soft"`
+	Hard int64  `json:"hard"`
+}
+
+func (r Resources) Empty() bool {
+	return r.CPUShares == 0 && r.CPUQuota == 0 && r.Memory == 0 && r.MemoryReservation == 0 && r.PidsLimit == 0 && len(r.Ulimits) == 0
+}
+
+// spec is everything about a container which requires it to be recreated
+// when changed. Runtime details (ID, ImageID, Labels, State, Health,
+// ExitCode, RestartCount), consul-only settings (Tags) and how the image is pulled
+// (PullPolicy, Auth) are left out on purpose.
+type spec struct {
+	Name        string            `json:"name"`
+	Image       string            `json:"image"`
+	Ports       []string          `json:"ports,omitempty"`
+	Env         map[string]string `json:"env,omitempty"`
+	Restart     string            `json:"restart,omitempty"`
+	Mounts      []Mount           `json:"mounts,omitempty"`
+	Resources   *Resources        `json:"resources,omitempty"`
+	Command     []string          `json:"command,omitempty"`
+	Entrypoint  []string          `json:"entrypoint,omitempty"`
+	Workdir     string            `json:"workdir,omitempty"`
+	User        string            `json:"user,omitempty"`
+	Hostname    string            `json:"hostname,omitempty"`
+	NetworkMode string            `json:"network_mode,omitempty"`
+	Networks    []Network         `json:"networks,omitempty"`
+}
+
+// Hash is a short fingerprint of the container's spec, used to cheaply tell
+// if a running container was started from the current spec
+func (c Container) Hash() string {
+	s := spec{
+		Name:        c.Name,
+		Image:       c.Image,
+		Ports:       c.Ports,
+		Env:         c.Env,
+		Restart:     c.Restart,
+		Mounts:      c.Mounts,
+		Command:     c.Command,
+		Entrypoint:  c.Entrypoint,
+		Workdir:     c.Workdir,
+		User:        c.User,
+		Hostname:    c.Hostname,
+		NetworkMode: c.NetworkMode,
+		Networks:    c.Networks,
+	}
+
+	// left out when unlimited, so containers started before there were
+	// limits keep their hash
+	if !c.Resources.Empty() {
+		s.Resources = &c.Resources
+	}
+
+	// marshaling a struct of strings, slices and maps can't fail and
+	// encoding/json sorts map keys, so the result is stable
+	b, _ := json.Marshal(s)
+	sum := sha256.Sum256(b)
+
+	return hex.EncodeToString(sum[:])[:16]
 }
 
 func Diff(left []Container, right []Container) []Container {
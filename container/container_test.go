@@ -1,6 +1,9 @@
 package container
 
 import (
+	"encoding/json"
+	"fmt"
+	"strings"
 	"testing"
 )
 
@@ -97,3 +100,38 @@ func TestDiff(t *testing.T) {
 		t.Errorf("expected added to be %v, but was %v", expectedAdded, added)
 	}
 }
+
+func TestHash(t *testing.T) {
+	c := Container{Name: "redis", Image: "redis:3.0", Env: map[string]string{"FOO": "BAR", "BAZ": "QUX"}}
+
+	same := c
+	same.ID = "921582f62758"
+	same.Labels = map[string]string{"foo": "bar"}
+	same.Tags = []string{"cache"}
+	same.PullPolicy = PullAlways
+	same.Auth = &RegistryAuth{Username: "deploy", Password: "s3cret"}
+
+	if c.Hash() != same.Hash() {
+		t.Errorf("expected ID, Labels, Tags and how the image is pulled to not change the hash, but %s != %s", c.Hash(), same.Hash())
+	}
+
+	changed := c
+	changed.Image = "redis:3.2"
+
+	if c.Hash() == changed.Hash() {
+		t.Errorf("expected a new image to change the hash, but both were %s", c.Hash())
+	}
+}
+
+func TestRegistryAuthIsRedacted(t *testing.T) {
+	auth := RegistryAuth{Username: "deploy", Password: "s3cret"}
+	b, err := json.Marshal(map[string]RegistryAuth{"registry:5000": auth})
+
+	if err != nil {
+		t.Fatalf("Got an error: %v", err)
+	}
+
+	if text := fmt.Sprintf("%v", auth); strings.Contains(string(b), "s3cret") || strings.Contains(text, "s3cret") {
+		t.Errorf("expected the password to be redacted, but got %s and %s", b, text)
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/wakeful-deployment/operator/consul"
+	"github.com/wakeful-deployment/operator/container"
+	"github.com/wakeful-deployment/operator/docker"
+	"github.com/wakeful-deployment/operator/logger"
+	"github.com/wakeful-deployment/operator/node"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Differences are how the node differs from the desired state, by container
+// or service name, ex: {"proxy": ["image is proxy:1, expected proxy:2"]}
+type Differences struct {
+	Containers map[string][]string `json:"containers"`
+	Services   map[string][]string `json:"services"`
+}
+
+func (d Differences) Empty() bool {
+	return len(d.Containers) == 0 && len(d.Services) == 0
+}
+
+// Diff compares every desired container and service with what is actually
+// running and registered
+func Diff(ctx context.Context, dockerClient docker.Client, consulClient consul.Client, desiredState *State, currentNodeState *node.State) Differences {
+	differences := Differences{Containers: make(map[string][]string), Services: make(map[string][]string)}
+	currentNodeState = currentNodeState.Without(desiredState.InvalidNames())
+	desiredContainers := stateContainers(desiredState, consulClient)
+
+	for _, d := range desiredContainers {
+		c, ok := findContainer(currentNodeState.Containers, d.Name)
+
+		if !ok {
+			differences.Containers[d.Name] = []string{"is not running"}
+			continue
+		}
+
+		if !docker.Managed(c) {
+			differences.Containers[d.Name] = []string{"is running, but not managed by operator"}
+			continue
+		}
+
+		actual, err := dockerClient.Inspect(ctx, c)
+
+		if err != nil {
+			logger.Error("could not inspect container", logger.Fields{"container": c.Name, "error": err})
+			differences.Containers[d.Name] = []string{fmt.Sprintf("could not be inspected: %v", err)}
+			continue
+		}
+
+		if drift := docker.Drift(d, actual); len(drift) > 0 {
+			differences.Containers[d.Name] = drift
+		}
+	}
+
+	for _, c := range currentNodeState.Containers {
+		if _, ok := findContainer(desiredContainers, c.Name); !ok && docker.Managed(c) {
+			differences.Containers[c.Name] = []string{"is running, but not desired"}
+		}
+	}
+
+	var desiredReps []consul.ServiceRepresentation
+
+	for _, s := range desiredState.Services {
+		desiredReps = append(desiredReps, consul.NewServiceRepresentation(*s, consulClient.NodeAddress()))
+	}
+
+	for _, d := range desiredReps {
+		r, ok := findService(currentNodeState.Services, d.ID)
+
+		if !ok {
+			differences.Services[d.ID] = []string{"is not registered"}
+			continue
+		}
+
+		if drift := serviceDrift(d, r); len(drift) > 0 {
+			differences.Services[d.ID] = drift
+		}
+	}
+
+	for _, r := range currentNodeState.Services {
+		if _, ok := findService(desiredReps, r.ID); !ok {
+			differences.Services[r.ID] = []string{"is registered, but not desired"}
+		}
+	}
+
+	return differences
+}
+
+func serviceDrift(desired consul.ServiceRepresentation, actual consul.ServiceRepresentation) []string {
+	var drift []string
+
+	if desired.Name != actual.Name {
+		drift = append(drift, fmt.Sprintf("name is %s, expected %s", actual.Name, desired.Name))
+	}
+
+	if desired.Address != actual.Address {
+		drift = append(drift, fmt.Sprintf("address is '%s', expected '%s'", actual.Address, desired.Address))
+	}
+
+	if desired.Port != actual.Port {
+		drift = append(drift, fmt.Sprintf("port is %d, expected %d", actual.Port, desired.Port))
+	}
+
+	if strings.Join(desired.Tags, ",") != strings.Join(actual.Tags, ",") {
+		drift = append(drift, fmt.Sprintf("tags are %v, expected %v", actual.Tags, desired.Tags))
+	}
+
+	// consul doesn't report the checks themselves, only their fingerprint
+	// in Meta, which is also what registering again goes by
+	if desired.Meta[consul.ChecksMetaKey] != actual.Meta[consul.ChecksMetaKey] {
+		drift = append(drift, "checks differ from the desired checks")
+	}
+
+	return drift
+}
+
+func findContainer(containers []container.Container, name string) (container.Container, bool) {
+	for _, c := range containers {
+		if c.Name == name {
+			return c, true
+		}
+	}
+
+	return container.Container{}, false
+}
+
+func findService(reps []consul.ServiceRepresentation, id string) (consul.ServiceRepresentation, bool) {
+	for _, r := range reps {
+		if r.ID == id {
+			return r, true
+		}
+	}
+
+	return consul.ServiceRepresentation{}, false
+}
+
+// WriteText writes one line per difference, ex: "container proxy: is not running"
+func (d Differences) WriteText(w io.Writer) {
+	if d.Empty() {
+		fmt.Fprintln(w, "No differences.")
+		return
+	}
+
+	writeDifferences(w, "container", d.Containers)
+	writeDifferences(w, "service", d.Services)
+}
+
+func writeDifferences(w io.Writer, kind string, differences map[string][]string) {
+	var names []string
+
+	for name := range differences {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		for _, difference := range differences[name] {
+			fmt.Fprintf(w, "%s %s: %s\n", kind, name, difference)
+		}
+	}
+}
+
+// runDiff prints how the node differs from the desired state right now as
+// text or json and returns the exit code, the same ones as runPlan
+func runDiff(ctx context.Context, dockerClient docker.Client, consulClient consul.Client, bootState *State, format string, w io.Writer) int {
+	desiredState, currentNodeState, err := observe(ctx, dockerClient, consulClient, bootState)
+
+	if err != nil {
+		return PlanFailed
+	}
+
+	differences := Diff(ctx, dockerClient, consulClient, desiredState, currentNodeState)
+
+	if format == "json" {
+		err = json.NewEncoder(w).Encode(differences)
+
+		if err != nil {
+			logger.Error("encoding the differences failed", logger.Fields{"error": err})
+			return PlanFailed
+		}
+	} else {
+		differences.WriteText(w)
+	}
+
+	if differences.Empty() {
+		return PlanNoChanges
+	}
+
+	return PlanChanges
+}
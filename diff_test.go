@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"github.com/wakeful-deployment/operator/consul"
+	"github.com/wakeful-deployment/operator/container"
+	"github.com/wakeful-deployment/operator/service"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	var startedContainers []string
+	var stoppedContainers []string
+	dockerClient := dockerClient(&startedContainers, &stoppedContainers)
+	dockerClient.RunningContainersResponse = func() ([]container.Container, error) {
+		return []container.Container{
+			container.Container{Name: "consul", Image: "plum/wake-consul-agent:latest"},
+			container.Container{Name: "statsite", Image: "plum/wake-statsite:latest", Labels: managed("statsite")},
+			container.Container{Name: "old", Image: "plum/old:latest", Labels: managed("old")},
+		}, nil
+	}
+	state := bootState()
+	state.Services["statsite"].Image = "plum/wake-statsite:latest"
+
+	dockerClient.InspectResponse = func(c container.Container) (container.Container, error) {
+		actual := state.Services["statsite"].Container("", "127.0.0.1")
+		actual.Image = "plum/wake-statsite:1"
+		return actual, nil
+	}
+
+	var registeredServices []string
+	var deregisteredServices []string
+	consulClient := consulClient(&registeredServices, &deregisteredServices)
+	consulClient.RegisteredServicesResponse = func() (string, error) {
+		return `{"consul":{"ID":"consul","Service":"consul","Tags":[],"Address":"","Port":8500}}`, nil
+	}
+	consulClient.GetDirectoryStateResponse = func() (*consul.DirectoryState, error) {
+		return &consul.DirectoryState{}, nil
+	}
+
+	var out bytes.Buffer
+	code := runDiff(context.Background(), dockerClient, consulClient, state, "text", &out)
+
+	if code != PlanChanges {
+		t.Errorf("Expected exit code %d but was %d", PlanChanges, code)
+	}
+
+	expected := `container consul: is running, but not managed by operator
+container old: is running, but not desired
+container statsite: image is plum/wake-statsite:1, expected plum/wake-statsite:latest
+service consul: port is 8500, expected 0
+service statsite: is not registered
+`
+
+	if out.String() != expected {
+		t.Errorf("Expected differences:\n%s\nbut was:\n%s", expected, out.String())
+	}
+}
+
+func TestServiceDriftIncludesChecks(t *testing.T) {
+	web := service.Service{Name: "web"}
+	registered := consul.NewServiceRepresentation(web, "")
+
+	web.Checks = []service.Check{service.NewHTTPCheck("http://localhost:8000/_health")}
+	desired := consul.NewServiceRepresentation(web, "")
+
+	if drift := serviceDrift(desired, registered); len(drift) != 1 || drift[0] != "checks differ from the desired checks" {
+		t.Errorf("Expected the checks to differ but got %v", drift)
+	}
+
+	if drift := serviceDrift(desired, desired); len(drift) != 0 {
+		t.Errorf("Expected no differences but got %v", drift)
+	}
+}
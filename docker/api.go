@@ -0,0 +1,724 @@
+package docker
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/wakeful-deployment/operator/container"
+	"github.com/wakeful-deployment/operator/logger"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultHost is where the docker daemon listens unless DOCKER_HOST says otherwise
+const DefaultHost = "unix:///var/run/docker.sock"
+
+// APIVersion is the docker engine API version the APIClient speaks
+const APIVersion = "v1.24"
+
+// DefaultTimeout is how long a call to the docker daemon may take when the
+// client doesn't say otherwise
+const DefaultTimeout = time.Minute
+
+// DefaultPullTimeout is how long pulling an image may take when the client
+// doesn't say otherwise
+const DefaultPullTimeout = 10 * time.Minute
+
+// APIClient talks to the docker engine HTTP API directly, either over the
+// unix socket or over tcp, so no docker binary is required
+type APIClient struct {
+	Host string
+	// Timeout is how long each request may take, DefaultTimeout when zero
+	Timeout time.Duration
+	// PullTimeout is how long pulling an image may take, DefaultPullTimeout
+	// when zero
+	PullTimeout time.Duration
+}
+
+func timeoutOrDefault(timeout time.Duration, fallback time.Duration) time.Duration {
+	if timeout <= 0 {
+		return fallback
+	}
+
+	return timeout
+}
+
+func (d APIClient) Run(ctx context.Context, c container.Container) error {
+	logger.Info("running container", logger.Fields{"container": c.Name, "image": c.Image})
+
+	config, err := createConfig(c)
+
+	if err != nil {
+		return err
+	}
+
+	for _, m := range namedVolumes(c) {
+		volume := volumeConfig{Name: m.Source, Labels: VolumeLabels(c, m)}
+		err = d.do(ctx, "POST", "/volumes/create", volume, nil)
+
+		if err != nil {
+			return errors.New(fmt.Sprintf("ERROR: creating volume '%s' failed: %v", m.Source, err))
+		}
+	}
+
+	var created struct {
+		ID string `json:"Id"`
+	}
+
+	path := fmt.Sprintf("/containers/create?name=%s", url.QueryEscape(c.Name))
+	err = d.do(ctx, "POST", path, config, &created)
+
+	if isNotFound(err) && c.PullPolicy != container.PullNever {
+		logger.Info("image not found locally, pulling it", logger.Fields{"container": c.Name, "image": c.Image})
+		err = d.Pull(ctx, c)
+
+		if err != nil {
+			return err
+		}
+
+		err = d.do(ctx, "POST", path, config, &created)
+	}
+
+	if err != nil {
+		return errors.New(fmt.Sprintf("ERROR: creating container '%s' failed: %v", c.Name, err))
+	}
+
+	// only the first network can be joined when creating the container
+	if c.NetworkMode == "" && len(c.Networks) > 1 {
+		for _, n := range c.Networks[1:] {
+			connect := networkConnect{Container: created.ID, EndpointConfig: endpointConfig{Aliases: n.Aliases}}
+			err = d.do(ctx, "POST", fmt.Sprintf("/networks/%s/connect", url.QueryEscape(n.Name)), connect, nil)
+
+			if err != nil {
+				d.removeCreated(ctx, c, created.ID)
+				return errors.New(fmt.Sprintf("ERROR: connecting container '%s' to network '%s' failed: %v", c.Name, n.Name, err))
+			}
+		}
+	}
+
+	err = d.do(ctx, "POST", fmt.Sprintf("/containers/%s/start", created.ID), nil, nil)
+
+	if err != nil {
+		d.removeCreated(ctx, c, created.ID)
+		return errors.New(fmt.Sprintf("ERROR: starting container '%s' failed: %v", c.Name, err))
+	}
+
+	return nil
+}
+
+// removeCreated removes a container which was created but couldn't be
+// started, so it doesn't hold on to the name when the run is retried
+func (d APIClient) removeCreated(ctx context.Context, c container.Container, id string) {
+	err := d.do(ctx, "DELETE", fmt.Sprintf("/containers/%s?force=1", id), nil, nil)
+
+	if err != nil {
+		logger.Error("removing the container which failed to start failed", logger.Fields{"container": c.Name, "error": err})
+	}
+}
+
+func (d APIClient) Stop(ctx context.Context, c container.Container) error {
+	logger.Info("stopping container", logger.Fields{"container": c.Name})
+
+	err := d.do(ctx, "POST", fmt.Sprintf("/containers/%s/stop?t=10", url.QueryEscape(c.Name)), nil, nil)
+
+	if err != nil && !isNotModified(err) {
+		return errors.New(fmt.Sprintf("ERROR: stopping container '%s' failed: %v", c.Name, err))
+	}
+
+	err = d.do(ctx, "DELETE", fmt.Sprintf("/containers/%s", url.QueryEscape(c.Name)), nil, nil)
+
+	if err != nil {
+		return errors.New(fmt.Sprintf("ERROR: removing container '%s' failed: %v", c.Name, err))
+	}
+
+	return nil
+}
+
+type apiContainer struct {
+	ID     string `json:"Id"`
+	Names  []string
+	Image  string
+	State  string
+	Labels map[string]string
+}
+
+func (d APIClient) RunningContainers(ctx context.Context) ([]container.Container, error) {
+	var listed []apiContainer
+	err := d.do(ctx, "GET", "/containers/json?all=1", nil, &listed)
+
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("ERROR: could not fetch running containers: %v", err))
+	}
+
+	var containers []container.Container
+
+	for _, c := range listed {
+		if len(c.Names) == 0 {
+			continue
+		}
+
+		name := strings.TrimPrefix(c.Names[0], "/")
+		containers = append(containers, container.Container{ID: c.ID, Name: name, Image: c.Image, Labels: c.Labels, State: c.State})
+	}
+
+	return containers, nil
+}
+
+func (d APIClient) Inspect(ctx context.Context, c container.Container) (container.Container, error) {
+	var inspected inspectResponse
+	err := d.do(ctx, "GET", fmt.Sprintf("/containers/%s/json", url.QueryEscape(c.Name)), nil, &inspected)
+
+	if err != nil {
+		return container.Container{}, errors.New(fmt.Sprintf("ERROR: inspecting container '%s' failed: %v", c.Name, err))
+	}
+
+	return inspected.Container(), nil
+}
+
+func (d APIClient) Events(ctx context.Context) (<-chan Event, error) {
+	// the stream has no timeout, it lasts until ctx is cancelled
+	resp, err := d.send(ctx, "GET", eventsPath(), nil)
+
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("ERROR: subscribing to docker events failed: %v", err))
+	}
+
+	events := make(chan Event)
+	go decodeEvents(ctx, resp.Body, events)
+
+	return events, nil
+}
+
+func (d APIClient) RemoveEphemeralVolumes(ctx context.Context, name string) error {
+	var listed struct {
+		Volumes []struct {
+			Name string
+		}
+	}
+
+	err := d.do(ctx, "GET", volumesPath(name), nil, &listed)
+
+	if err != nil {
+		return errors.New(fmt.Sprintf("ERROR: listing volumes of '%s' failed: %v", name, err))
+	}
+
+	for _, v := range listed.Volumes {
+		logger.Info("removing ephemeral volume", logger.Fields{"container": name, "volume": v.Name})
+		err = d.do(ctx, "DELETE", fmt.Sprintf("/volumes/%s", url.QueryEscape(v.Name)), nil, nil)
+
+		if err != nil && !isNotFound(err) {
+			return errors.New(fmt.Sprintf("ERROR: removing volume '%s' failed: %v", v.Name, err))
+		}
+	}
+
+	return nil
+}
+
+type apiNetwork struct {
+	Name     string
+	Driver   string
+	Internal bool
+	Labels   map[string]string
+}
+
+func (d APIClient) Networks(ctx context.Context) ([]Network, error) {
+	var listed []apiNetwork
+	err := d.do(ctx, "GET", "/networks", nil, &listed)
+
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("ERROR: listing networks failed: %v", err))
+	}
+
+	var networks []Network
+
+	for _, n := range listed {
+		networks = append(networks, Network{Name: n.Name, Driver: n.Driver, Internal: n.Internal, Managed: n.Labels[ManagedLabel] == "true"})
+	}
+
+	return networks, nil
+}
+
+func (d APIClient) CreateNetwork(ctx context.Context, n Network) error {
+	config := networkConfig{
+		Name:           n.Name,
+		Driver:         n.Driver,
+		Internal:       n.Internal,
+		CheckDuplicate: true,
+		Labels:         map[string]string{ManagedLabel: "true"},
+	}
+
+	err := d.do(ctx, "POST", "/networks/create", config, nil)
+
+	if err != nil {
+		return errors.New(fmt.Sprintf("ERROR: creating network '%s' failed: %v", n.Name, err))
+	}
+
+	return nil
+}
+
+func (d APIClient) RemoveNetwork(ctx context.Context, name string) error {
+	err := d.do(ctx, "DELETE", fmt.Sprintf("/networks/%s", url.QueryEscape(name)), nil, nil)
+
+	if err != nil && !isNotFound(err) {
+		return errors.New(fmt.Sprintf("ERROR: removing network '%s' failed: %v", name, err))
+	}
+
+	return nil
+}
+
+func (d APIClient) ImageID(ctx context.Context, image string) (string, error) {
+	var inspected struct {
+		ID string `json:"Id"`
+	}
+
+	err := d.do(ctx, "GET", fmt.Sprintf("/images/%s/json", url.QueryEscape(image)), nil, &inspected)
+
+	if isNotFound(err) {
+		return "", nil
+	}
+
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("ERROR: inspecting image '%s' failed: %v", image, err))
+	}
+
+	return inspected.ID, nil
+}
+
+func (d APIClient) Pull(ctx context.Context, c container.Container) error {
+	image := c.Image
+	repo, tag := splitImage(image)
+	path := fmt.Sprintf("/images/create?fromImage=%s&tag=%s", url.QueryEscape(repo), url.QueryEscape(tag))
+
+	ctx, cancel := context.WithTimeout(ctx, timeoutOrDefault(d.PullTimeout, DefaultPullTimeout))
+	defer cancel()
+
+	headers := make(map[string]string)
+
+	if c.Auth != nil {
+		headers["X-Registry-Auth"] = registryAuthHeader(image, *c.Auth)
+	}
+
+	resp, err := d.sendWithHeaders(ctx, "POST", path, nil, headers)
+
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	// the pull progress is streamed back as a series of json messages, any
+	// of which may report a failure
+	decoder := json.NewDecoder(resp.Body)
+
+	for {
+		var message struct {
+			Error string `json:"error"`
+		}
+
+		err = decoder.Decode(&message)
+
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if message.Error != "" {
+			return errors.New(fmt.Sprintf("ERROR: pulling image '%s' failed: %s", image, message.Error))
+		}
+	}
+}
+
+// apiError is returned for any non-2xx response from the docker daemon
+type apiError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e apiError) Error() string {
+	return fmt.Sprintf("docker responded with %d: %s", e.StatusCode, e.Message)
+}
+
+func isNotFound(err error) bool {
+	e, ok := err.(apiError)
+	return ok && e.StatusCode == http.StatusNotFound
+}
+
+func isNotModified(err error) bool {
+	e, ok := err.(apiError)
+	return ok && e.StatusCode == http.StatusNotModified
+}
+
+// do sends the request and decodes the json response into out, if given,
+// giving up after Timeout
+func (d APIClient) do(ctx context.Context, method string, path string, in interface{}, out interface{}) error {
+	ctx, cancel := context.WithTimeout(ctx, timeoutOrDefault(d.Timeout, DefaultTimeout))
+	defer cancel()
+
+	var body io.Reader
+
+	if in != nil {
+		b, err := json.Marshal(in)
+
+		if err != nil {
+			return err
+		}
+
+		body = bytes.NewReader(b)
+	}
+
+	resp, err := d.send(ctx, method, path, body)
+
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if out == nil {
+		return nil
+	}
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func (d APIClient) send(ctx context.Context, method string, path string, body io.Reader) (*http.Response, error) {
+	return d.sendWithHeaders(ctx, method, path, body, nil)
+}
+
+func (d APIClient) sendWithHeaders(ctx context.Context, method string, path string, body io.Reader, headers map[string]string) (*http.Response, error) {
+	client, base, err := d.httpClient()
+
+	if err != nil {
+		return nil, err
+	}
+
+	request, err := http.NewRequest(method, fmt.Sprintf("%s/%s%s", base, APIVersion, path), body)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+
+	for key, value := range headers {
+		request.Header.Set(key, value)
+	}
+
+	resp, err := client.Do(request.WithContext(ctx))
+
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+
+		var message struct {
+			Message string `json:"message"`
+		}
+		json.NewDecoder(resp.Body).Decode(&message)
+
+		return nil, apiError{StatusCode: resp.StatusCode, Message: message.Message}
+	}
+
+	return resp, nil
+}
+
+// httpClient returns a client which can reach the daemon and the base url to
+// use for requests, based on Host (ex: unix:///var/run/docker.sock or tcp://10.0.0.1:2375)
+func (d APIClient) httpClient() (*http.Client, string, error) {
+	host := d.Host
+
+	if host == "" {
+		host = DefaultHost
+	}
+
+	u, err := url.Parse(host)
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	switch u.Scheme {
+	case "unix":
+		socket := u.Path
+		transport := &http.Transport{
+			DisableKeepAlives: true,
+			Dial: func(_, _ string) (net.Conn, error) {
+				return net.Dial("unix", socket)
+			},
+		}
+		return &http.Client{Transport: transport}, "http://docker", nil
+	case "tcp", "http":
+		transport := &http.Transport{DisableKeepAlives: true}
+		return &http.Client{Transport: transport}, fmt.Sprintf("http://%s", u.Host), nil
+	default:
+		return nil, "", errors.New(fmt.Sprintf("ERROR: unsupported docker host '%s'", host))
+	}
+}
+
+type portBinding struct {
+	HostIP   string `json:"HostIp"`
+	HostPort string
+}
+
+type restartPolicy struct {
+	Name              string
+	MaximumRetryCount int
+}
+
+type hostConfig struct {
+	PortBindings    map[string][]portBinding
+	PublishAllPorts bool
+	RestartPolicy   restartPolicy
+	Binds           []string          `json:",omitempty"`
+	Tmpfs           map[string]string `json:",omitempty"`
+	NetworkMode     string            `json:",omitempty"`
+	resources
+}
+
+type endpointConfig struct {
+	Aliases []string `json:",omitempty"`
+}
+
+type networkingConfig struct {
+	EndpointsConfig map[string]endpointConfig
+}
+
+type networkConnect struct {
+	Container      string
+	EndpointConfig endpointConfig
+}
+
+type networkConfig struct {
+	Name           string
+	Driver         string `json:",omitempty"`
+	Internal       bool
+	CheckDuplicate bool
+	Labels         map[string]string
+}
+
+// resources are the limits as both HostConfig and `docker inspect` have them
+type resources struct {
+	CPUShares         int64    `json:"CpuShares,omitempty"`
+	CPUQuota          int64    `json:"CpuQuota,omitempty"`
+	Memory            int64    `json:",omitempty"`
+	MemoryReservation int64    `json:",omitempty"`
+	PidsLimit         int64    `json:",omitempty"`
+	Ulimits           []ulimit `json:",omitempty"`
+}
+
+type ulimit struct {
+	Name string
+	Soft int64
+	Hard int64
+}
+
+func newResources(r container.Resources) resources {
+	result := resources{
+		CPUShares:         r.CPUShares,
+		CPUQuota:          r.CPUQuota,
+		Memory:            r.Memory,
+		MemoryReservation: r.MemoryReservation,
+		PidsLimit:         r.PidsLimit,
+	}
+
+	for _, u := range r.Ulimits {
+		result.Ulimits = append(result.Ulimits, ulimit{Name: u.Name, Soft: u.Soft, Hard: u.Hard})
+	}
+
+	return result
+}
+
+func (r resources) Resources() container.Resources {
+	result := container.Resources{
+		CPUShares:         r.CPUShares,
+		CPUQuota:          r.CPUQuota,
+		Memory:            r.Memory,
+		MemoryReservation: r.MemoryReservation,
+		PidsLimit:         r.PidsLimit,
+	}
+
+	for _, u := range r.Ulimits {
+		result.Ulimits = append(result.Ulimits, container.Ulimit{Name: u.Name, Soft: u.Soft, Hard: u.Hard})
+	}
+
+	return result
+}
+
+type volumeConfig struct {
+	Name   string
+	Labels map[string]string
+}
+
+type containerConfig struct {
+	Image        string
+	Env          []string
+	Labels       map[string]string
+	ExposedPorts map[string]struct{}
+	Cmd          []string `json:",omitempty"`
+	Entrypoint   []string `json:",omitempty"`
+	WorkingDir   string   `json:",omitempty"`
+	User         string   `json:",omitempty"`
+	Hostname     string   `json:",omitempty"`
+	HostConfig   hostConfig
+	// NetworkingConfig is the first network joined, with its aliases
+	NetworkingConfig *networkingConfig `json:",omitempty"`
+}
+
+// createConfig is the API equivalent of RunArgs
+func createConfig(c container.Container) (containerConfig, error) {
+	config := containerConfig{
+		Image:        c.Image,
+		Env:          expandEnv(c.Env),
+		Labels:       Labels(c),
+		ExposedPorts: make(map[string]struct{}),
+		Cmd:          c.Command,
+		Entrypoint:   c.Entrypoint,
+		WorkingDir:   c.Workdir,
+		User:         c.User,
+		Hostname:     c.Hostname,
+		HostConfig: hostConfig{
+			PortBindings: make(map[string][]portBinding),
+			resources:    newResources(c.Resources),
+		},
+	}
+
+	switch {
+	case c.NetworkMode != "":
+		config.HostConfig.NetworkMode = c.NetworkMode
+	case len(c.Networks) > 0:
+		first := c.Networks[0]
+		config.HostConfig.NetworkMode = first.Name
+		config.NetworkingConfig = &networkingConfig{
+			EndpointsConfig: map[string]endpointConfig{first.Name: endpointConfig{Aliases: first.Aliases}},
+		}
+	}
+
+	ports := c.Ports
+
+	// with the host's network there is nothing to publish
+	if c.NetworkMode == "host" {
+		ports = nil
+	} else if len(ports) == 0 {
+		config.HostConfig.PublishAllPorts = true
+	}
+
+	for _, port := range ports {
+		containerPort, binding, err := parsePort(port)
+
+		if err != nil {
+			return config, err
+		}
+
+		config.ExposedPorts[containerPort] = struct{}{}
+		config.HostConfig.PortBindings[containerPort] = append(config.HostConfig.PortBindings[containerPort], binding)
+	}
+
+	policy, err := parseRestart(c.Restart)
+
+	if err != nil {
+		return config, err
+	}
+
+	config.HostConfig.RestartPolicy = policy
+
+	for _, m := range c.Mounts {
+		if m.Type == container.TmpfsMount {
+			if config.HostConfig.Tmpfs == nil {
+				config.HostConfig.Tmpfs = make(map[string]string)
+			}
+
+			config.HostConfig.Tmpfs[m.Target] = tmpfsOptions(m)
+		} else {
+			config.HostConfig.Binds = append(config.HostConfig.Binds, bindSpec(m))
+		}
+	}
+
+	return config, nil
+}
+
+// parsePort understands the same formats as `docker run -p`: container,
+// host:container and ip:host:container, optionally followed by /udp or /tcp
+func parsePort(port string) (string, portBinding, error) {
+	proto := "tcp"
+
+	if i := strings.Index(port, "/"); i != -1 {
+		proto = port[i+1:]
+		port = port[:i]
+	}
+
+	parts := strings.Split(port, ":")
+	binding := portBinding{}
+	var containerPort string
+
+	switch len(parts) {
+	case 1:
+		containerPort = parts[0]
+	case 2:
+		binding.HostPort = parts[0]
+		containerPort = parts[1]
+	case 3:
+		binding.HostIP = parts[0]
+		binding.HostPort = parts[1]
+		containerPort = parts[2]
+	default:
+		return "", binding, errors.New(fmt.Sprintf("ERROR: invalid port '%s'", port))
+	}
+
+	if _, err := strconv.Atoi(containerPort); err != nil {
+		return "", binding, errors.New(fmt.Sprintf("ERROR: invalid port '%s'", port))
+	}
+
+	return fmt.Sprintf("%s/%s", containerPort, proto), binding, nil
+}
+
+// parseRestart understands the same values as `docker run --restart`
+func parseRestart(setting string) (restartPolicy, error) {
+	if setting == "" {
+		return restartPolicy{Name: "always"}, nil
+	}
+
+	parts := strings.SplitN(setting, ":", 2)
+	policy := restartPolicy{Name: parts[0]}
+
+	if len(parts) == 2 {
+		count, err := strconv.Atoi(parts[1])
+
+		if err != nil {
+			return policy, errors.New(fmt.Sprintf("ERROR: invalid restart policy '%s'", setting))
+		}
+
+		policy.MaximumRetryCount = count
+	}
+
+	return policy, nil
+}
+
+// splitImage splits an image reference into the repository and tag, taking
+// care not to confuse a registry port (ex: registry:5000/app) with a tag
+func splitImage(image string) (string, string) {
+	if strings.Contains(image, "@") {
+		return image, ""
+	}
+
+	i := strings.LastIndex(image, ":")
+
+	if i == -1 || strings.Contains(image[i:], "/") {
+		return image, "latest"
+	}
+
+	return image[:i], image[i+1:]
+}
@@ -0,0 +1,235 @@
+package docker
+
+import (
+	"context"
+	"github.com/wakeful-deployment/operator/container"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParsePort(t *testing.T) {
+	containerPort, binding, err := parsePort("8300:9300/udp")
+
+	if err != nil {
+		t.Fatalf("Got an error: %v", err)
+	}
+
+	if containerPort != "9300/udp" {
+		t.Errorf("expected container port to be 9300/udp, but was %s", containerPort)
+	}
+
+	if binding.HostPort != "8300" {
+		t.Errorf("expected host port to be 8300, but was %s", binding.HostPort)
+	}
+
+	_, _, err = parsePort("8300:abc")
+
+	if err == nil {
+		t.Error("expected an invalid port to error, but got none")
+	}
+}
+
+func TestSplitImage(t *testing.T) {
+	images := map[string][]string{
+		"redis":                    []string{"redis", "latest"},
+		"redis:3.0":                []string{"redis", "3.0"},
+		"registry:5000/wakeful/op": []string{"registry:5000/wakeful/op", "latest"},
+		"registry:5000/op:abc123":  []string{"registry:5000/op", "abc123"},
+	}
+
+	for image, expected := range images {
+		repo, tag := splitImage(image)
+
+		if repo != expected[0] || tag != expected[1] {
+			t.Errorf("expected %s to split into %v, but got [%s %s]", image, expected, repo, tag)
+		}
+	}
+}
+
+func TestCreateConfig(t *testing.T) {
+	c := container.Container{
+		Name:    "statsite",
+		Image:   "wakeful/wake-statsite:latest",
+		Ports:   []string{"8125:8125/udp"},
+		Restart: "on-failure:3",
+	}
+
+	config, err := createConfig(c)
+
+	if err != nil {
+		t.Fatalf("Got an error: %v", err)
+	}
+
+	if config.HostConfig.PublishAllPorts {
+		t.Error("expected ports to not all be published when ports are given")
+	}
+
+	bindings := config.HostConfig.PortBindings["8125/udp"]
+
+	if len(bindings) != 1 || bindings[0].HostPort != "8125" {
+		t.Errorf("expected 8125/udp to be bound to 8125, but was %v", bindings)
+	}
+
+	if config.Labels[ManagedLabel] != "true" || config.Labels[SpecHashLabel] != c.Hash() {
+		t.Errorf("expected the container to be labeled as managed with its spec hash, but labels were %v", config.Labels)
+	}
+
+	policy := config.HostConfig.RestartPolicy
+
+	if policy.Name != "on-failure" || policy.MaximumRetryCount != 3 {
+		t.Errorf("expected restart policy on-failure with 3 retries, but was %v", policy)
+	}
+}
+
+func TestMountArgs(t *testing.T) {
+	mounts := []container.Mount{
+		container.Mount{Type: container.NamedVolume, Source: "consul-data", Target: "/data"},
+		container.Mount{Type: container.BindMount, Source: "/etc/ssl/certs", Target: "/etc/ssl/certs", ReadOnly: true},
+		container.Mount{Type: container.TmpfsMount, Target: "/tmp"},
+	}
+
+	expected := "-v consul-data:/data -v /etc/ssl/certs:/etc/ssl/certs:ro --tmpfs /tmp"
+
+	if args := strings.Join(mountArgs(mounts), " "); args != expected {
+		t.Errorf("expected %s, but got %s", expected, args)
+	}
+
+	config, err := createConfig(container.Container{Name: "consul", Image: "consul", Mounts: mounts})
+
+	if err != nil {
+		t.Fatalf("Got an error: %v", err)
+	}
+
+	if binds := strings.Join(config.HostConfig.Binds, " "); binds != "consul-data:/data /etc/ssl/certs:/etc/ssl/certs:ro" {
+		t.Errorf("expected the volume and bind mount to be binds, but got %s", binds)
+	}
+
+	if _, ok := config.HostConfig.Tmpfs["/tmp"]; !ok {
+		t.Errorf("expected /tmp to be a tmpfs, but got %v", config.HostConfig.Tmpfs)
+	}
+}
+
+func TestResourceArgs(t *testing.T) {
+	r := container.Resources{
+		CPUShares: 512,
+		Memory:    536870912,
+		PidsLimit: 100,
+		Ulimits:   []container.Ulimit{container.Ulimit{Name: "nofile", Soft: 1024, Hard: 4096}},
+	}
+
+	expected := "--cpu-shares 512 --memory 536870912 --pids-limit 100 --ulimit nofile=1024:4096"
+
+	if args := strings.Join(resourceArgs(r), " "); args != expected {
+		t.Errorf("expected %s, but got %s", expected, args)
+	}
+
+	config, err := createConfig(container.Container{Name: "consul", Image: "consul", Resources: r})
+
+	if err != nil {
+		t.Fatalf("Got an error: %v", err)
+	}
+
+	if config.HostConfig.CPUShares != 512 || config.HostConfig.Memory != 536870912 || len(config.HostConfig.Ulimits) != 1 {
+		t.Errorf("expected the limits to be in the host config, but got %+v", config.HostConfig.resources)
+	}
+}
+
+func TestRunArgsWithCommand(t *testing.T) {
+	c := container.Container{
+		Name:       "worker",
+		Image:      "wakeful/app:abc123",
+		Restart:    "always",
+		Command:    []string{"sh", "-c", "echo 'hello world' "},
+		Entrypoint: []string{"/usr/bin/env", "--"},
+		Workdir:    "/opt/app",
+		User:       "app",
+	}
+
+	args := RunArgs(c)
+	expected := []string{"--restart=always", "--entrypoint", "/usr/bin/env", "--workdir", "/opt/app", "--user", "app", "wakeful/app:abc123", "--", "sh", "-c", "echo 'hello world' "}
+	tail := args[len(args)-len(expected):]
+
+	if strings.Join(tail, "|") != strings.Join(expected, "|") {
+		t.Errorf("expected args to end with %q, but got %q", expected, args)
+	}
+
+	config, err := createConfig(c)
+
+	if err != nil {
+		t.Fatalf("Got an error: %v", err)
+	}
+
+	if len(config.Cmd) != 3 || len(config.Entrypoint) != 2 || config.WorkingDir != "/opt/app" || config.User != "app" {
+		t.Errorf("expected the command, entrypoint, workdir and user to be in the config, but got %+v", config)
+	}
+}
+
+func TestNetworks(t *testing.T) {
+	c := container.Container{
+		Name:  "proxy",
+		Image: "wakeful/wake-proxy:latest",
+		Networks: []container.Network{
+			container.Network{Name: "backend", Aliases: []string{"web"}},
+			container.Network{Name: "frontend"},
+		},
+	}
+
+	expected := "--network backend --network-alias web"
+
+	if args := strings.Join(networkArgs(c), " "); args != expected {
+		t.Errorf("expected %s, but got %s", expected, args)
+	}
+
+	config, err := createConfig(c)
+
+	if err != nil {
+		t.Fatalf("Got an error: %v", err)
+	}
+
+	endpoint, ok := config.NetworkingConfig.EndpointsConfig["backend"]
+
+	if config.HostConfig.NetworkMode != "backend" || !ok || len(endpoint.Aliases) != 1 {
+		t.Errorf("expected the container to be created on backend as web, but got %+v", config.NetworkingConfig)
+	}
+
+	c = container.Container{Name: "statsite", Image: "statsite", Ports: []string{"8125:8125/udp"}, NetworkMode: "host"}
+
+	if args := strings.Join(RunArgs(c), " "); strings.Contains(args, "-p") || strings.Contains(args, "-P") || !strings.Contains(args, "--network host") {
+		t.Errorf("expected the host network without published ports, but got %s", args)
+	}
+
+	config, err = createConfig(c)
+
+	if err != nil {
+		t.Fatalf("Got an error: %v", err)
+	}
+
+	if config.HostConfig.NetworkMode != "host" || config.HostConfig.PublishAllPorts || len(config.HostConfig.PortBindings) != 0 {
+		t.Errorf("expected the host network without published ports, but got %+v", config.HostConfig)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	done := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-done // a wedged daemon
+	}))
+	defer server.Close()
+	defer close(done) // before closing the server, which waits on requests
+
+	client := APIClient{Host: strings.Replace(server.URL, "http://", "tcp://", 1), Timeout: 50 * time.Millisecond}
+
+	start := time.Now()
+	_, err := client.RunningContainers(context.Background())
+
+	if err == nil {
+		t.Fatal("expected a timeout error, but got none")
+	}
+
+	if time.Since(start) > time.Second {
+		t.Errorf("expected to give up after the timeout, but took %v", time.Since(start))
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"github.com/wakeful-deployment/operator/container"
 	"os"
+	"sort"
 	"strings"
 )
 
@@ -19,15 +20,44 @@ func portsArgs(ports []string) []string {
 	return args
 }
 
-func envArgs(vars map[string]string) []string {
-	var args []string
+// expandEnv turns the env map into KEY=value pairs, looking up values which
+// reference the operator's own environment (ex: "$CONSULHOST")
+func expandEnv(vars map[string]string) []string {
+	var pairs []string
 
 	for key, value := range vars {
 		if strings.HasPrefix(value, "$") && strings.ToUpper(value) == value {
 			value, _ = os.LookupEnv(value[1:len(value)])
 		}
-		str := fmt.Sprintf("%s=%s", key, value)
-		args = append(args, "-e", str)
+		pairs = append(pairs, fmt.Sprintf("%s=%s", key, value))
+	}
+
+	return pairs
+}
+
+func envArgs(vars map[string]string) []string {
+	var args []string
+
+	for _, pair := range expandEnv(vars) {
+		args = append(args, "-e", pair)
+	}
+
+	return args
+}
+
+func labelArgs(labels map[string]string) []string {
+	var keys []string
+
+	for key := range labels {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	var args []string
+
+	for _, key := range keys {
+		args = append(args, "--label", fmt.Sprintf("%s=%s", key, labels[key]))
 	}
 
 	return args
@@ -41,11 +71,83 @@ func restartArg(setting string) string {
 	return fmt.Sprintf("--restart=%s", setting)
 }
 
+func resourceArgs(r container.Resources) []string {
+	var args []string
+
+	limits := []struct {
+		flag  string
+		value int64
+	}{
+		{"--cpu-shares", r.CPUShares},
+		{"--cpu-quota", r.CPUQuota},
+		{"--memory", r.Memory},
+		{"--memory-reservation", r.MemoryReservation},
+		{"--pids-limit", r.PidsLimit},
+	}
+
+	for _, limit := range limits {
+		if limit.value != 0 {
+			args = append(args, limit.flag, fmt.Sprintf("%d", limit.value))
+		}
+	}
+
+	for _, ulimit := range r.Ulimits {
+		args = append(args, "--ulimit", fmt.Sprintf("%s=%d:%d", ulimit.Name, ulimit.Soft, ulimit.Hard))
+	}
+
+	return args
+}
+
+// processArgs are the flags for how the container's process is started
+func processArgs(c container.Container) []string {
+	var args []string
+
+	if len(c.Entrypoint) > 0 {
+		args = append(args, "--entrypoint", c.Entrypoint[0])
+	}
+
+	if c.Workdir != "" {
+		args = append(args, "--workdir", c.Workdir)
+	}
+
+	if c.User != "" {
+		args = append(args, "--user", c.User)
+	}
+
+	if c.Hostname != "" {
+		args = append(args, "--hostname", c.Hostname)
+	}
+
+	return args
+}
+
+// commandArgs go after the image. --entrypoint only takes the program, so
+// the rest of the entrypoint goes before the command.
+func commandArgs(c container.Container) []string {
+	var args []string
+
+	if len(c.Entrypoint) > 1 {
+		args = append(args, c.Entrypoint[1:]...)
+	}
+
+	return append(args, c.Command...)
+}
+
 func RunArgs(c container.Container) []string {
 	args := []string{"run", "-d", "--name", c.Name}
-	args = append(args, portsArgs(c.Ports)...)
+	args = append(args, networkArgs(c)...)
+
+	// with the host's network there is nothing to publish
+	if c.NetworkMode != "host" {
+		args = append(args, portsArgs(c.Ports)...)
+	}
+
 	args = append(args, envArgs(c.Env)...)
+	args = append(args, mountArgs(c.Mounts)...)
+	args = append(args, resourceArgs(c.Resources)...)
+	args = append(args, labelArgs(Labels(c))...)
 	args = append(args, restartArg(c.Restart))
+	args = append(args, processArgs(c)...)
 	args = append(args, c.Image)
 
 	var cleaned []string
@@ -56,5 +158,6 @@ func RunArgs(c container.Container) []string {
 		}
 	}
 
-	return cleaned
+	// the command is passed on exactly as given, spaces and all
+	return append(cleaned, commandArgs(c)...)
 }
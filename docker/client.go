@@ -1,43 +1,123 @@
 package docker
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/wakeful-deployment/operator/container"
 	"github.com/wakeful-deployment/operator/logger"
+	"io/ioutil"
+	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
 	"time"
 )
 
 type Client interface {
-	Run(container.Container) error
-	Stop(container.Container) error
-	RunningContainers() (string, error)
+	Run(context.Context, container.Container) error
+	Stop(context.Context, container.Container) error
+	RunningContainers(context.Context) ([]container.Container, error)
+	Inspect(context.Context, container.Container) (container.Container, error)
+	// Events streams the EventActions of managed containers until ctx is
+	// cancelled or the stream breaks, which closes the channel
+	Events(context.Context) (<-chan Event, error)
+	// RemoveEphemeralVolumes removes the named volumes marked ephemeral
+	// which were created for the container with this name
+	RemoveEphemeralVolumes(context.Context, string) error
+	// Networks lists the networks the operator created
+	Networks(context.Context) ([]Network, error)
+	CreateNetwork(context.Context, Network) error
+	RemoveNetwork(context.Context, string) error
+	// ImageID is the ID of the image on the node, "" when it isn't there
+	ImageID(context.Context, string) (string, error)
+	// Pull pulls the container's image with the container's Auth, if any
+	Pull(context.Context, container.Container) error
 }
 
-type EngineClient struct{}
+// EngineClient shells out to the docker binary
+type EngineClient struct {
+	// Timeout is how long each docker command may take, DefaultTimeout when zero
+	Timeout time.Duration
+}
+
+func (d EngineClient) command(ctx context.Context, args ...string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeoutOrDefault(d.Timeout, DefaultTimeout))
+	defer cancel()
+
+	return exec.CommandContext(ctx, "docker", args...).Output()
+}
 
-func (d EngineClient) Run(c container.Container) error {
-	logger.Info(fmt.Sprintf("running container with name '%s' with image '%s'", c.Name, c.Image))
+func (d EngineClient) Run(ctx context.Context, c container.Container) error {
+	logger.Info("running container", logger.Fields{"container": c.Name, "image": c.Image})
+
+	for _, m := range namedVolumes(c) {
+		args := append([]string{"volume", "create"}, labelArgs(VolumeLabels(c, m))...)
+		_, err := d.command(ctx, append(args, m.Source)...)
+
+		if err != nil {
+			return errors.New(fmt.Sprintf("ERROR: 'docker volume create' failed: %v", err))
+		}
+	}
 
 	args := RunArgs(c)
 	commandString := strings.Join(append([]string{"docker"}, args...), " ")
-	logger.Info(fmt.Sprintf("running docker command: '%s'", commandString))
-	_, err := exec.Command("docker", args...).Output()
+	logger.Debug("running docker command", logger.Fields{"container": c.Name, "command": commandString})
+	_, err := d.command(ctx, args...)
 
 	if err != nil {
+		d.removeCreated(ctx, c)
 		errMsg := fmt.Sprintf("ERROR: 'docker run' failed: %v", err)
 		return errors.New(errMsg)
 	}
 
+	if c.NetworkMode != "" || len(c.Networks) < 2 {
+		return nil
+	}
+
+	for _, n := range c.Networks[1:] {
+		args := []string{"network", "connect"}
+
+		for _, alias := range n.Aliases {
+			args = append(args, "--alias", alias)
+		}
+
+		_, err = d.command(ctx, append(args, n.Name, c.Name)...)
+
+		if err != nil {
+			d.forceRemove(ctx, c)
+			return errors.New(fmt.Sprintf("ERROR: 'docker network connect' failed: %v", err))
+		}
+	}
+
 	return nil
 }
 
-func (d EngineClient) Stop(c container.Container) error {
-	logger.Info(fmt.Sprintf("stopping container with name '%s'", c.Name))
+// removeCreated removes the container when `docker run` created it but
+// couldn't start it, so it doesn't hold on to the name when the run is
+// retried. A container which was already there under the name is left alone.
+func (d EngineClient) removeCreated(ctx context.Context, c container.Container) {
+	out, err := d.command(ctx, "inspect", "--format", "{{.State.Status}}", c.Name)
+
+	if err == nil && strings.TrimSpace(string(out)) == "created" {
+		d.forceRemove(ctx, c)
+	}
+}
+
+// forceRemove removes a container which was run but couldn't be set up
+func (d EngineClient) forceRemove(ctx context.Context, c container.Container) {
+	_, err := d.command(ctx, "rm", "--force", c.Name)
+
+	if err != nil {
+		logger.Error("removing the container which failed to start failed", logger.Fields{"container": c.Name, "error": err})
+	}
+}
+
+func (d EngineClient) Stop(ctx context.Context, c container.Container) error {
+	logger.Info("stopping container", logger.Fields{"container": c.Name})
 
-	_, err := exec.Command("docker", "stop", c.Name).Output()
+	_, err := d.command(ctx, "stop", c.Name)
 
 	if err != nil {
 		errMsg := fmt.Sprintf("ERROR: 'docker stop' failed: %v", err)
@@ -46,7 +126,7 @@ func (d EngineClient) Stop(c container.Container) error {
 
 	time.Sleep(time.Second)
 
-	_, err = exec.Command("docker", "rm", c.Name).Output()
+	_, err = d.command(ctx, "rm", c.Name)
 
 	if err != nil {
 		errMsg := fmt.Sprintf("ERROR: 'docker rm' failed: %v", err)
@@ -56,15 +136,198 @@ func (d EngineClient) Stop(c container.Container) error {
 	return nil
 }
 
-// For now, we assume if it's running then it's running with the correct args. It's possible in the future we will inspect each container and compare every arg.
-
-func (d EngineClient) RunningContainers() (string, error) {
-	psOut, err := exec.Command("docker", "ps", "--format", "{{.Names}} {{.Image}}").Output()
+func (d EngineClient) RunningContainers(ctx context.Context) ([]container.Container, error) {
+	psOut, err := d.command(ctx, "ps", "--all", "--no-trunc", "--format", "{{.ID}}\t{{.Names}}\t{{.Image}}\t{{.Status}}\t{{.Labels}}")
 
 	if err != nil {
 		errMsg := fmt.Sprintf("ERROR: could not fetch running containers: %v\n", err)
-		return "", errors.New(errMsg)
+		return nil, errors.New(errMsg)
+	}
+
+	return parseDockerPsOutput(string(psOut))
+}
+
+func (d EngineClient) Inspect(ctx context.Context, c container.Container) (container.Container, error) {
+	out, err := d.command(ctx, "inspect", "--type", "container", c.Name)
+
+	if err != nil {
+		errMsg := fmt.Sprintf("ERROR: 'docker inspect' failed: %v", err)
+		return container.Container{}, errors.New(errMsg)
+	}
+
+	var inspected []inspectResponse
+	err = json.Unmarshal(out, &inspected)
+
+	if err != nil {
+		return container.Container{}, err
+	}
+
+	if len(inspected) != 1 {
+		errMsg := fmt.Sprintf("ERROR: 'docker inspect' returned %d containers for '%s'", len(inspected), c.Name)
+		return container.Container{}, errors.New(errMsg)
+	}
+
+	return inspected[0].Container(), nil
+}
+
+func (d EngineClient) Events(ctx context.Context) (<-chan Event, error) {
+	args := []string{"events", "--format", "{{json .}}"}
+
+	for key, values := range eventFilters() {
+		for _, value := range values {
+			args = append(args, "--filter", fmt.Sprintf("%s=%s", key, value))
+		}
+	}
+
+	// the stream has no timeout, it lasts until ctx is cancelled
+	cmd := exec.CommandContext(ctx, "docker", args...)
+	out, err := cmd.StdoutPipe()
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = cmd.Start()
+
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("ERROR: 'docker events' failed: %v", err))
+	}
+
+	events := make(chan Event)
+
+	go func() {
+		decodeEvents(ctx, out, events)
+		cmd.Wait()
+	}()
+
+	return events, nil
+}
+
+func (d EngineClient) RemoveEphemeralVolumes(ctx context.Context, name string) error {
+	args := []string{"volume", "ls", "--quiet"}
+
+	for key, values := range ephemeralVolumeFilters(name) {
+		for _, value := range values {
+			args = append(args, "--filter", fmt.Sprintf("%s=%s", key, value))
+		}
+	}
+
+	out, err := d.command(ctx, args...)
+
+	if err != nil {
+		return errors.New(fmt.Sprintf("ERROR: 'docker volume ls' failed: %v", err))
 	}
 
-	return string(psOut), nil
+	volumes := strings.Fields(string(out))
+
+	if len(volumes) == 0 {
+		return nil
+	}
+
+	logger.Info("removing ephemeral volumes", logger.Fields{"container": name, "volumes": volumes})
+
+	_, err = d.command(ctx, append([]string{"volume", "rm"}, volumes...)...)
+
+	if err != nil {
+		return errors.New(fmt.Sprintf("ERROR: 'docker volume rm' failed: %v", err))
+	}
+
+	return nil
+}
+
+func (d EngineClient) Networks(ctx context.Context) ([]Network, error) {
+	out, err := d.command(ctx, "network", "ls", "--no-trunc", "--format", "{{.Name}}\t{{.Driver}}\t{{.Internal}}\t{{.Labels}}")
+
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("ERROR: 'docker network ls' failed: %v", err))
+	}
+
+	var networks []Network
+
+	// the labels are often empty, so the trailing tab has to be kept
+	for _, line := range strings.Split(strings.TrimRight(string(out), "\r\n"), "\n") {
+		info := strings.Split(strings.TrimRight(line, "\r"), "\t")
+
+		if len(info) != 4 {
+			continue
+		}
+
+		managed := parseLabels(info[3])[ManagedLabel] == "true"
+		networks = append(networks, Network{Name: info[0], Driver: info[1], Internal: info[2] == "true", Managed: managed})
+	}
+
+	return networks, nil
+}
+
+func (d EngineClient) CreateNetwork(ctx context.Context, n Network) error {
+	args := []string{"network", "create"}
+
+	if n.Driver != "" {
+		args = append(args, "--driver", n.Driver)
+	}
+
+	if n.Internal {
+		args = append(args, "--internal")
+	}
+
+	args = append(args, labelArgs(map[string]string{ManagedLabel: "true"})...)
+	_, err := d.command(ctx, append(args, n.Name)...)
+
+	if err != nil {
+		return errors.New(fmt.Sprintf("ERROR: 'docker network create' failed: %v", err))
+	}
+
+	return nil
+}
+
+func (d EngineClient) RemoveNetwork(ctx context.Context, name string) error {
+	_, err := d.command(ctx, "network", "rm", name)
+
+	if err != nil {
+		return errors.New(fmt.Sprintf("ERROR: 'docker network rm' failed: %v", err))
+	}
+
+	return nil
+}
+
+func (d EngineClient) ImageID(ctx context.Context, image string) (string, error) {
+	out, err := d.command(ctx, "images", "--quiet", "--no-trunc", image)
+
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("ERROR: 'docker images' failed: %v", err))
+	}
+
+	return strings.SplitN(strings.TrimSpace(string(out)), "\n", 2)[0], nil
+}
+
+// Pull passes the credentials on in a config of its own, rather than
+// relying on a `docker login` on the host
+func (d EngineClient) Pull(ctx context.Context, c container.Container) error {
+	args := []string{"pull", c.Image}
+
+	if c.Auth != nil {
+		dir, err := ioutil.TempDir("", "operator-docker")
+
+		if err != nil {
+			return err
+		}
+
+		defer os.RemoveAll(dir)
+
+		err = ioutil.WriteFile(filepath.Join(dir, "config.json"), engineConfig(c.Image, *c.Auth), 0600)
+
+		if err != nil {
+			return err
+		}
+
+		args = append([]string{"--config", dir}, args...)
+	}
+
+	_, err := d.command(ctx, args...)
+
+	if err != nil {
+		return errors.New(fmt.Sprintf("ERROR: 'docker pull' failed: %v", err))
+	}
+
+	return nil
 }
@@ -1,58 +1,305 @@
 package docker
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"github.com/wakeful-deployment/operator/container"
 	"github.com/wakeful-deployment/operator/logger"
+	"github.com/wakeful-deployment/operator/metrics"
+	"sort"
 	"strings"
 )
 
-func RunningContainers(client Client) ([]container.Container, error) {
-	output, err := client.RunningContainers()
+// RunningContainers lists every container except operator, including the
+// ones which exited or are restarting. Those are inspected for their exit
+// code and restart count, so crash loops can be told apart.
+func RunningContainers(ctx context.Context, client Client) ([]container.Container, error) {
+	containers, err := client.RunningContainers(ctx)
 
 	if err != nil {
 		return nil, err
 	}
 
-	return parseDockerPsOutput(output)
+	var runningContainers []container.Container
+
+	for _, c := range containers {
+		if c.Name == "operator" {
+			continue
+		}
+
+		if !Running(c) {
+			inspected, err := client.Inspect(ctx, c)
+
+			if err != nil {
+				logger.Warn("could not inspect stopped container", logger.Fields{"container": c.Name, "error": err})
+			} else {
+				c.ExitCode = inspected.ExitCode
+				c.RestartCount = inspected.RestartCount
+				c.Restart = inspected.Restart
+			}
+		}
+
+		runningContainers = append(runningContainers, c)
+	}
+
+	return runningContainers, nil
+}
+
+// Running is true unless docker said the container isn't running. Clients
+// which don't report a state only list running containers.
+func Running(c container.Container) bool {
+	return c.State == "" || c.State == "running"
+}
+
+// CrashLooping is true for a container docker keeps restarting, or has given
+// up restarting after it failed again and again
+func CrashLooping(c container.Container) bool {
+	return c.State == "restarting" || (c.State == "exited" && c.ExitCode != 0 && c.RestartCount > 0)
+}
+
+// Stopped is true for a container which isn't running although its restart
+// policy says it should be: one which was only created, is dead, or exited
+// with restart always or unless-stopped, which docker only leaves stopped
+// when someone stopped it. An exited container with restart no or
+// on-failure is meant to stay that way.
+func Stopped(c container.Container) bool {
+	switch c.State {
+	case "created", "dead":
+		return true
+	case "exited":
+		policy, _ := parseRestart(c.Restart)
+		return policy.Name == "always" || policy.Name == "unless-stopped"
+	default:
+		return false
+	}
+}
+
+// Run pulls the image as its pull policy says and starts the container
+func Run(ctx context.Context, client Client, c container.Container) error {
+	err := Pull(ctx, client, c)
+
+	if err != nil {
+		return err
+	}
+
+	return start(ctx, client, c)
+}
+
+// start starts the container, keeping count for the metrics
+func start(ctx context.Context, client Client, c container.Container) error {
+	metrics.DockerRuns.Inc()
+	err := client.Run(ctx, c)
+
+	if err != nil {
+		metrics.DockerRunFailures.Inc()
+	}
+
+	return err
+}
+
+// Stop stops and removes the container, keeping count for the metrics
+func Stop(ctx context.Context, client Client, c container.Container) error {
+	metrics.DockerStops.Inc()
+	err := client.Stop(ctx, c)
+
+	if err != nil {
+		metrics.DockerStopFailures.Inc()
+	}
+
+	return err
+}
+
+// ContainerPlan is what NormalizeContainers would do
+type ContainerPlan struct {
+	Start    []container.Container
+	Stop     []container.Container
+	Recreate []container.Container
+}
+
+func (p ContainerPlan) Empty() bool {
+	return len(p.Start) == 0 && len(p.Stop) == 0 && len(p.Recreate) == 0
+}
+
+// PlanContainers works out which containers need to be started, stopped or
+// recreated without changing anything
+func PlanContainers(ctx context.Context, client Client, desired []container.Container, current []container.Container) ContainerPlan {
+	return ContainerPlan{
+		Start:    container.Diff(desired, current),
+		Stop:     managedContainers(container.Diff(current, desired)),
+		Recreate: driftedContainers(ctx, client, desired, current),
+	}
 }
 
-func NormalizeContainers(client Client, desired []container.Container, current []container.Container) error {
-	removed := container.Diff(current, desired)
-	added := container.Diff(desired, current)
+func NormalizeContainers(ctx context.Context, client Client, desired []container.Container, current []container.Container) error {
+	plan := PlanContainers(ctx, client, desired, current)
 
-	logger.Info(fmt.Sprintf("removed containers: %v", removed))
-	logger.Info(fmt.Sprintf("added containers: %v", added))
+	logger.Debug("normalizing containers", logger.Fields{"removed": Names(plan.Stop), "added": Names(plan.Start), "drifted": Names(plan.Recreate)})
 
-	if len(added) == 0 && len(removed) == 0 {
+	if plan.Empty() {
 		return nil
 	}
 
-	errs := []error{}
-	for _, container := range added {
-		err := client.Run(container)
+	errs := Errors{}
+	for _, container := range plan.Start {
+		err := Run(ctx, client, container)
+		if err != nil {
+			logger.Error("running container failed", logger.Fields{"container": container.Name, "error": err})
+			errs[container.Name] = err
+		}
+	}
+
+	for _, container := range plan.Stop {
+		err := Stop(ctx, client, container)
+
 		if err != nil {
-			errs = append(errs, err)
+			logger.Error("stopping container failed", logger.Fields{"container": container.Name, "error": err})
+			errs[container.Name] = err
+			continue
+		}
+
+		// the service is gone, so are its ephemeral volumes. Every other
+		// volume is kept for when it comes back.
+		err = RemoveEphemeralVolumes(ctx, client, container.Name)
+
+		if err != nil {
+			logger.Error("removing ephemeral volumes failed", logger.Fields{"container": container.Name, "error": err})
+			errs[container.Name] = err
 		}
 	}
 
-	for _, container := range removed {
-		err := client.Stop(container)
+	for _, container := range plan.Recreate {
+		err := recreate(ctx, client, container)
 
 		if err != nil {
-			errs = append(errs, err)
+			logger.Error("recreating container failed", logger.Fields{"container": container.Name, "error": err})
+			errs[container.Name] = err
 		}
 	}
 
 	if len(errs) > 0 {
-		errMsg := fmt.Sprintf("ERROR: At least 1 error normalizing containers: %v", errs)
-		return errors.New(errMsg)
+		return errs
 	}
 
 	return nil
 }
 
+// Errors are the failures of normalizing containers, by container name
+type Errors map[string]error
+
+func (e Errors) Error() string {
+	return fmt.Sprintf("ERROR: At least 1 error normalizing containers: %v", sortedErrors(e))
+}
+
+func sortedErrors(errs map[string]error) []string {
+	var result []string
+
+	for name, err := range errs {
+		result = append(result, fmt.Sprintf("%s: %v", name, err))
+	}
+
+	sort.Strings(result)
+
+	return result
+}
+
+// Names returns the names of the containers
+func Names(containers []container.Container) []string {
+	var result []string
+
+	for _, c := range containers {
+		result = append(result, c.Name)
+	}
+
+	return result
+}
+
+// managedContainers filters out any container the operator didn't start
+func managedContainers(containers []container.Container) []container.Container {
+	var managed []container.Container
+
+	for _, c := range containers {
+		if Managed(c) {
+			managed = append(managed, c)
+		} else {
+			logger.Info("leaving container alone since it is not managed by operator", logger.Fields{"container": c.Name})
+		}
+	}
+
+	return managed
+}
+
+// driftedContainers returns the desired containers which are running with an
+// out of date spec. The spec hash label tells us cheaply if anything changed;
+// we only inspect the container to log what exactly drifted. A container
+// without labels which has the name of a service, ex: one started by hand,
+// is never stopped, so it is left alone and reported instead.
+func driftedContainers(ctx context.Context, client Client, desired []container.Container, current []container.Container) []container.Container {
+	var drifted []container.Container
+
+	for _, d := range desired {
+		for _, c := range current {
+			if d.Name != c.Name {
+				continue
+			}
+
+			if !Managed(c) {
+				logger.Warn("container has the name of a service, but is not managed by operator, leaving it alone", logger.Fields{"container": c.Name})
+				break
+			}
+
+			if Stopped(c) {
+				logger.Info("container is stopped, recreating it", logger.Fields{"container": c.Name, "state": c.State})
+				drifted = append(drifted, d)
+				break
+			}
+
+			if UpToDate(d, c) {
+				break
+			}
+
+			actual, err := client.Inspect(ctx, c)
+
+			if err != nil {
+				logger.Error("could not inspect drifted container", logger.Fields{"container": c.Name, "error": err})
+			} else {
+				logger.Info("container has drifted", logger.Fields{"container": d.Name, "drift": strings.Join(Drift(d, actual), ", ")})
+			}
+
+			drifted = append(drifted, d)
+			break
+		}
+	}
+
+	return drifted
+}
+
+func recreate(ctx context.Context, client Client, c container.Container) error {
+	logger.Info("recreating container", logger.Fields{"container": c.Name})
+
+	// a failed pull leaves the current container running
+	err := Pull(ctx, client, c)
+
+	if err != nil {
+		return err
+	}
+
+	return replace(ctx, client, c)
+}
+
+// replace stops the container and starts it again from the desired spec,
+// once its image was pulled
+func replace(ctx context.Context, client Client, c container.Container) error {
+	err := Stop(ctx, client, c)
+
+	if err != nil {
+		return err
+	}
+
+	return start(ctx, client, c)
+}
+
+// parseDockerPsOutput parses lines of "id\tname\timage\tstatus\tlabels"
 func parseDockerPsOutput(output string) ([]container.Container, error) {
 	output = strings.TrimSpace(output)
 	var runningContainers []container.Container
@@ -64,35 +311,44 @@ func parseDockerPsOutput(output string) ([]container.Container, error) {
 	lines := strings.Split(output, "\n")
 
 	for _, line := range lines {
-		info := strings.Split(line, " ")
-		var cleanedInfo []string
-
-		for _, str := range info {
-			str = strings.TrimSpace(str)
-			if str != "" {
-				cleanedInfo = append(cleanedInfo, str)
-			}
-		}
-		info = cleanedInfo
+		info := strings.SplitN(strings.TrimSpace(line), "\t", 5)
 
-		var name string
-		var image string
-
-		if len(info) != 2 {
+		if len(info) < 4 {
 			errMsg := fmt.Sprintf("ERROR: 'docker ps' info was not formatted correctly: %s\n", line)
 			return nil, errors.New(errMsg)
 		}
 
-		name = info[0]
-		image = info[1]
+		container := container.Container{ID: info[0], Name: info[1], Image: info[2], State: parseStatus(info[3])}
 
-		if name == "operator" {
-			continue
+		if len(info) == 5 {
+			container.Labels = parseLabels(info[4])
 		}
 
-		container := container.Container{Name: name, Image: image}
 		runningContainers = append(runningContainers, container)
 	}
 
 	return runningContainers, nil
 }
+
+// parseStatus turns the status `docker ps` prints, ex: "Up 2 hours" or
+// "Exited (1) 3 minutes ago", into the state the API reports
+func parseStatus(status string) string {
+	switch {
+	case strings.HasPrefix(status, "Up") && strings.Contains(status, "(Paused)"):
+		return "paused"
+	case strings.HasPrefix(status, "Up"):
+		return "running"
+	case strings.HasPrefix(status, "Restarting"):
+		return "restarting"
+	case strings.HasPrefix(status, "Exited"):
+		return "exited"
+	case strings.HasPrefix(status, "Created"):
+		return "created"
+	case strings.HasPrefix(status, "Removal"):
+		return "removing"
+	case strings.HasPrefix(status, "Dead"):
+		return "dead"
+	default:
+		return strings.ToLower(status)
+	}
+}
@@ -0,0 +1,68 @@
+package docker
+
+import (
+	"github.com/wakeful-deployment/operator/container"
+	"testing"
+)
+
+func TestParseDockerPsOutput(t *testing.T) {
+	output := "921582f62758\tconsul\tplum/wake-consul-agent:latest\tUp 2 hours\t\n" +
+		"405bab56d0c7\tstatsite\tplum/wake-statsite:latest\tExited (1) 3 minutes ago\twakeful.managed=true,wakeful.service=statsite\n" +
+		"3e02f2aae498\tredis\tredis:3.0\tRestarting (1) 5 seconds ago\t\n"
+
+	containers, err := parseDockerPsOutput(output)
+
+	if err != nil {
+		t.Fatalf("Got an error: %v", err)
+	}
+
+	if len(containers) != 3 {
+		t.Fatalf("expected 3 containers, but got %v", containers)
+	}
+
+	states := []string{"running", "exited", "restarting"}
+
+	for i, state := range states {
+		if containers[i].State != state {
+			t.Errorf("expected %s to be %s, but was %s", containers[i].Name, state, containers[i].State)
+		}
+	}
+
+	if !Managed(containers[1]) {
+		t.Errorf("expected statsite to be managed, but got labels %v", containers[1].Labels)
+	}
+}
+
+func TestCrashLooping(t *testing.T) {
+	containers := map[string]bool{
+		"running":               CrashLooping(container.Container{State: "running", RestartCount: 3}),
+		"restarting":            CrashLooping(container.Container{State: "restarting", ExitCode: 1, RestartCount: 3}),
+		"exited cleanly":        CrashLooping(container.Container{State: "exited"}),
+		"exited once":           CrashLooping(container.Container{State: "exited", ExitCode: 1}),
+		"exited after retrying": CrashLooping(container.Container{State: "exited", ExitCode: 1, RestartCount: 3}),
+	}
+
+	expected := map[string]bool{"running": false, "restarting": true, "exited cleanly": false, "exited once": false, "exited after retrying": true}
+
+	for name, crashLooping := range containers {
+		if crashLooping != expected[name] {
+			t.Errorf("expected crash looping to be %v when %s, but was %v", expected[name], name, crashLooping)
+		}
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	images := map[string]string{
+		"redis":                         DefaultRegistry,
+		"wakeful/wake-proxy:latest":     DefaultRegistry,
+		"registry:5000/wakeful/op":      "registry:5000",
+		"registry.example.com/op:1.0.0": "registry.example.com",
+		"localhost/op":                  "localhost",
+	}
+
+	for image, expected := range images {
+		if registry := Registry(image); registry != expected {
+			t.Errorf("expected the registry of %s to be %s, but was %s", image, expected, registry)
+		}
+	}
+}
@@ -0,0 +1,297 @@
+package docker
+
+import (
+	"fmt"
+	"github.com/wakeful-deployment/operator/container"
+	"sort"
+	"strings"
+)
+
+// inspectResponse is the subset of `docker inspect` (and GET /containers/:id/json)
+// that we care about when comparing a running container to its desired spec
+type inspectResponse struct {
+	ID           string `json:"Id"`
+	Name         string
+	Image        string
+	RestartCount int
+	Config       struct {
+		Image      string
+		Env        []string
+		Labels     map[string]string
+		Cmd        []string
+		Entrypoint []string
+		WorkingDir string
+		User       string
+		Hostname   string
+	}
+	HostConfig struct {
+		PortBindings  map[string][]portBinding
+		RestartPolicy restartPolicy
+		Binds         []string
+		Tmpfs         map[string]string
+		NetworkMode   string
+		resources
+	}
+	NetworkSettings struct {
+		Networks map[string]struct {
+			Aliases []string
+		}
+	}
+	State struct {
+		Status   string
+		ExitCode int
+		Health   *struct {
+			Status string
+		}
+	}
+}
+
+func (i inspectResponse) Container() container.Container {
+	c := container.Container{
+		ID:           i.ID,
+		Name:         strings.TrimPrefix(i.Name, "/"),
+		Image:        i.Config.Image,
+		ImageID:      i.Image,
+		Env:          make(map[string]string),
+		Labels:       i.Config.Labels,
+		State:        i.State.Status,
+		ExitCode:     i.State.ExitCode,
+		RestartCount: i.RestartCount,
+		Resources:    i.HostConfig.Resources(),
+		Command:      i.Config.Cmd,
+		Entrypoint:   i.Config.Entrypoint,
+		Workdir:      i.Config.WorkingDir,
+		User:         i.Config.User,
+		Hostname:     i.Config.Hostname,
+	}
+
+	if i.State.Health != nil {
+		c.Health = i.State.Health.Status
+	}
+
+	for _, pair := range i.Config.Env {
+		parts := strings.SplitN(pair, "=", 2)
+
+		if len(parts) == 2 {
+			c.Env[parts[0]] = parts[1]
+		} else {
+			c.Env[parts[0]] = ""
+		}
+	}
+
+	for containerPort, bindings := range i.HostConfig.PortBindings {
+		for _, binding := range bindings {
+			port := fmt.Sprintf("%s:%s", binding.HostPort, containerPort)
+
+			if binding.HostIP != "" && binding.HostIP != "0.0.0.0" {
+				port = fmt.Sprintf("%s:%s", binding.HostIP, port)
+			}
+
+			c.Ports = append(c.Ports, port)
+		}
+	}
+
+	for _, bind := range i.HostConfig.Binds {
+		c.Mounts = append(c.Mounts, parseBind(bind))
+	}
+
+	for target, options := range i.HostConfig.Tmpfs {
+		c.Mounts = append(c.Mounts, parseTmpfs(target, options))
+	}
+
+	switch i.HostConfig.NetworkMode {
+	case "default", "bridge":
+		c.NetworkMode = "bridge"
+	case "host", "none":
+		c.NetworkMode = i.HostConfig.NetworkMode
+	}
+
+	for name, n := range i.NetworkSettings.Networks {
+		if name != "bridge" && name != "host" && name != "none" {
+			c.Networks = append(c.Networks, container.Network{Name: name, Aliases: n.Aliases})
+		}
+	}
+
+	policy := i.HostConfig.RestartPolicy
+	c.Restart = policy.Name
+
+	// docker leaves the name empty for a container run without a policy
+	if c.Restart == "" {
+		c.Restart = "no"
+	}
+
+	if policy.MaximumRetryCount > 0 {
+		c.Restart = fmt.Sprintf("%s:%d", policy.Name, policy.MaximumRetryCount)
+	}
+
+	return c
+}
+
+// Drift compares a desired container with what is actually running and
+// returns a description of each difference. An empty result means the
+// running container matches the spec.
+func Drift(desired container.Container, actual container.Container) []string {
+	var drift []string
+
+	desiredImage := normalizeImage(desired.Image)
+	actualImage := normalizeImage(actual.Image)
+
+	if desiredImage != actualImage {
+		drift = append(drift, fmt.Sprintf("image is %s, expected %s", actualImage, desiredImage))
+	}
+
+	desiredPorts := canonicalPorts(desired.Ports)
+	actualPorts := canonicalPorts(actual.Ports)
+
+	if strings.Join(desiredPorts, ",") != strings.Join(actualPorts, ",") {
+		drift = append(drift, fmt.Sprintf("ports are %v, expected %v", actualPorts, desiredPorts))
+	}
+
+	// images bring their own env (PATH, etc), so we can only check that
+	// everything we asked for is present
+	actualEnv := make(map[string]bool)
+	for key, value := range actual.Env {
+		actualEnv[fmt.Sprintf("%s=%s", key, value)] = true
+	}
+
+	for _, pair := range expandEnv(desired.Env) {
+		if !actualEnv[pair] {
+			drift = append(drift, fmt.Sprintf("env is missing %s", pair))
+		}
+	}
+
+	desiredMounts := canonicalMounts(desired.Mounts)
+	actualMounts := canonicalMounts(actual.Mounts)
+
+	if strings.Join(desiredMounts, ",") != strings.Join(actualMounts, ",") {
+		drift = append(drift, fmt.Sprintf("mounts are %v, expected %v", actualMounts, desiredMounts))
+	}
+
+	drift = append(drift, resourceDrift(desired.Resources, actual.Resources)...)
+
+	drift = append(drift, processDrift(desired, actual)...)
+	drift = append(drift, networkDrift(desired, actual)...)
+
+	desiredRestart, _ := parseRestart(desired.Restart)
+	actualRestart, _ := parseRestart(actual.Restart)
+
+	if desiredRestart != actualRestart {
+		drift = append(drift, fmt.Sprintf("restart policy is %s, expected %s", actual.Restart, desired.Restart))
+	}
+
+	return drift
+}
+
+// processDrift only compares what was asked for, since docker reports the
+// image's own command, entrypoint, etc when the container doesn't set them
+func processDrift(desired container.Container, actual container.Container) []string {
+	var drift []string
+
+	type setting struct {
+		name    string
+		desired string
+		actual  string
+	}
+
+	settings := []setting{
+		{"workdir", desired.Workdir, actual.Workdir},
+		{"user", desired.User, actual.User},
+		{"hostname", desired.Hostname, actual.Hostname},
+	}
+
+	// `docker run` only takes the program as --entrypoint and the rest of
+	// the entrypoint goes before the command, so the two are compared as
+	// the command line they make up together
+	if len(desired.Entrypoint) > 0 {
+		settings = append(settings, setting{"entrypoint and command", commandLine(desired), commandLine(actual)})
+	} else {
+		settings = append(settings, setting{"command", strings.Join(desired.Command, " "), strings.Join(actual.Command, " ")})
+	}
+
+	for _, s := range settings {
+		if s.desired != "" && s.desired != s.actual {
+			drift = append(drift, fmt.Sprintf("%s is '%s', expected '%s'", s.name, s.actual, s.desired))
+		}
+	}
+
+	return drift
+}
+
+func commandLine(c container.Container) string {
+	return strings.Join(append(append([]string{}, c.Entrypoint...), c.Command...), " ")
+}
+
+func resourceDrift(desired container.Resources, actual container.Resources) []string {
+	var drift []string
+
+	limits := []struct {
+		name    string
+		desired int64
+		actual  int64
+	}{
+		{"cpu shares", desired.CPUShares, actual.CPUShares},
+		{"cpu quota", desired.CPUQuota, actual.CPUQuota},
+		{"memory", desired.Memory, actual.Memory},
+		{"memory reservation", desired.MemoryReservation, actual.MemoryReservation},
+		{"pids limit", desired.PidsLimit, actual.PidsLimit},
+	}
+
+	for _, limit := range limits {
+		// docker reports -1 for an unlimited pids limit on some versions
+		if limit.desired == 0 && limit.actual < 0 {
+			continue
+		}
+
+		if limit.desired != limit.actual {
+			drift = append(drift, fmt.Sprintf("%s is %d, expected %d", limit.name, limit.actual, limit.desired))
+		}
+	}
+
+	desiredUlimits := fmt.Sprintf("%v", desired.Ulimits)
+	actualUlimits := fmt.Sprintf("%v", canonicalUlimits(actual.Ulimits))
+
+	if desiredUlimits != actualUlimits {
+		drift = append(drift, fmt.Sprintf("ulimits are %s, expected %s", actualUlimits, desiredUlimits))
+	}
+
+	return drift
+}
+
+// canonicalUlimits sorts the ulimits by name, the order they are desired in
+func canonicalUlimits(ulimits []container.Ulimit) []container.Ulimit {
+	sorted := append([]container.Ulimit(nil), ulimits...)
+	sort.Sort(ulimitsByName(sorted))
+
+	return sorted
+}
+
+type ulimitsByName []container.Ulimit
+
+func (u ulimitsByName) Len() int           { return len(u) }
+func (u ulimitsByName) Swap(i, j int)      { u[i], u[j] = u[j], u[i] }
+func (u ulimitsByName) Less(i, j int) bool { return u[i].Name < u[j].Name }
+
+// normalizeImage makes "redis" and "redis:latest" compare as equal
+func normalizeImage(image string) string {
+	repo, tag := splitImage(image)
+
+	if tag == "" {
+		return repo
+	}
+
+	return fmt.Sprintf("%s:%s", repo, tag)
+}
+
+// canonicalPorts sorts the ports and drops the implied /tcp so that
+// "8000:8000" and "8000:8000/tcp" compare as equal
+func canonicalPorts(ports []string) []string {
+	var result []string
+
+	for _, port := range ports {
+		result = append(result, strings.TrimSuffix(port, "/tcp"))
+	}
+
+	sort.Strings(result)
+
+	return result
+}
@@ -0,0 +1,202 @@
+package docker
+
+import (
+	"github.com/wakeful-deployment/operator/container"
+	"testing"
+)
+
+func TestNoDrift(t *testing.T) {
+	desired := container.Container{
+		Name:  "redis",
+		Image: "redis",
+		Ports: []string{"6379:6379"},
+		Env:   map[string]string{"FOO": "BAR"},
+	}
+
+	actual := container.Container{
+		Name:    "redis",
+		Image:   "redis:latest",
+		Ports:   []string{"6379:6379/tcp"},
+		Env:     map[string]string{"FOO": "BAR", "PATH": "/usr/bin"},
+		Restart: "always",
+	}
+
+	drift := Drift(desired, actual)
+
+	if len(drift) != 0 {
+		t.Errorf("expected no drift, but got %v", drift)
+	}
+}
+
+func TestDrift(t *testing.T) {
+	desired := container.Container{
+		Name:    "redis",
+		Image:   "redis:3.0",
+		Ports:   []string{"6379:6379"},
+		Env:     map[string]string{"FOO": "BAR"},
+		Restart: "no",
+	}
+
+	actual := container.Container{
+		Name:    "redis",
+		Image:   "redis:2.8",
+		Ports:   []string{"6380:6379/tcp"},
+		Env:     map[string]string{"FOO": "BAZ"},
+		Restart: "always",
+	}
+
+	drift := Drift(desired, actual)
+
+	if len(drift) != 4 {
+		t.Errorf("expected image, ports, env and restart to drift, but got %v", drift)
+	}
+}
+
+func TestMountDrift(t *testing.T) {
+	desired := container.Container{
+		Name:  "consul",
+		Image: "consul",
+		Mounts: []container.Mount{
+			container.Mount{Type: container.NamedVolume, Source: "consul-data", Target: "/data", Ephemeral: true},
+			container.Mount{Type: container.BindMount, Source: "/etc/ssl/certs", Target: "/etc/ssl/certs", ReadOnly: true},
+			container.Mount{Type: container.TmpfsMount, Target: "/tmp"},
+		},
+	}
+
+	config, err := createConfig(desired)
+
+	if err != nil {
+		t.Fatalf("Got an error: %v", err)
+	}
+
+	var inspected inspectResponse
+	inspected.Config.Image = "consul"
+	inspected.HostConfig.RestartPolicy = config.HostConfig.RestartPolicy
+	inspected.HostConfig.Binds = config.HostConfig.Binds
+	inspected.HostConfig.Tmpfs = config.HostConfig.Tmpfs
+
+	if drift := Drift(desired, inspected.Container()); len(drift) != 0 {
+		t.Errorf("expected no drift, but got %v", drift)
+	}
+
+	inspected.HostConfig.Binds = []string{"consul-data:/data", "/etc/ssl/certs:/etc/ssl/certs"}
+
+	if drift := Drift(desired, inspected.Container()); len(drift) != 1 {
+		t.Errorf("expected mounts to drift, but got %v", drift)
+	}
+}
+
+func TestResourceDrift(t *testing.T) {
+	desired := container.Container{
+		Name:      "consul",
+		Image:     "consul",
+		Resources: container.Resources{Memory: 536870912, Ulimits: []container.Ulimit{container.Ulimit{Name: "nofile", Soft: 1024, Hard: 4096}}},
+	}
+
+	actual := container.Container{
+		Name:      "consul",
+		Image:     "consul",
+		Restart:   "always",
+		Resources: container.Resources{Memory: 268435456, PidsLimit: -1},
+	}
+
+	drift := Drift(desired, actual)
+
+	if len(drift) != 2 {
+		t.Errorf("expected memory and ulimits to drift, but got %v", drift)
+	}
+
+	if desired.Hash() == (container.Container{Name: "consul", Image: "consul"}).Hash() {
+		t.Error("expected changing a limit to change the spec hash")
+	}
+}
+
+func TestProcessDrift(t *testing.T) {
+	desired := container.Container{
+		Name:    "worker",
+		Image:   "app",
+		Command: []string{"bundle", "exec", "sidekiq"},
+		User:    "app",
+	}
+
+	// the image's own entrypoint and workdir aren't drift
+	actual := container.Container{
+		Name:       "worker",
+		Image:      "app",
+		Restart:    "always",
+		Command:    []string{"bundle", "exec", "puma"},
+		Entrypoint: []string{"/docker-entrypoint.sh"},
+		Workdir:    "/opt/app",
+		User:       "app",
+	}
+
+	drift := Drift(desired, actual)
+
+	if len(drift) != 1 {
+		t.Errorf("expected the command to drift, but got %v", drift)
+	}
+}
+
+func TestEntrypointDrift(t *testing.T) {
+	desired := container.Container{
+		Name:       "worker",
+		Image:      "app",
+		Entrypoint: []string{"/bin/sh", "-c"},
+		Command:    []string{"exec worker"},
+	}
+
+	// what the api client creates
+	actual := container.Container{
+		Name:       "worker",
+		Image:      "app",
+		Restart:    "always",
+		Entrypoint: []string{"/bin/sh", "-c"},
+		Command:    []string{"exec worker"},
+	}
+
+	if drift := Drift(desired, actual); len(drift) != 0 {
+		t.Errorf("expected no drift, but got %v", drift)
+	}
+
+	// what `docker run --entrypoint /bin/sh app -c 'exec worker'` creates
+	actual.Entrypoint = []string{"/bin/sh"}
+	actual.Command = []string{"-c", "exec worker"}
+
+	if drift := Drift(desired, actual); len(drift) != 0 {
+		t.Errorf("expected no drift, but got %v", drift)
+	}
+
+	actual.Entrypoint = []string{"/bin/bash"}
+
+	if drift := Drift(desired, actual); len(drift) != 1 {
+		t.Errorf("expected the entrypoint to drift, but got %v", drift)
+	}
+}
+
+func TestNetworkDrift(t *testing.T) {
+	desired := container.Container{
+		Name:     "proxy",
+		Image:    "proxy",
+		Networks: []container.Network{container.Network{Name: "backend", Aliases: []string{"web"}}},
+	}
+
+	var inspected inspectResponse
+	inspected.Config.Image = "proxy"
+	inspected.HostConfig.RestartPolicy = restartPolicy{Name: "always"}
+	inspected.HostConfig.NetworkMode = "backend"
+	inspected.NetworkSettings.Networks = map[string]struct{ Aliases []string }{
+		"backend": {Aliases: []string{"web", "921582f62758"}},
+	}
+
+	if drift := Drift(desired, inspected.Container()); len(drift) != 0 {
+		t.Errorf("expected no drift, but got %v", drift)
+	}
+
+	inspected.NetworkSettings.Networks = map[string]struct{ Aliases []string }{
+		"bridge": {},
+	}
+
+	if drift := Drift(desired, inspected.Container()); len(drift) != 1 {
+		t.Errorf("expected networks to drift, but got %v", drift)
+	}
+}
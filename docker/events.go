@@ -0,0 +1,69 @@
+package docker
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/url"
+)
+
+// EventActions are the container events which mean a managed container may
+// no longer be running
+var EventActions = []string{"die", "stop", "destroy"}
+
+// Event is something which happened to a container operator manages, ex:
+// {Action: "die", ID: "921582f62758", Name: "proxy"}
+type Event struct {
+	Action string
+	ID     string
+	Name   string
+}
+
+// apiEvent is an event as both GET /events and `docker events --format
+// '{{json .}}'` stream them
+type apiEvent struct {
+	Action string
+	Actor  struct {
+		ID         string
+		Attributes map[string]string
+	}
+}
+
+// eventFilters only lets through EventActions of managed containers
+func eventFilters() map[string][]string {
+	return map[string][]string{
+		"type":  []string{"container"},
+		"event": EventActions,
+		"label": []string{ManagedLabel + "=true"},
+	}
+}
+
+func eventsPath() string {
+	// marshaling a map of string slices can't fail
+	b, _ := json.Marshal(eventFilters())
+
+	return "/events?filters=" + url.QueryEscape(string(b))
+}
+
+// decodeEvents sends every event read from r until it ends, fails or ctx is
+// cancelled, then closes events
+func decodeEvents(ctx context.Context, r io.ReadCloser, events chan<- Event) {
+	defer close(events)
+	defer r.Close()
+
+	decoder := json.NewDecoder(r)
+
+	for {
+		var e apiEvent
+
+		if decoder.Decode(&e) != nil {
+			return
+		}
+
+		select {
+		case events <- Event{Action: e.Action, ID: e.Actor.ID, Name: e.Actor.Attributes["name"]}:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package docker
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/wakeful-deployment/operator/container"
+	"github.com/wakeful-deployment/operator/logger"
+	"github.com/wakeful-deployment/operator/metrics"
+	"strings"
+	"time"
+)
+
+// DefaultRegistry is where images without a registry in their name come from
+const DefaultRegistry = "docker.io"
+
+// Registry is the registry the image comes from, ex: "registry:5000" for
+// "registry:5000/wakeful/op" and DefaultRegistry for "redis"
+func Registry(image string) string {
+	i := strings.Index(image, "/")
+
+	if i == -1 {
+		return DefaultRegistry
+	}
+
+	first := image[:i]
+
+	if strings.ContainsAny(first, ".:") || first == "localhost" {
+		return first
+	}
+
+	return DefaultRegistry
+}
+
+// registryAuthHeader is the X-Registry-Auth header the engine takes
+// credentials in
+func registryAuthHeader(image string, auth container.RegistryAuth) string {
+	// marshaling a map of strings can't fail
+	b, _ := json.Marshal(map[string]string{
+		"username":      auth.Username,
+		"password":      auth.Password,
+		"serveraddress": Registry(image),
+	})
+
+	return base64.URLEncoding.EncodeToString(b)
+}
+
+// engineConfig is a docker config.json with only the credentials for the
+// image's registry
+func engineConfig(image string, auth container.RegistryAuth) []byte {
+	credentials := base64.StdEncoding.EncodeToString([]byte(auth.Username + ":" + auth.Password))
+
+	// marshaling maps of strings can't fail
+	b, _ := json.Marshal(map[string]map[string]map[string]string{
+		"auths": {Registry(image): {"auth": credentials}},
+	})
+
+	return b
+}
+
+// Pull makes sure the container's image is there according to its pull
+// policy, before the container is run or anything is stopped for it, so a
+// failed pull leaves the current container running
+func Pull(ctx context.Context, client Client, c container.Container) error {
+	switch c.PullPolicy {
+	case container.PullAlways:
+	case container.PullNever:
+		id, err := client.ImageID(ctx, c.Image)
+
+		if err != nil {
+			return err
+		}
+
+		if id == "" {
+			return errors.New(fmt.Sprintf("ERROR: image '%s' is not on the node and the pull policy is never", c.Image))
+		}
+
+		return nil
+	default:
+		id, err := client.ImageID(ctx, c.Image)
+
+		if err != nil || id != "" {
+			return err
+		}
+	}
+
+	logger.Info("pulling image", logger.Fields{"container": c.Name, "image": c.Image, "pull_policy": c.PullPolicy})
+	metrics.DockerPulls.Inc()
+	err := client.Pull(ctx, c)
+
+	if err != nil {
+		metrics.DockerPullFailures.Inc()
+	}
+
+	return err
+}
+
+// PullInterval is the least time between two pulls of an image by
+// StaleImages, so a tick doesn't hit the registry for every service
+var PullInterval = 5 * time.Minute
+
+// stalePulls is when StaleImages last pulled each image
+var stalePulls = make(map[string]time.Time)
+
+// StaleImages pulls the image of every up to date container whose pull
+// policy is always, at most once every PullInterval, and returns the desired
+// containers whose tag now points at another image than the one their
+// container runs, ex: a new :latest. A failed pull keeps the current
+// container.
+func StaleImages(ctx context.Context, client Client, desired []container.Container, current []container.Container) []container.Container {
+	var stale []container.Container
+
+	for _, d := range desired {
+		if d.PullPolicy != container.PullAlways {
+			continue
+		}
+
+		for _, c := range current {
+			if d.Name != c.Name || !Managed(c) || !UpToDate(d, c) || !Running(c) {
+				continue
+			}
+
+			if imageMoved(ctx, client, d, c) {
+				stale = append(stale, d)
+			}
+
+			break
+		}
+	}
+
+	return stale
+}
+
+// imageMoved pulls the desired image, unless it was pulled recently, and
+// compares it with the image the current container was started from
+func imageMoved(ctx context.Context, client Client, desired container.Container, current container.Container) bool {
+	if time.Since(stalePulls[desired.Image]) >= PullInterval {
+		err := Pull(ctx, client, desired)
+
+		if err != nil {
+			logger.Warn("pulling image failed, keeping the current container", logger.Fields{"container": desired.Name, "image": desired.Image, "error": err})
+			return false
+		}
+
+		stalePulls[desired.Image] = time.Now()
+	}
+
+	id, err := client.ImageID(ctx, desired.Image)
+
+	if err != nil {
+		logger.Warn("could not inspect pulled image", logger.Fields{"container": desired.Name, "image": desired.Image, "error": err})
+		return false
+	}
+
+	actual, err := client.Inspect(ctx, current)
+
+	if err != nil {
+		logger.Warn("could not inspect container", logger.Fields{"container": current.Name, "error": err})
+		return false
+	}
+
+	if id == "" || actual.ImageID == "" || id == actual.ImageID {
+		return false
+	}
+
+	logger.Info("image tag points at a new image", logger.Fields{"container": desired.Name, "image": desired.Image, "image_id": id, "running_image_id": actual.ImageID})
+
+	return true
+}
@@ -0,0 +1,61 @@
+package docker
+
+import (
+	"github.com/wakeful-deployment/operator/container"
+	"strings"
+)
+
+const (
+	ManagedLabel  = "wakeful.managed"
+	ServiceLabel  = "wakeful.service"
+	SpecHashLabel = "wakeful.spec-hash"
+)
+
+// Labels returns the labels every container started by the operator
+// carries, on top of any labels already on the container
+func Labels(c container.Container) map[string]string {
+	labels := make(map[string]string)
+
+	for key, value := range c.Labels {
+		labels[key] = value
+	}
+
+	labels[ManagedLabel] = "true"
+	labels[ServiceLabel] = c.Name
+	labels[SpecHashLabel] = c.Hash()
+
+	return labels
+}
+
+// Managed is true if the operator started this container. We never stop
+// containers we didn't start.
+func Managed(c container.Container) bool {
+	return c.Labels[ManagedLabel] == "true"
+}
+
+// UpToDate is true if the running container was started from the desired
+// spec, based on the spec hash label
+func UpToDate(desired container.Container, current container.Container) bool {
+	return current.Labels[SpecHashLabel] == desired.Hash()
+}
+
+// parseLabels parses the k=v,k=v format `docker ps` uses for labels
+func parseLabels(str string) map[string]string {
+	labels := make(map[string]string)
+
+	for _, pair := range strings.Split(str, ",") {
+		if pair == "" {
+			continue
+		}
+
+		parts := strings.SplitN(pair, "=", 2)
+
+		if len(parts) == 2 {
+			labels[parts[0]] = parts[1]
+		} else {
+			labels[parts[0]] = ""
+		}
+	}
+
+	return labels
+}
@@ -0,0 +1,220 @@
+package docker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/wakeful-deployment/operator/container"
+	"github.com/wakeful-deployment/operator/logger"
+	"sort"
+	"strings"
+)
+
+// Network is a user-defined docker network declared in operator.json, ex:
+// {"driver": "bridge", "internal": true}. Operator creates it once a
+// service joins it and removes it once none do.
+type Network struct {
+	Name     string `json:"name"`
+	Driver   string `json:"driver"`
+	Internal bool   `json:"internal"`
+	// Managed is true for a network the operator created, as listed by
+	// Client.Networks
+	Managed bool `json:"-"`
+}
+
+// driver is the driver docker uses for the network
+func (n Network) driver() string {
+	if n.Driver == "" {
+		return "bridge"
+	}
+
+	return n.Driver
+}
+
+// networkArgs attach the container to its network mode, or else to the
+// first of its networks. docker run can only join one network, the rest are
+// connected once the container exists.
+func networkArgs(c container.Container) []string {
+	if c.NetworkMode != "" {
+		return []string{"--network", c.NetworkMode}
+	}
+
+	if len(c.Networks) == 0 {
+		return nil
+	}
+
+	args := []string{"--network", c.Networks[0].Name}
+
+	for _, alias := range c.Networks[0].Aliases {
+		args = append(args, "--network-alias", alias)
+	}
+
+	return args
+}
+
+// NetworkPlan is which networks NormalizeNetworks would create and remove
+type NetworkPlan struct {
+	Create []Network
+	Remove []Network
+}
+
+// PlanNetworks works out which of the desired networks are missing, and
+// which networks the operator created are no longer desired. A desired
+// network which already exists with another driver or internal setting is
+// an error, since docker can't change those in place.
+func PlanNetworks(ctx context.Context, client Client, desired []Network) (NetworkPlan, error) {
+	plan := NetworkPlan{}
+	current, err := client.Networks(ctx)
+
+	if err != nil {
+		return plan, err
+	}
+
+	for _, d := range desired {
+		c, ok := findNetwork(current, d.Name)
+
+		if !ok {
+			plan.Create = append(plan.Create, d)
+			continue
+		}
+
+		if c.driver() != d.driver() || c.Internal != d.Internal {
+			return plan, errors.New(fmt.Sprintf("ERROR: network '%s' exists with driver %s and internal %t, expected driver %s and internal %t. Remove it to have it created again", d.Name, c.driver(), c.Internal, d.driver(), d.Internal))
+		}
+	}
+
+	for _, c := range current {
+		if _, ok := findNetwork(desired, c.Name); !ok && c.Managed {
+			plan.Remove = append(plan.Remove, c)
+		}
+	}
+
+	sort.Sort(networksByName(plan.Create))
+	sort.Sort(networksByName(plan.Remove))
+
+	return plan, nil
+}
+
+// CreateNetworks creates the missing networks, which has to happen before
+// any container can join them
+func CreateNetworks(ctx context.Context, client Client, plan NetworkPlan) error {
+	errs := Errors{}
+
+	for _, n := range plan.Create {
+		logger.Info("creating network", logger.Fields{"network": n.Name, "driver": n.Driver})
+		err := client.CreateNetwork(ctx, n)
+
+		if err != nil {
+			logger.Error("creating network failed", logger.Fields{"network": n.Name, "error": err})
+			errs[n.Name] = err
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+
+	return nil
+}
+
+// RemoveNetworks removes the networks no service joins anymore, which has
+// to happen after their containers were stopped. A network something else
+// is still attached to is kept and tried again next tick.
+func RemoveNetworks(ctx context.Context, client Client, plan NetworkPlan) {
+	for _, n := range plan.Remove {
+		logger.Info("removing network", logger.Fields{"network": n.Name})
+		err := client.RemoveNetwork(ctx, n.Name)
+
+		if err != nil {
+			logger.Warn("removing network failed, keeping it", logger.Fields{"network": n.Name, "error": err})
+		}
+	}
+}
+
+// NetworkNames returns the names of the networks
+func NetworkNames(networks []Network) []string {
+	var result []string
+
+	for _, n := range networks {
+		result = append(result, n.Name)
+	}
+
+	return result
+}
+
+func findNetwork(networks []Network, name string) (Network, bool) {
+	for _, n := range networks {
+		if n.Name == name {
+			return n, true
+		}
+	}
+
+	return Network{}, false
+}
+
+// canonicalNetworks describes the networks as sorted names, ex: "backend"
+func canonicalNetworks(networks []container.Network) []string {
+	var result []string
+
+	for _, n := range networks {
+		result = append(result, n.Name)
+	}
+
+	sort.Strings(result)
+
+	return result
+}
+
+// networkDrift compares the network mode when one is desired, and which
+// networks the container joined with which aliases. docker adds aliases of
+// its own, so only missing aliases are drift.
+func networkDrift(desired container.Container, actual container.Container) []string {
+	var drift []string
+
+	if desired.NetworkMode != "" {
+		if desired.NetworkMode != actual.NetworkMode {
+			drift = append(drift, fmt.Sprintf("network mode is '%s', expected '%s'", actual.NetworkMode, desired.NetworkMode))
+		}
+
+		return drift
+	}
+
+	if len(desired.Networks) == 0 {
+		return drift
+	}
+
+	desiredNetworks := canonicalNetworks(desired.Networks)
+	actualNetworks := canonicalNetworks(actual.Networks)
+
+	if strings.Join(desiredNetworks, ",") != strings.Join(actualNetworks, ",") {
+		drift = append(drift, fmt.Sprintf("networks are %v, expected %v", actualNetworks, desiredNetworks))
+	}
+
+	for _, d := range desired.Networks {
+		for _, a := range actual.Networks {
+			if a.Name != d.Name {
+				continue
+			}
+
+			aliases := make(map[string]bool)
+
+			for _, alias := range a.Aliases {
+				aliases[alias] = true
+			}
+
+			for _, alias := range d.Aliases {
+				if !aliases[alias] {
+					drift = append(drift, fmt.Sprintf("network %s is missing alias %s", d.Name, alias))
+				}
+			}
+		}
+	}
+
+	return drift
+}
+
+type networksByName []Network
+
+func (n networksByName) Len() int           { return len(n) }
+func (n networksByName) Swap(i, j int)      { n[i], n[j] = n[j], n[i] }
+func (n networksByName) Less(i, j int) bool { return n[i].Name < n[j].Name }
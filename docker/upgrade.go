@@ -0,0 +1,264 @@
+package docker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/wakeful-deployment/operator/container"
+	"github.com/wakeful-deployment/operator/logger"
+	"time"
+)
+
+// UpgradeTimeout is how long a new container has to become healthy before
+// the upgrade is abandoned and the old container is kept
+var UpgradeTimeout = time.Minute
+
+// UpgradePollInterval is how often we check on a new container's health
+var UpgradePollInterval = time.Second
+
+// containers without a docker HEALTHCHECK are considered healthy once they
+// have stayed running for this many polls in a row
+const stablePolls = 3
+
+// Gate tells whether the service's own health checks, ex: its consul
+// checks, pass for its new container, which was started at since. It is
+// only asked once docker considers the container healthy.
+type Gate func(ctx context.Context, since time.Time) (bool, error)
+
+// UpgradeError means the service could not be moved over to its new
+// container. The old container is left running, or run again from its old
+// spec, when this is returned.
+type UpgradeError struct {
+	Name  string
+	Image string
+	Err   error
+}
+
+func (e UpgradeError) Error() string {
+	return fmt.Sprintf("upgrading '%s' to image '%s' failed: %v", e.Name, e.Image, e.Err)
+}
+
+// CandidateName is the temporary name a new container runs under while we
+// wait for it to become healthy
+func CandidateName(name string) string {
+	return fmt.Sprintf("%s-next", name)
+}
+
+// PendingUpgrades returns the desired containers whose image differs from
+// the managed container currently running under the same name
+func PendingUpgrades(desired []container.Container, current []container.Container) []container.Container {
+	var upgrades []container.Container
+
+	for _, d := range desired {
+		for _, c := range current {
+			if d.Name == c.Name && Managed(c) && normalizeImage(d.Image) != normalizeImage(c.Image) {
+				upgrades = append(upgrades, d)
+				break
+			}
+		}
+	}
+
+	return upgrades
+}
+
+// Upgrade moves a service from its current container over to the desired
+// one. The new image first runs under a temporary name until it is healthy,
+// while the current container keeps serving, unless it can't run next to it
+// (see skipCandidate). Only then is the current container stopped and the
+// desired one started in its place, which has to become healthy too, and
+// pass gate when there is one, since that is where the service's checks
+// run. If that fails, the current container is run again from the spec it
+// had. pulled says the image was just pulled, ex: by StaleImages, and
+// doesn't need to be pulled again.
+func Upgrade(ctx context.Context, client Client, desired container.Container, current container.Container, pulled bool, gate Gate) error {
+	fail := func(err error) error {
+		return UpgradeError{Name: desired.Name, Image: desired.Image, Err: err}
+	}
+
+	var err error
+
+	// a failed pull leaves the current container running
+	if !pulled {
+		err = Pull(ctx, client, desired)
+
+		if err != nil {
+			return fail(err)
+		}
+	}
+
+	if reason := skipCandidate(desired); reason != "" {
+		logger.Info("not starting a candidate, the new container is only checked in place", logger.Fields{"container": desired.Name, "reason": reason})
+	} else {
+		err = tryCandidate(ctx, client, desired)
+
+		if err != nil {
+			return fail(err)
+		}
+	}
+
+	// what to roll back to, since only the name and labels were listed
+	previous, err := client.Inspect(ctx, current)
+
+	if err != nil {
+		return fail(err)
+	}
+
+	logger.Info("replacing the current container", logger.Fields{"container": desired.Name, "image": desired.Image})
+
+	err = Stop(ctx, client, current)
+
+	if err != nil {
+		return fail(err)
+	}
+
+	err = start(ctx, client, desired)
+
+	if err == nil {
+		err = waitUntilHealthy(ctx, client, desired, gate)
+	}
+
+	if err != nil {
+		logger.Error("new container failed, rolling back", logger.Fields{"container": desired.Name, "image": desired.Image, "error": err})
+
+		// when starting failed the container may not even exist
+		stopErr := Stop(ctx, client, desired)
+
+		if stopErr != nil {
+			logger.Debug("removing the failed container failed", logger.Fields{"container": desired.Name, "error": stopErr})
+		}
+
+		return fail(rollBack(ctx, client, previous, err))
+	}
+
+	return nil
+}
+
+// skipCandidate returns why the desired container can't run next to the
+// current one, or "" when it can
+func skipCandidate(desired container.Container) string {
+	if len(namedVolumes(desired)) > 0 {
+		return "it would open the named volumes of the current container"
+	}
+
+	if desired.NetworkMode == "host" {
+		return "it would listen on the same host ports as the current container"
+	}
+
+	return ""
+}
+
+// tryCandidate runs the desired container under a temporary name, on random
+// ports and without network aliases so it doesn't fight the current
+// container, until it becomes healthy or never does, and then removes it
+func tryCandidate(ctx context.Context, client Client, desired container.Container) error {
+	candidate := desired
+	candidate.Name = CandidateName(desired.Name)
+	candidate.Ports = nil
+	candidate.Networks = nil
+
+	// without aliases, so nothing is routed to it before it is healthy
+	for _, n := range desired.Networks {
+		candidate.Networks = append(candidate.Networks, container.Network{Name: n.Name})
+	}
+
+	logger.Info("upgrading container by starting a candidate", logger.Fields{"container": desired.Name, "image": desired.Image, "candidate": candidate.Name})
+
+	err := start(ctx, client, candidate)
+
+	if err != nil {
+		return err
+	}
+
+	healthErr := waitUntilHealthy(ctx, client, candidate, nil)
+	err = Stop(ctx, client, candidate)
+
+	if healthErr != nil {
+		logger.Error("candidate never became healthy, keeping the current container", logger.Fields{"container": desired.Name, "candidate": candidate.Name, "error": healthErr})
+		return healthErr
+	}
+
+	if err != nil {
+		return err
+	}
+
+	logger.Info("candidate is healthy", logger.Fields{"container": desired.Name, "candidate": candidate.Name})
+
+	return nil
+}
+
+// rollBack runs the previous container again, after the new one failed in
+// its place, and returns why the new one failed
+func rollBack(ctx context.Context, client Client, previous container.Container, cause error) error {
+	logger.Warn("running the previous container again", logger.Fields{"container": previous.Name, "image": previous.Image})
+
+	err := start(ctx, client, previous)
+
+	if err != nil {
+		logger.Error("rolling back failed, the service is down", logger.Fields{"container": previous.Name, "error": err})
+		return errors.New(fmt.Sprintf("%v, and rolling back failed: %v", cause, err))
+	}
+
+	return cause
+}
+
+func waitUntilHealthy(ctx context.Context, client Client, c container.Container, gate Gate) error {
+	started := time.Now()
+	deadline := started.Add(UpgradeTimeout)
+	stable := 0
+	gated := false
+
+	for {
+		inspected, err := client.Inspect(ctx, c)
+
+		if err != nil {
+			return err
+		}
+
+		healthy := false
+
+		switch {
+		case inspected.Health == "healthy":
+			healthy = true
+		case inspected.Health == "unhealthy":
+			return errors.New("container reported itself unhealthy")
+		case inspected.State == "exited" || inspected.State == "dead":
+			return errors.New(fmt.Sprintf("container %s", inspected.State))
+		case inspected.Health == "" && inspected.State == "running":
+			stable++
+			healthy = stable >= stablePolls
+		default:
+			stable = 0
+		}
+
+		if healthy && gate == nil {
+			return nil
+		}
+
+		if healthy {
+			gated = true
+			passing, err := gate(ctx, started)
+
+			if err != nil {
+				logger.Warn("could not tell if the service's checks pass", logger.Fields{"container": c.Name, "error": err})
+			}
+
+			if passing {
+				return nil
+			}
+		}
+
+		if time.Now().After(deadline) && gated {
+			return errors.New(fmt.Sprintf("the service's checks did not pass within %v", UpgradeTimeout))
+		}
+
+		if time.Now().After(deadline) {
+			return errors.New(fmt.Sprintf("container did not become healthy within %v", UpgradeTimeout))
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(UpgradePollInterval):
+		}
+	}
+}
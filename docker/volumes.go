@@ -0,0 +1,166 @@
+package docker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/wakeful-deployment/operator/container"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// EphemeralLabel marks a named volume which is removed along with its
+// service. Every other volume is kept, even once nothing uses it anymore.
+const EphemeralLabel = "wakeful.ephemeral"
+
+// namedVolumes returns the named volumes the container needs to exist
+// before it can be created
+func namedVolumes(c container.Container) []container.Mount {
+	var volumes []container.Mount
+
+	for _, m := range c.Mounts {
+		if m.Type == container.NamedVolume {
+			volumes = append(volumes, m)
+		}
+	}
+
+	return volumes
+}
+
+// VolumeLabels are the labels of a named volume created for the container
+func VolumeLabels(c container.Container, m container.Mount) map[string]string {
+	return map[string]string{
+		ManagedLabel:   "true",
+		ServiceLabel:   c.Name,
+		EphemeralLabel: fmt.Sprintf("%t", m.Ephemeral),
+	}
+}
+
+// ephemeralVolumeFilters matches the ephemeral volumes created for a service
+func ephemeralVolumeFilters(name string) map[string][]string {
+	return map[string][]string{
+		"label": []string{
+			ManagedLabel + "=true",
+			ServiceLabel + "=" + name,
+			EphemeralLabel + "=true",
+		},
+	}
+}
+
+func volumesPath(name string) string {
+	// marshaling a map of string slices can't fail
+	b, _ := json.Marshal(ephemeralVolumeFilters(name))
+
+	return "/volumes?filters=" + url.QueryEscape(string(b))
+}
+
+// bindSpec is a named volume or bind mount the way both `docker run -v` and
+// HostConfig.Binds take it, ex: "/etc/ssl/certs:/etc/ssl/certs:ro"
+func bindSpec(m container.Mount) string {
+	spec := fmt.Sprintf("%s:%s", m.Source, m.Target)
+
+	if m.ReadOnly {
+		spec += ":ro"
+	}
+
+	return spec
+}
+
+// tmpfsOptions are the mount options of a tmpfs, the part after the target
+// in `docker run --tmpfs`
+func tmpfsOptions(m container.Mount) string {
+	if m.ReadOnly {
+		return "ro"
+	}
+
+	return ""
+}
+
+func mountArgs(mounts []container.Mount) []string {
+	var args []string
+
+	for _, m := range mounts {
+		if m.Type == container.TmpfsMount {
+			if options := tmpfsOptions(m); options != "" {
+				args = append(args, "--tmpfs", fmt.Sprintf("%s:%s", m.Target, options))
+			} else {
+				args = append(args, "--tmpfs", m.Target)
+			}
+		} else {
+			args = append(args, "-v", bindSpec(m))
+		}
+	}
+
+	return args
+}
+
+// parseBind is the reverse of bindSpec
+func parseBind(bind string) container.Mount {
+	parts := strings.Split(bind, ":")
+	m := container.Mount{Type: container.NamedVolume, Source: parts[0]}
+
+	if len(parts) > 1 {
+		m.Target = parts[1]
+	}
+
+	if len(parts) > 2 {
+		for _, option := range strings.Split(parts[2], ",") {
+			if option == "ro" {
+				m.ReadOnly = true
+			}
+		}
+	}
+
+	if strings.HasPrefix(m.Source, "/") {
+		m.Type = container.BindMount
+	}
+
+	return m
+}
+
+// parseTmpfs is the reverse of tmpfsOptions
+func parseTmpfs(target string, options string) container.Mount {
+	m := container.Mount{Type: container.TmpfsMount, Target: target}
+
+	for _, option := range strings.Split(options, ",") {
+		if option == "ro" {
+			m.ReadOnly = true
+		}
+	}
+
+	return m
+}
+
+// canonicalMounts describes each mount as a sorted string, ex:
+// "volume consul-data:/data", leaving out whether it is ephemeral since
+// docker can't tell us
+func canonicalMounts(mounts []container.Mount) []string {
+	var result []string
+
+	for _, m := range mounts {
+		if m.Type == container.TmpfsMount {
+			result = append(result, strings.TrimSuffix(fmt.Sprintf("tmpfs %s:%s", m.Target, tmpfsOptions(m)), ":"))
+		} else {
+			result = append(result, fmt.Sprintf("%s %s", m.Type, bindSpec(m)))
+		}
+	}
+
+	sort.Strings(result)
+
+	return result
+}
+
+// RemoveEphemeralVolumes removes the ephemeral volumes of a service which
+// is no longer desired, including any created while it was being upgraded
+func RemoveEphemeralVolumes(ctx context.Context, client Client, name string) error {
+	for _, owner := range []string{name, CandidateName(name)} {
+		err := client.RemoveEphemeralVolumes(ctx, owner)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
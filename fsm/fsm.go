@@ -2,18 +2,25 @@ package fsm
 
 import (
 	"fmt"
+	"github.com/wakeful-deployment/operator/logger"
 )
 
 type Machine struct {
+	// Name tells a machine apart from the node's own in the logs. Only the
+	// node's machine, which has none, puts its state on every log line.
+	Name         string
 	CurrentState State
 	Rules        Rules
 	States       []State
+	// OnTransition, if set, is called after every allowed transition
+	OnTransition func(from State, to State)
 }
 
 func (m *Machine) ForceTransition(to State, e error) {
 	to.Error = e
-	fmt.Println(fmt.Sprintf("FSM: force transitioned from %v to %v", m.CurrentState, to))
+	logger.Debug("fsm force transitioned", m.fields(logger.Fields{"from": m.CurrentState.Name, "to": to.Name}))
 	m.CurrentState = to
+	m.setField()
 }
 
 func (m *Machine) Transition(to State, e error) {
@@ -31,13 +38,33 @@ func (m *Machine) Transition(to State, e error) {
 	}
 
 	if m.Rules.Test(m.CurrentState, to) {
-		fmt.Println(fmt.Sprintf("FSM: transitioned from %v to %v", m.CurrentState, to))
+		logger.Info("fsm transitioned", m.fields(logger.Fields{"from": m.CurrentState.Name, "to": to.Name, "error": to.Error}))
+		from := m.CurrentState
 		m.CurrentState = to
+		m.setField()
+
+		if m.OnTransition != nil {
+			m.OnTransition(from, to)
+		}
 	} else {
 		panic(fmt.Sprintf("FATAL ERROR: Cannot transition from %v to %v, not allowed", m.CurrentState, to))
 	}
 }
 
+func (m *Machine) fields(fields logger.Fields) logger.Fields {
+	if m.Name != "" {
+		fields["machine"] = m.Name
+	}
+
+	return fields
+}
+
+func (m *Machine) setField() {
+	if m.Name == "" {
+		logger.SetField("fsm_state", m.CurrentState.Name)
+	}
+}
+
 func (m Machine) IsCurrently(s State) bool {
 	return m.CurrentState.Equal(s)
 }
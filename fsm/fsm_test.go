@@ -1,6 +1,10 @@
 package fsm
 
 import (
+	"bytes"
+	"github.com/wakeful-deployment/operator/logger"
+	"os"
+	"strings"
 	"testing"
 )
 
@@ -60,3 +64,28 @@ func TestIllegalTransition(t *testing.T) {
 		t.Errorf("expected illegal transition to panic but did not")
 	}
 }
+
+func TestNamedMachineLeavesTheStateField(t *testing.T) {
+	var out bytes.Buffer
+	logger.Output = &out
+	defer func() { logger.Output = os.Stdout }()
+	defer logger.ClearField("fsm_state")
+
+	node := machine()
+	node.ForceTransition(state2, nil)
+
+	named := machine()
+	named.Name = "web"
+	named.Transition(state2, nil)
+
+	if !strings.Contains(out.String(), "fsm_state=state2 machine=web") {
+		t.Errorf("expected the named machine to log its name next to the node's state, but logged %s", out.String())
+	}
+
+	out.Reset()
+	named.Transition(state3, nil)
+
+	if !strings.Contains(out.String(), "fsm_state=state2") {
+		t.Errorf("expected the node's state to be kept, but logged %s", out.String())
+	}
+}
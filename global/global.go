@@ -2,6 +2,7 @@ package global
 
 import (
 	"github.com/wakeful-deployment/operator/fsm"
+	"github.com/wakeful-deployment/operator/metrics"
 )
 
 var (
@@ -41,12 +42,16 @@ var AllowedTransitions = fsm.Rules{
 	fsm.From(PostingMetadataFailed).To(Booting),
 	fsm.From(ConsulFailed).To(Booting, AttemptingToRecover),
 	fsm.From(Booted).To(ConsulFailed, FetchingDirectoryStateFailed, FetchingNodeStateFailed, NormalizingFailed, Running),
-	fsm.From(FetchingNodeStateFailed).To(AttemptingToRecover),
-	fsm.From(MergingStateFailed).To(AttemptingToRecover),
-	fsm.From(NormalizingFailed).To(AttemptingToRecover),
-	fsm.From(FetchingDirectoryStateFailed).To(AttemptingToRecover),
+	fsm.From(FetchingNodeStateFailed).To(AttemptingToRecover, FetchingDirectoryStateFailed),
+	fsm.From(MergingStateFailed).To(AttemptingToRecover, FetchingDirectoryStateFailed),
+	fsm.From(NormalizingFailed).To(AttemptingToRecover, FetchingDirectoryStateFailed),
+	fsm.From(FetchingDirectoryStateFailed).To(AttemptingToRecover, FetchingDirectoryStateFailed),
 	fsm.From(AttemptingToRecover).To(ConsulFailed, FetchingNodeStateFailed, NormalizingFailed, Running),
-	fsm.From(Running).To(ConsulFailed, FetchingNodeStateFailed, NormalizingFailed, Running),
+	fsm.From(Running).To(ConsulFailed, FetchingDirectoryStateFailed, FetchingNodeStateFailed, NormalizingFailed, Running),
 }
 
-var Machine = fsm.Machine{CurrentState: Initial, Rules: AllowedTransitions, States: states}
+var Machine = fsm.Machine{CurrentState: Initial, Rules: AllowedTransitions, States: states, OnTransition: countTransition}
+
+func countTransition(from fsm.State, to fsm.State) {
+	metrics.FSMTransitions.Inc(from.Name, to.Name)
+}
@@ -0,0 +1,104 @@
+package global
+
+import (
+	"github.com/wakeful-deployment/operator/fsm"
+	"sync"
+)
+
+// every service has a machine of its own, so a failed upgrade only fails
+// its service and not the whole node
+var (
+	ServiceRunning       = fsm.State{Name: "Running"}
+	ServiceUpgrading     = fsm.State{Name: "Upgrading"}
+	ServiceUpgradeFailed = fsm.State{Name: "UpgradeFailed"}
+)
+
+var serviceStates = []fsm.State{
+	ServiceRunning,
+	ServiceUpgrading,
+	ServiceUpgradeFailed,
+}
+
+var ServiceTransitions = fsm.Rules{
+	fsm.From(ServiceRunning).To(ServiceUpgrading),
+	fsm.From(ServiceUpgrading).To(ServiceRunning, ServiceUpgradeFailed),
+	fsm.From(ServiceUpgradeFailed).To(ServiceUpgrading, ServiceRunning),
+}
+
+// the machines are written by the loop and read by the http server
+var (
+	serviceMutex    sync.Mutex
+	serviceMachines = make(map[string]*fsm.Machine)
+)
+
+// serviceMachine must be called with serviceMutex held
+func serviceMachine(name string) *fsm.Machine {
+	m, ok := serviceMachines[name]
+
+	if !ok {
+		m = &fsm.Machine{Name: name, CurrentState: ServiceRunning, Rules: ServiceTransitions, States: serviceStates}
+		serviceMachines[name] = m
+	}
+
+	return m
+}
+
+// TransitionService moves the service's machine, which starts out Running
+func TransitionService(name string, to fsm.State, e error) {
+	serviceMutex.Lock()
+	defer serviceMutex.Unlock()
+
+	serviceMachine(name).Transition(to, e)
+}
+
+// ForceServiceTransition is for picking up a state from before a restart
+func ForceServiceTransition(name string, to fsm.State, e error) {
+	serviceMutex.Lock()
+	defer serviceMutex.Unlock()
+
+	serviceMachine(name).ForceTransition(to, e)
+}
+
+func ServiceState(name string) fsm.State {
+	serviceMutex.Lock()
+	defer serviceMutex.Unlock()
+
+	if m, ok := serviceMachines[name]; ok {
+		return m.CurrentState
+	}
+
+	return ServiceRunning
+}
+
+// ServiceStates returns the name of the state of every service with a
+// machine, ex: one which was upgraded
+func ServiceStates() map[string]string {
+	serviceMutex.Lock()
+	defer serviceMutex.Unlock()
+
+	states := make(map[string]string)
+
+	for name, m := range serviceMachines {
+		states[name] = m.CurrentState.Name
+	}
+
+	return states
+}
+
+// KeepServices forgets the machines of every service which isn't named
+func KeepServices(names []string) {
+	serviceMutex.Lock()
+	defer serviceMutex.Unlock()
+
+	keep := make(map[string]bool)
+
+	for _, name := range names {
+		keep[name] = true
+	}
+
+	for name := range serviceMachines {
+		if !keep[name] {
+			delete(serviceMachines, name)
+		}
+	}
+}
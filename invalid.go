@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"github.com/wakeful-deployment/operator/consul"
+	"github.com/wakeful-deployment/operator/logger"
+	"github.com/wakeful-deployment/operator/metrics"
+	"time"
+)
+
+// reportedInvalid are the invalid services written to consul, with the
+// error written, so each key is only written again when the error changes
+// and deleted once the service is fixed
+var reportedInvalid = make(map[string]string)
+
+// reportInvalidServices writes a key under the node's namespace for every
+// invalid service, and deletes the keys of the ones which have been fixed
+func reportInvalidServices(ctx context.Context, consulClient consul.Client, nodeName string, invalid map[string]string) {
+	metrics.InvalidServices.Set(float64(len(invalid)))
+
+	for name, message := range invalid {
+		if reportedInvalid[name] == message {
+			continue
+		}
+
+		logger.Error("service is invalid, leaving it alone", logger.Fields{"service": name, "error": message})
+
+		err := consul.PostInvalidService(ctx, consulClient, nodeName, name, consul.InvalidService{Error: message, Time: time.Now()})
+
+		if err != nil {
+			logger.Error("recording the invalid service in consul failed", logger.Fields{"service": name, "error": err})
+			continue
+		}
+
+		reportedInvalid[name] = message
+	}
+
+	for name := range reportedInvalid {
+		if _, ok := invalid[name]; ok {
+			continue
+		}
+
+		err := consul.ClearInvalidService(ctx, consulClient, nodeName, name)
+
+		if err != nil {
+			logger.Error("clearing the invalid service in consul failed", logger.Fields{"service": name, "error": err})
+			continue
+		}
+
+		delete(reportedInvalid, name)
+	}
+}
+
+// recallInvalidServices picks up the invalid services written to consul
+// before a restart, so the next tick deletes the keys of any which are fixed
+func recallInvalidServices(ctx context.Context, consulClient consul.Client, nodeName string) {
+	invalid, err := consul.ReportedInvalidServices(ctx, consulClient, nodeName)
+
+	if err != nil {
+		logger.Error("could not list the invalid services in consul", logger.Fields{"error": err})
+		return
+	}
+
+	for name, service := range invalid {
+		reportedInvalid[name] = service.Error
+	}
+}
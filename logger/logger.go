@@ -1,21 +1,185 @@
 package logger
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 )
 
-var Verbose bool
+type Level int
 
-func Info(content string) {
-	Log("INFO: ", content)
+const (
+	DebugLevel Level = iota
+	InfoLevel
+	WarnLevel
+	ErrorLevel
+)
+
+var levelNames = map[Level]string{
+	DebugLevel: "debug",
+	InfoLevel:  "info",
+	WarnLevel:  "warn",
+	ErrorLevel: "error",
+}
+
+func (l Level) String() string {
+	return levelNames[l]
+}
+
+func ParseLevel(name string) (Level, error) {
+	for level, n := range levelNames {
+		if n == strings.ToLower(name) {
+			return level, nil
+		}
+	}
+
+	return InfoLevel, errors.New(fmt.Sprintf("unknown log level '%s'", name))
+}
+
+const (
+	TextFormat = "text"
+	JSONFormat = "json"
+)
+
+// Fields are key/value pairs added to a log line, ex: Fields{"service": "consul"}
+type Fields map[string]interface{}
+
+// MinLevel is the least severe level which is still logged
+var MinLevel = InfoLevel
+
+// Format is either TextFormat (logfmt style) or JSONFormat (one object per line)
+var Format = TextFormat
+
+var Output io.Writer = os.Stdout
+
+// Now is swappable so tests can have predictable times
+var Now = time.Now
+
+var (
+	mutex  sync.Mutex
+	global = Fields{}
+)
+
+// SetField adds a field to every following log line until it's cleared,
+// ex: the current tick or fsm state
+func SetField(key string, value interface{}) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	global[key] = value
+}
+
+func ClearField(key string) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	delete(global, key)
+}
+
+func Debug(msg string, fields ...Fields) {
+	Log(DebugLevel, msg, fields...)
+}
+
+func Info(msg string, fields ...Fields) {
+	Log(InfoLevel, msg, fields...)
+}
+
+func Warn(msg string, fields ...Fields) {
+	Log(WarnLevel, msg, fields...)
 }
 
-func Error(content string) {
-	Log("ERROR: ", content)
+func Error(msg string, fields ...Fields) {
+	Log(ErrorLevel, msg, fields...)
 }
 
-func Log(prefix string, content string) {
-	if Verbose {
-		fmt.Println(fmt.Sprintf("%s%s", prefix, content))
+func Log(level Level, msg string, fields ...Fields) {
+	if level < MinLevel {
+		return
 	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	all := Fields{}
+
+	for key, value := range global {
+		all[key] = value
+	}
+
+	for _, f := range fields {
+		for key, value := range f {
+			all[key] = value
+		}
+	}
+
+	var line string
+
+	if Format == JSONFormat {
+		line = jsonLine(level, msg, all)
+	} else {
+		line = textLine(level, msg, all)
+	}
+
+	fmt.Fprintln(Output, line)
+}
+
+func jsonLine(level Level, msg string, fields Fields) string {
+	entry := make(map[string]interface{})
+
+	for key, value := range fields {
+		if err, ok := value.(error); ok {
+			value = err.Error()
+		}
+
+		entry[key] = value
+	}
+
+	entry["time"] = Now().UTC().Format(time.RFC3339)
+	entry["level"] = level.String()
+	entry["msg"] = msg
+
+	b, err := json.Marshal(entry)
+
+	if err != nil {
+		return fmt.Sprintf(`{"level":"error","msg":"could not encode log line: %v"}`, err)
+	}
+
+	return string(b)
+}
+
+func textLine(level Level, msg string, fields Fields) string {
+	pairs := []string{
+		fmt.Sprintf("time=%s", Now().UTC().Format(time.RFC3339)),
+		fmt.Sprintf("level=%s", level),
+		fmt.Sprintf("msg=%s", quote(msg)),
+	}
+
+	var keys []string
+
+	for key := range fields {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		pairs = append(pairs, fmt.Sprintf("%s=%s", key, quote(fmt.Sprintf("%v", fields[key]))))
+	}
+
+	return strings.Join(pairs, " ")
+}
+
+// quote only quotes values which would otherwise be ambiguous
+func quote(value string) string {
+	if value == "" || strings.ContainsAny(value, " =\"\t\n") {
+		return fmt.Sprintf("%q", value)
+	}
+
+	return value
 }
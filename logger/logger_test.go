@@ -1,29 +1,64 @@
 package logger
 
-func ExampleNotVerbose() {
-	Log("FOO: ", "bar")
+import (
+	"errors"
+	"os"
+	"time"
+)
+
+func setup() func() {
+	Output = os.Stdout
+	Now = func() time.Time { return time.Date(2016, 1, 2, 15, 4, 5, 0, time.UTC) }
+
+	return func() {
+		MinLevel = InfoLevel
+		Format = TextFormat
+		Now = time.Now
+	}
+}
+
+func Example_belowMinLevel() {
+	defer setup()()
+
+	Debug("foo")
 	// Output:
 	//
 }
 
-func ExampleInfoLog() {
-	Verbose = true
-	defer func() {
-		Verbose = false
-	}()
+func ExampleInfo() {
+	defer setup()()
 
-	Info("foo")
+	Info("foo", Fields{"service": "consul"})
 	// Output:
-	// INFO: foo
+	// time=2016-01-02T15:04:05Z level=info msg=foo service=consul
 }
 
-func ExampleErrorLog() {
-	Verbose = true
-	defer func() {
-		Verbose = false
-	}()
+func ExampleError() {
+	defer setup()()
+
+	Error("running failed", Fields{"error": errors.New("no such image")})
+	// Output:
+	// time=2016-01-02T15:04:05Z level=error msg="running failed" error="no such image"
+}
+
+func ExampleSetField() {
+	defer setup()()
+
+	MinLevel = DebugLevel
+	SetField("tick_id", 7)
+	defer ClearField("tick_id")
+
+	Debug("ticking")
+	// Output:
+	// time=2016-01-02T15:04:05Z level=debug msg=ticking tick_id=7
+}
+
+func Example_json() {
+	defer setup()()
+
+	Format = JSONFormat
 
-	Error("foo")
+	Warn("foo", Fields{"service": "consul", "error": errors.New("bar")})
 	// Output:
-	// ERROR: foo
+	// {"error":"bar","level":"warn","msg":"foo","service":"consul","time":"2016-01-02T15:04:05Z"}
 }
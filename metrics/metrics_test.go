@@ -0,0 +1,72 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestCounter(t *testing.T) {
+	c := &Counter{newVector("counter", "test_total", "A test", []string{"from", "to"})}
+
+	c.Inc("Booted", "Running")
+	c.Inc("Booted", "Running")
+	c.Inc("Running", "NormalizingFailed")
+
+	var b bytes.Buffer
+	c.write(&b)
+
+	expected := `# HELP test_total A test
+# TYPE test_total counter
+test_total{from="Booted",to="Running"} 2
+test_total{from="Running",to="NormalizingFailed"} 1
+`
+
+	if b.String() != expected {
+		t.Errorf("expected %s, but got %s", expected, b.String())
+	}
+}
+
+func TestGaugeWithoutLabels(t *testing.T) {
+	g := &Gauge{newVector("gauge", "test_gauge", "A test", nil)}
+
+	var b bytes.Buffer
+	g.write(&b)
+
+	if !strings.HasSuffix(b.String(), "test_gauge 0\n") {
+		t.Errorf("expected an unset gauge to be 0, but got %s", b.String())
+	}
+
+	g.Set(42)
+
+	b.Reset()
+	g.write(&b)
+
+	if !strings.HasSuffix(b.String(), "test_gauge 42\n") {
+		t.Errorf("expected the gauge to be 42, but got %s", b.String())
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	h := &Histogram{name: "test_seconds", help: "A test", buckets: []float64{1, 5}, counts: make([]uint64, 2)}
+
+	h.Observe(0.5)
+	h.Observe(2)
+	h.Observe(10)
+
+	var b bytes.Buffer
+	h.write(&b)
+
+	expected := `# HELP test_seconds A test
+# TYPE test_seconds histogram
+test_seconds_bucket{le="1"} 1
+test_seconds_bucket{le="5"} 2
+test_seconds_bucket{le="+Inf"} 3
+test_seconds_sum 12.5
+test_seconds_count 3
+`
+
+	if b.String() != expected {
+		t.Errorf("expected %s, but got %s", expected, b.String())
+	}
+}
@@ -0,0 +1,28 @@
+package metrics
+
+// The metrics operator exposes on /metrics
+
+var (
+	Ticks        = NewCounter("operator_ticks_total", "Ticks run, by the state the node ended up in", "state")
+	TickDuration = NewHistogram("operator_tick_duration_seconds", "How long each tick took", []float64{0.1, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300})
+
+	DockerRuns         = NewCounter("operator_docker_runs_total", "Containers started")
+	DockerRunFailures  = NewCounter("operator_docker_run_failures_total", "Containers which failed to start")
+	DockerStops        = NewCounter("operator_docker_stops_total", "Containers stopped and removed")
+	DockerStopFailures = NewCounter("operator_docker_stop_failures_total", "Containers which failed to stop or be removed")
+	DockerPulls        = NewCounter("operator_docker_pulls_total", "Images pulled")
+	DockerPullFailures = NewCounter("operator_docker_pull_failures_total", "Images which failed to pull")
+
+	ConsulRegistrations          = NewCounter("operator_consul_registrations_total", "Services registered in consul")
+	ConsulRegistrationFailures   = NewCounter("operator_consul_registration_failures_total", "Services which failed to register in consul")
+	ConsulDeregistrations        = NewCounter("operator_consul_deregistrations_total", "Services deregistered from consul")
+	ConsulDeregistrationFailures = NewCounter("operator_consul_deregistration_failures_total", "Services which failed to deregister from consul")
+	ConsulIndex                  = NewGauge("operator_consul_index", "The index of the last blocking query on this node's services")
+
+	FSMTransitions = NewCounter("operator_fsm_transitions_total", "State machine transitions", "from", "to")
+
+	DesiredContainers = NewGauge("operator_desired_containers", "Containers which should be running on this node")
+	RunningContainers = NewGauge("operator_running_containers", "Containers which are running on this node, excluding operator")
+	CrashLooping      = NewGauge("operator_crash_looping_containers", "Containers docker keeps restarting, or gave up restarting")
+	InvalidServices   = NewGauge("operator_invalid_services", "Services in consul which are invalid and left alone")
+)
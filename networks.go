@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"github.com/wakeful-deployment/operator/docker"
+	"github.com/wakeful-deployment/operator/service"
+	"regexp"
+	"sort"
+)
+
+// docker's rule for network names, which can't be one of its own networks
+var networkNamePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+var reservedNetworks = map[string]bool{
+	"bridge":  true,
+	"host":    true,
+	"none":    true,
+	"default": true,
+}
+
+func (s *State) networkNames() []string {
+	var names []string
+
+	for name := range s.Networks {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+// validateNetworks checks the networks declared in operator.json, ex:
+// "networks.backend: must not be null"
+func (s *State) validateNetworks() service.ValidationErrors {
+	var errs service.ValidationErrors
+
+	add := func(field string, format string, args ...interface{}) {
+		errs = append(errs, service.ValidationError{Field: field, Message: fmt.Sprintf(format, args...)})
+	}
+
+	for _, name := range s.networkNames() {
+		field := "networks." + name
+
+		if s.Networks[name] == nil {
+			add(field, "must not be null")
+			continue
+		}
+
+		if !networkNamePattern.MatchString(name) {
+			add(field, "'%s' must start with a letter or digit and only contain letters, digits, '_', '.' and '-'", name)
+		} else if reservedNetworks[name] {
+			add(field, "'%s' is one of docker's own networks, use network_mode instead", name)
+		}
+	}
+
+	return errs
+}
+
+// checkNetworks makes sure every network the service joins is declared in
+// operator.json, since those are the only ones operator creates
+func (s *State) checkNetworks(svc service.Service) error {
+	var errs service.ValidationErrors
+
+	for _, name := range svc.NetworkNames() {
+		if s.Networks[name] == nil {
+			errs = append(errs, service.ValidationError{
+				Field:   "networks." + name,
+				Message: "is not declared in operator.json",
+			})
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+
+	return nil
+}
+
+// ServiceNetworks are the declared networks the service joins
+func (s *State) ServiceNetworks(svc service.Service) []docker.Network {
+	var networks []docker.Network
+
+	for _, name := range svc.NetworkNames() {
+		if s.Networks[name] != nil {
+			networks = append(networks, *s.Networks[name])
+		}
+	}
+
+	return networks
+}
+
+// DesiredNetworks are the declared networks at least one service joins.
+// The rest are not created, or removed if operator created them before.
+func (s *State) DesiredNetworks() []docker.Network {
+	joined := make(map[string]bool)
+
+	for _, svc := range s.Services {
+		for _, name := range svc.NetworkNames() {
+			joined[name] = true
+		}
+	}
+
+	var networks []docker.Network
+
+	for _, name := range s.networkNames() {
+		if joined[name] && s.Networks[name] != nil {
+			networks = append(networks, *s.Networks[name])
+		}
+	}
+
+	return networks
+}
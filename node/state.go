@@ -1,25 +1,25 @@
 package node
 
 import (
+	"context"
 	"github.com/wakeful-deployment/operator/consul"
 	"github.com/wakeful-deployment/operator/container"
 	"github.com/wakeful-deployment/operator/docker"
-	"github.com/wakeful-deployment/operator/service"
 )
 
 type State struct {
-	Containers []container.Container
-	Services   []service.Service
+	Containers []container.Container          `json:"containers"`
+	Services   []consul.ServiceRepresentation `json:"services"`
 }
 
-func CurrentState(dockerClient docker.Client, consulClient consul.Client) (*State, error) {
-	containers, err := docker.RunningContainers(dockerClient)
+func CurrentState(ctx context.Context, dockerClient docker.Client, consulClient consul.Client) (*State, error) {
+	containers, err := docker.RunningContainers(ctx, dockerClient)
 
 	if err != nil {
 		return nil, err
 	}
 
-	services, err := consul.RegisteredServices(consulClient)
+	services, err := consul.RegisteredServices(ctx, consulClient)
 
 	if err != nil {
 		return nil, err
@@ -29,3 +29,29 @@ func CurrentState(dockerClient docker.Client, consulClient consul.Client) (*Stat
 
 	return &currentState, nil
 }
+
+// Without returns a copy of the state leaving out the containers and
+// services with any of the names
+func (s *State) Without(names []string) *State {
+	skip := make(map[string]bool)
+
+	for _, name := range names {
+		skip[name] = true
+	}
+
+	result := &State{}
+
+	for _, c := range s.Containers {
+		if !skip[c.Name] {
+			result.Containers = append(result.Containers, c)
+		}
+	}
+
+	for _, r := range s.Services {
+		if !skip[r.ID] {
+			result.Services = append(result.Services, r)
+		}
+	}
+
+	return result
+}
@@ -1,7 +1,9 @@
 package node
 
 import (
+	"context"
 	"errors"
+	"github.com/wakeful-deployment/operator/container"
 	"github.com/wakeful-deployment/operator/test"
 	"testing"
 )
@@ -15,16 +17,18 @@ func erroredRegisteredServices() (string, error) {
 	return "", errors.New("I don't care")
 }
 
-func runningContainers() (string, error) {
-	str := `921582f62758 consul
-405bab56d0c7 statsite
-3e02f2aae498 operator`
+func runningContainers() ([]container.Container, error) {
+	containers := []container.Container{
+		container.Container{ID: "921582f62758", Name: "consul"},
+		container.Container{ID: "405bab56d0c7", Name: "statsite"},
+		container.Container{ID: "3e02f2aae498", Name: "redis"},
+	}
 
-	return str, nil
+	return containers, nil
 }
 
-func erroredRunningContainers() (string, error) {
-	return "", errors.New("I don't care")
+func erroredRunningContainers() ([]container.Container, error) {
+	return nil, errors.New("I don't care")
 }
 
 func TestSuccessfulCurrentState(t *testing.T) {
@@ -36,7 +40,7 @@ func TestSuccessfulCurrentState(t *testing.T) {
 		RegisteredServicesResponse: registeredServices,
 	}
 
-	state, err := CurrentState(dockerClient, consulClient)
+	state, err := CurrentState(context.Background(), dockerClient, consulClient)
 
 	if err != nil {
 		t.Errorf("Got an error: %v", err)
@@ -62,7 +66,7 @@ func TestConsulErrorCurrentState(t *testing.T) {
 		RegisteredServicesResponse: erroredRegisteredServices,
 	}
 
-	_, err := CurrentState(dockerClient, consulClient)
+	_, err := CurrentState(context.Background(), dockerClient, consulClient)
 
 	if err == nil {
 		t.Error("We expected an error, but got none")
@@ -78,7 +82,7 @@ func TestDockerErrorCurrentState(t *testing.T) {
 		RegisteredServicesResponse: registeredServices,
 	}
 
-	_, err := CurrentState(dockerClient, consulClient)
+	_, err := CurrentState(context.Background(), dockerClient, consulClient)
 
 	if err == nil {
 		t.Error("We expected an error, but got none")
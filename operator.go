@@ -1,34 +1,126 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"github.com/wakeful-deployment/operator/backoff"
 	"github.com/wakeful-deployment/operator/consul"
 	"github.com/wakeful-deployment/operator/docker"
 	"github.com/wakeful-deployment/operator/global"
 	"github.com/wakeful-deployment/operator/logger"
-	"io"
+	"github.com/wakeful-deployment/operator/metrics"
 	"net/http"
+	"os"
+	"os/signal"
+	"sort"
 	"strings"
+	"syscall"
 	"time"
 )
 
+// commands are what operator can be asked to do, ex: `operator plan -node
+// abc123 -consul 10.0.0.1`. Without a command operator runs.
+var commands = map[string]func(args []string) int{
+	"run":      runCommand,
+	"apply":    applyCommand,
+	"plan":     planCommand,
+	"diff":     diffCommand,
+	"status":   statusCommand,
+	"validate": validateCommand,
+}
+
 func main() {
-	var (
-		nodeName   = flag.String("node", "", "The name of the host which is running operator")
-		consulHost = flag.String("consul", "", "The name or ip of the consul host")
-		configPath = flag.String("config", "./operator.json", "The path to the operator.json (default is .)")
-		shouldLoop = flag.Bool("loop", false, "Run on each change to the consul key/value storage")
-		wait       = flag.String("wait", "", "The timeout for polling")
-		metadata   = flag.String("metadata", "", "JSON metadata to add to the directory for this node")
-		verbose    = flag.Bool("verbose", false, "Log more info for easier debugging")
-	)
-	flag.Parse()
+	command, args, err := findCommand(os.Args[1:])
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+		os.Exit(2)
+	}
+
+	os.Exit(command(args))
+}
+
+// findCommand picks the command named by the first argument, or run when it
+// is a flag or there is none. Commands always come before their flags.
+func findCommand(args []string) (func(args []string) int, []string, error) {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return commands["run"], args, nil
+	}
+
+	command, ok := commands[args[0]]
+
+	if !ok {
+		return nil, nil, errors.New(fmt.Sprintf("unknown command '%s', expected one of %s", args[0], strings.Join(commandNames(), ", ")))
+	}
+
+	return command, args[1:], nil
+}
+
+func commandNames() []string {
+	var names []string
+
+	for name := range commands {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
 
-	state := LoadBootStateFromFile(*configPath)
+	return names
+}
+
+// options are the flags shared by every command which talks to docker and
+// consul. They override what is in operator.json.
+type options struct {
+	nodeName   *string
+	consulHost *string
+	address    *string
+	dockerHost *string
+	configPath *string
+	shouldLoop *bool
+	wait       *string
+	metadata   *string
+	upgrade    *string
+	verbose    *bool
+	logLevel   *string
+	logFormat  *string
+	deregister *bool
+	stop       *bool
+	resync     *string
+	pull       *string
+}
 
-	go runServer()
+func newFlagSet(name string) (*flag.FlagSet, *options) {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+
+	o := &options{
+		nodeName:   flags.String("node", "", "The name of the host which is running operator"),
+		consulHost: flags.String("consul", "", "The name or ip of the consul host"),
+		address:    flags.String("address", "", "The address to register services with (default is the node address of the consul agent)"),
+		dockerHost: flags.String("docker", "", "The docker daemon to use (default is $DOCKER_HOST or unix:///var/run/docker.sock)"),
+		configPath: flags.String("config", "./operator.json", "The path to the operator.json (default is .)"),
+		shouldLoop: flags.Bool("loop", false, "Run on each change to the consul key/value storage"),
+		wait:       flags.String("wait", "", "The timeout for polling"),
+		metadata:   flags.String("metadata", "", "JSON metadata to add to the directory for this node"),
+		upgrade:    flags.String("upgrade-timeout", "", "How long a new image has to become healthy before an upgrade is rolled back (default is 1m)"),
+		verbose:    flags.Bool("verbose", false, "Log more info for easier debugging (same as -log-level debug)"),
+		logLevel:   flags.String("log-level", "", "The least severe level to log: debug, info, warn or error (default is info)"),
+		logFormat:  flags.String("log-format", "", "Log as text or json (default is text)"),
+		deregister: flags.Bool("deregister-on-shutdown", false, "Deregister this node's services from consul when shutting down"),
+		stop:       flags.Bool("stop-on-shutdown", false, "Stop the managed containers when shutting down"),
+		resync:     flags.String("resync", "", "How often to reconcile the node even when nothing changed in consul, 0 to never (default is 1m)"),
+		pull:       flags.String("pull-interval", "", "How often images pulled with the always policy are checked for a new image (default is 5m)"),
+	}
+
+	return flags, o
+}
+
+// configure loads operator.json, applies the flags on top and sets up
+// logging and the package settings which come from the config
+func (o *options) configure() *State {
+	state := LoadBootStateFromFile(*o.configPath)
 
 	// panic if config failed to load
 
@@ -36,18 +128,59 @@ func main() {
 		panic(global.Machine.CurrentState.Error)
 	}
 
-	if *shouldLoop {
+	// logging first, so everything after is logged as configured
+
+	if *o.logLevel != "" {
+		state.LogLevel = *o.logLevel
+	}
+
+	if *o.verbose {
+		state.LogLevel = "debug"
+	}
+
+	if state.LogLevel != "" {
+		level, err := logger.ParseLevel(state.LogLevel)
+
+		if err != nil {
+			panic(fmt.Sprintf("ERROR: %v", err))
+		}
+
+		logger.MinLevel = level
+	}
+
+	if *o.logFormat != "" {
+		state.LogFormat = *o.logFormat
+	}
+
+	switch state.LogFormat {
+	case "", logger.TextFormat:
+		logger.Format = logger.TextFormat
+	case logger.JSONFormat:
+		logger.Format = logger.JSONFormat
+	default:
+		panic(fmt.Sprintf("ERROR: unknown log format '%s'", state.LogFormat))
+	}
+
+	if *o.shouldLoop {
 		state.ShouldLoop = true
 	}
 
+	if *o.deregister {
+		state.DeregisterOnShutdown = true
+	}
+
+	if *o.stop {
+		state.StopOnShutdown = true
+	}
+
 	// proceed with configuration
 
-	if *nodeName != "" {
-		state.NodeName = *nodeName
+	if *o.nodeName != "" {
+		state.NodeName = *o.nodeName
 	}
 
-	if *consulHost != "" {
-		state.ConsulHost = *consulHost
+	if *o.consulHost != "" {
+		state.ConsulHost = *o.consulHost
 	}
 
 	// required flags
@@ -58,17 +191,21 @@ func main() {
 
 	// other flags
 
-	if *wait != "" {
-		state.Wait = *wait
+	if *o.address != "" {
+		state.Address = *o.address
 	}
 
-	if *metadata != "" {
+	if *o.wait != "" {
+		state.Wait = *o.wait
+	}
+
+	if *o.metadata != "" {
 		var m map[string]string
 
-		jsonErr := json.NewDecoder(strings.NewReader(*metadata)).Decode(&m)
+		jsonErr := json.NewDecoder(strings.NewReader(*o.metadata)).Decode(&m)
 
 		if jsonErr != nil {
-			fmt.Println("-metadata was not valid json, skipping")
+			logger.Warn("-metadata was not valid json, skipping", logger.Fields{"error": jsonErr})
 		} else {
 			state.Metadata = m
 		}
@@ -80,24 +217,194 @@ func main() {
 		state.Wait = "5m"
 	}
 
-	logger.Verbose = *verbose
+	if *o.upgrade != "" {
+		state.UpgradeTimeout = *o.upgrade
+	}
+
+	if state.UpgradeTimeout == "" {
+		state.UpgradeTimeout = "1m"
+	}
+
+	upgradeTimeout, err := time.ParseDuration(state.UpgradeTimeout)
+
+	if err != nil {
+		panic(fmt.Sprintf("ERROR: upgrade timeout '%s' is not a valid duration", state.UpgradeTimeout))
+	}
+
+	docker.UpgradeTimeout = upgradeTimeout
 
-	// dependencies
+	if *o.resync != "" {
+		state.Resync = *o.resync
+	}
 
-	dockerClient := docker.EngineClient{}
-	consulClient := consul.HttpClient{Host: state.ConsulHost}
+	if state.Resync == "" {
+		state.Resync = "1m"
+	}
 
-	logger.Info("ready to go...")
+	resyncInterval, err = time.ParseDuration(state.Resync)
+
+	if err != nil {
+		panic(fmt.Sprintf("ERROR: resync interval '%s' is not a valid duration", state.Resync))
+	}
+
+	if *o.pull != "" {
+		state.PullInterval = *o.pull
+	}
+
+	if state.PullInterval == "" {
+		state.PullInterval = "5m"
+	}
 
-	run(dockerClient, consulClient, state)
+	pullInterval, err := time.ParseDuration(state.PullInterval)
+
+	if err != nil {
+		panic(fmt.Sprintf("ERROR: pull interval '%s' is not a valid duration", state.PullInterval))
+	}
+
+	docker.PullInterval = pullInterval
+
+	retryPolicy, err = state.Backoff.Policy()
+
+	if err != nil {
+		panic(fmt.Sprintf("ERROR: %v", err))
+	}
+
+	if *o.dockerHost != "" {
+		state.DockerHost = *o.dockerHost
+	}
+
+	if state.DockerHost == "" {
+		state.DockerHost = os.Getenv("DOCKER_HOST")
+	}
+
+	if state.DockerHost == "" {
+		state.DockerHost = docker.DefaultHost
+	}
+
+	return state
+}
+
+func clients(state *State) (docker.Client, consul.Client) {
+	dockerClient := docker.APIClient{
+		Host:        state.DockerHost,
+		Timeout:     parseTimeout("docker", state.Timeouts.Docker),
+		PullTimeout: parseTimeout("docker_pull", state.Timeouts.DockerPull),
+	}
+	consulClient := consul.HttpClient{
+		Host:    state.ConsulHost,
+		Address: state.Address,
+		Timeout: parseTimeout("consul", state.Timeouts.Consul),
+	}
+
+	return dockerClient, consulClient
+}
+
+// runCommand boots, ticks once or keeps ticking with -loop, and serves the
+// HTTP API until it is signalled to stop
+func runCommand(args []string) int {
+	flags, o := newFlagSet("run")
+	plan := flags.Bool("plan", false, "Print what would be changed on this node without changing it, then exit (same as the plan command)")
+	format := flags.String("format", "text", "Print the plan as text or json")
+	flags.Parse(args)
+
+	// ex: `operator -node abc123 plan`, which would otherwise just run
+	if flags.NArg() > 0 {
+		fmt.Fprintf(os.Stderr, "ERROR: unexpected arguments %v, a command goes before the flags, ex: operator plan -node abc123\n", flags.Args())
+		return 2
+	}
+
+	if *plan {
+		return printPlan(o, *format)
+	}
+
+	state := o.configure()
+	dockerClient, consulClient := clients(state)
+
+	logger.Info("ready to go...", logger.Fields{"node": state.NodeName, "consul": state.ConsulHost, "docker": state.DockerHost})
+
+	server := runServer()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go handleSignals(cancel)
+
+	run(ctx, dockerClient, consulClient, state)
+
+	logger.Info("shutting down...")
+
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelShutdown()
+
+	err := server.Shutdown(shutdownCtx)
+
+	if err != nil {
+		logger.Error("shutting down the http server failed", logger.Fields{"error": err})
+	}
+
+	// cleaning up is for when operator is being stopped, a single run
+	// leaves the node as it just made it
+	if ctx.Err() == nil {
+		logger.Info("bye")
+		return 0
+	}
+
+	err = Shutdown(context.Background(), dockerClient, consulClient, state)
+
+	if err != nil {
+		logger.Error("cleaning up failed", logger.Fields{"error": err})
+		return 1
+	}
+
+	logger.Info("bye")
+
+	return 0
 }
 
-func runServer() {
-	http.HandleFunc("/api/state", func(w http.ResponseWriter, r *http.Request) {
-		io.WriteString(w, fmt.Sprintf("%v", global.Machine.CurrentState))
+// parseTimeout returns 0, meaning the client's default, when no timeout is set
+func parseTimeout(name string, value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+
+	timeout, err := time.ParseDuration(value)
+
+	if err != nil {
+		panic(fmt.Sprintf("ERROR: %s timeout '%s' is not a valid duration", name, value))
+	}
+
+	return timeout
+}
+
+// handleSignals cancels the loop on the first SIGINT or SIGTERM, so the
+// current tick can finish. A second signal exits right away.
+func handleSignals(cancel context.CancelFunc) {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	sig := <-signals
+	logger.Info("received signal, finishing the current tick", logger.Fields{"signal": sig})
+	cancel()
+
+	sig = <-signals
+	logger.Warn("received second signal, exiting now", logger.Fields{"signal": sig})
+	os.Exit(1)
+}
+
+func runServer() *http.Server {
+	mux := http.NewServeMux()
+	server := &http.Server{Addr: ":8000", Handler: mux}
+
+	mux.HandleFunc("/api/state", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		err := json.NewEncoder(w).Encode(currentStatus.Report())
+
+		if err != nil {
+			logger.Error("encoding the state failed", logger.Fields{"error": err})
+		}
 	})
 
-	http.HandleFunc("/_health", func(w http.ResponseWriter, r *http.Request) {
+	mux.Handle("/metrics", metrics.Handler())
+
+	mux.HandleFunc("/_health", func(w http.ResponseWriter, r *http.Request) {
 		if global.Machine.IsCurrently(global.Running) {
 			w.WriteHeader(http.StatusNoContent)
 		} else {
@@ -105,23 +412,55 @@ func runServer() {
 		}
 	})
 
-	http.ListenAndServe(":8000", nil)
+	go func() {
+		err := server.ListenAndServe()
+
+		if err != nil && err != http.ErrServerClosed {
+			logger.Error("http server failed", logger.Fields{"error": err})
+		}
+	}()
+
+	return server
 }
 
-func run(dockerClient docker.Client, consulClient consul.Client, state *State) {
-	for {
-		Boot(dockerClient, consulClient, state)
+func run(ctx context.Context, dockerClient docker.Client, consulClient consul.Client, state *State) {
+	if !boot(ctx, dockerClient, consulClient, state, 0) {
+		return
+	}
+
+	if state.ShouldLoop {
+		Loop(ctx, dockerClient, consulClient, state)
+	} else {
+		Once(ctx, dockerClient, consulClient, state)
+	}
+}
+
+// boot retries Boot with backoff until it succeeds, ctx is cancelled or it
+// was attempted the given number of times, where 0 means no limit. It
+// returns whether the node booted.
+func boot(ctx context.Context, dockerClient docker.Client, consulClient consul.Client, state *State, attempts int) bool {
+	retries := backoff.New(retryPolicy)
+
+	for attempt := 1; ; attempt++ {
+		Boot(ctx, dockerClient, consulClient, state)
 
 		if global.Machine.IsCurrently(global.Booted) {
 			break
 		}
 
-		time.Sleep(6 * time.Second)
-	}
+		if attempts > 0 && attempt >= attempts {
+			logger.Error("giving up booting", logger.Fields{"attempts": attempt})
+			return false
+		}
 
-	if state.ShouldLoop {
-		Loop(dockerClient, consulClient, state)
-	} else {
-		Once(dockerClient, consulClient, state)
+		wait(ctx, retries)
+
+		if ctx.Err() != nil {
+			return false
+		}
 	}
+
+	currentStatus.recordBackoff(0)
+
+	return true
 }
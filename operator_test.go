@@ -0,0 +1,37 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFindCommand(t *testing.T) {
+	same := func(a func([]string) int, b func([]string) int) bool {
+		return reflect.ValueOf(a).Pointer() == reflect.ValueOf(b).Pointer()
+	}
+
+	command, args, err := findCommand([]string{"plan", "-node", "abc123"})
+
+	if err != nil || !same(command, planCommand) || strings.Join(args, " ") != "-node abc123" {
+		t.Errorf("Expected plan with its flags but got %v (%v)", args, err)
+	}
+
+	command, args, err = findCommand([]string{"-node", "abc123", "-loop"})
+
+	if err != nil || !same(command, runCommand) || len(args) != 3 {
+		t.Errorf("Expected run with every flag but got %v (%v)", args, err)
+	}
+
+	command, args, err = findCommand(nil)
+
+	if err != nil || !same(command, runCommand) || len(args) != 0 {
+		t.Errorf("Expected run without flags but got %v (%v)", args, err)
+	}
+
+	_, _, err = findCommand([]string{"plna", "-node", "abc123"})
+
+	if err == nil || !strings.Contains(err.Error(), "unknown command 'plna'") {
+		t.Errorf("Expected an unknown command to error but got %v", err)
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/wakeful-deployment/operator/consul"
+	"github.com/wakeful-deployment/operator/container"
+	"github.com/wakeful-deployment/operator/docker"
+	"github.com/wakeful-deployment/operator/logger"
+	"github.com/wakeful-deployment/operator/node"
+	"github.com/wakeful-deployment/operator/service"
+	"io"
+	"sort"
+)
+
+// exit codes of plan mode, so scripts can tell pending changes from errors
+const (
+	PlanNoChanges = 0
+	PlanFailed    = 1
+	PlanChanges   = 2
+)
+
+// Plan is what a tick would do to the node, by container or service name
+type Plan struct {
+	CreateNetwork []string `json:"create_network"`
+	Upgrade       []string `json:"upgrade"`
+	Start         []string `json:"start"`
+	Stop          []string `json:"stop"`
+	Recreate      []string `json:"recreate"`
+	RemoveNetwork []string `json:"remove_network"`
+	Register      []string `json:"register"`
+	Deregister    []string `json:"deregister"`
+}
+
+func (p Plan) Empty() bool {
+	return len(p.CreateNetwork) == 0 && len(p.Upgrade) == 0 && len(p.Start) == 0 && len(p.Stop) == 0 && len(p.Recreate) == 0 && len(p.RemoveNetwork) == 0 && len(p.Register) == 0 && len(p.Deregister) == 0
+}
+
+// MakePlan works out the same changes as normalize, without making them
+func MakePlan(ctx context.Context, dockerClient docker.Client, consulClient consul.Client, desiredState *State, currentNodeState *node.State) Plan {
+	currentNodeState = currentNodeState.Without(desiredState.InvalidNames())
+
+	networks, err := docker.PlanNetworks(ctx, dockerClient, desiredState.DesiredNetworks())
+
+	if err != nil {
+		logger.Error("could not plan networks, leaving them out of the plan", logger.Fields{"error": err})
+	}
+
+	desiredContainers := stateContainers(desiredState, consulClient)
+	currentContainers := currentNodeState.Containers
+
+	pending := docker.PendingUpgrades(desiredContainers, currentContainers)
+	desiredContainers = withoutContainers(desiredContainers, docker.Names(pending))
+	currentContainers = withoutContainers(currentContainers, docker.Names(pending))
+	upgrades := docker.Names(withoutFailedUpgrades(ctx, consulClient, desiredState.NodeName, pending))
+
+	containers := docker.PlanContainers(ctx, dockerClient, desiredContainers, currentContainers)
+
+	var desiredServices []service.Service
+
+	for _, s := range desiredState.Services {
+		desiredServices = append(desiredServices, *s)
+	}
+
+	services := consul.PlanServices(consulClient, desiredServices, currentNodeState.Services)
+
+	return Plan{
+		CreateNetwork: list(docker.NetworkNames(networks.Create)),
+		Upgrade:       list(upgrades),
+		Start:         list(docker.Names(containers.Start)),
+		Stop:          list(docker.Names(containers.Stop)),
+		Recreate:      list(docker.Names(containers.Recreate)),
+		RemoveNetwork: list(docker.NetworkNames(networks.Remove)),
+		Register:      list(consul.IDs(services.Register)),
+		Deregister:    list(consul.IDs(services.Deregister)),
+	}
+}
+
+// withoutFailedUpgrades leaves out the upgrades which already failed with
+// the same spec, since a tick won't try them again
+func withoutFailedUpgrades(ctx context.Context, consulClient consul.Client, nodeName string, upgrades []container.Container) []container.Container {
+	if len(upgrades) == 0 {
+		return upgrades
+	}
+
+	failures, err := consul.UpgradeFailures(ctx, consulClient, nodeName)
+
+	if err != nil {
+		logger.Error("could not list failed upgrades, leaving them in the plan", logger.Fields{"error": err})
+		return upgrades
+	}
+
+	var result []container.Container
+
+	for _, c := range upgrades {
+		if failure, ok := failures[c.Name]; ok && failure.Hash == c.Hash() {
+			continue
+		}
+
+		result = append(result, c)
+	}
+
+	return result
+}
+
+// list sorts the names, and makes sure no changes are encoded as [] rather
+// than null
+func list(names []string) []string {
+	if names == nil {
+		return []string{}
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+// WriteText writes the plan as one line per change, ex: "+ start proxy"
+func (p Plan) WriteText(w io.Writer) {
+	if p.Empty() {
+		fmt.Fprintln(w, "No changes.")
+		return
+	}
+
+	changes := []struct {
+		symbol string
+		action string
+		names  []string
+	}{
+		{"+", "create network", p.CreateNetwork},
+		{"^", "upgrade", p.Upgrade},
+		{"+", "start", p.Start},
+		{"-", "stop", p.Stop},
+		{"~", "recreate", p.Recreate},
+		{"-", "remove network", p.RemoveNetwork},
+		{"+", "register", p.Register},
+		{"-", "deregister", p.Deregister},
+	}
+
+	for _, change := range changes {
+		for _, name := range change.names {
+			fmt.Fprintf(w, "%s %s %s\n", change.symbol, change.action, name)
+		}
+	}
+}
+
+// runPlan prints what a tick would do right now as text or json and returns
+// the exit code
+func runPlan(ctx context.Context, dockerClient docker.Client, consulClient consul.Client, bootState *State, format string, w io.Writer) int {
+	desiredState, currentNodeState, err := observe(ctx, dockerClient, consulClient, bootState)
+
+	if err != nil {
+		return PlanFailed
+	}
+
+	plan := MakePlan(ctx, dockerClient, consulClient, desiredState, currentNodeState)
+
+	if format == "json" {
+		err = json.NewEncoder(w).Encode(plan)
+
+		if err != nil {
+			logger.Error("encoding the plan failed", logger.Fields{"error": err})
+			return PlanFailed
+		}
+	} else {
+		plan.WriteText(w)
+	}
+
+	if plan.Empty() {
+		return PlanNoChanges
+	}
+
+	return PlanChanges
+}
+
+// observe fetches the desired state and the current state of the node once,
+// without booting or changing anything
+func observe(ctx context.Context, dockerClient docker.Client, consulClient consul.Client, bootState *State) (*State, *node.State, error) {
+	directoryState, err := consulClient.GetDirectoryState(ctx, bootState.NodeName, 0, "0s")
+
+	if err != nil {
+		logger.Error("fetching directory state failed", logger.Fields{"error": err})
+		return nil, nil, err
+	}
+
+	desiredState := MergeStates(bootState, directoryState)
+
+	for _, name := range desiredState.InvalidNames() {
+		logger.Warn("service is invalid, leaving it alone", logger.Fields{"service": name, "error": desiredState.Invalid[name]})
+	}
+
+	currentNodeState, err := node.CurrentState(ctx, dockerClient, consulClient)
+
+	if err != nil {
+		logger.Error("getting current node state failed", logger.Fields{"error": err})
+		return nil, nil, err
+	}
+
+	return desiredState, currentNodeState, nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/wakeful-deployment/operator/consul"
+	"github.com/wakeful-deployment/operator/container"
+	"testing"
+)
+
+func TestPlan(t *testing.T) {
+	var startedContainers []string
+	var stoppedContainers []string
+	dockerClient := dockerClient(&startedContainers, &stoppedContainers)
+	dockerClient.RunningContainersResponse = func() ([]container.Container, error) {
+		return []container.Container{
+			container.Container{Name: "consul", Image: "plum/wake-consul-agent:latest"},
+			container.Container{Name: "statsite", Image: "plum/wake-statsite:latest"},
+			container.Container{Name: "old", Image: "plum/old:latest", Labels: managed("old")},
+		}, nil
+	}
+
+	var registeredServices []string
+	var deregisteredServices []string
+	consulClient := consulClient(&registeredServices, &deregisteredServices)
+	consulClient.RegisteredServicesResponse = func() (string, error) {
+		return `{"consul":{"ID":"consul","Service":"consul","Tags":[],"Address":"","Port":0},"statsite":{"ID":"statsite","Service":"statsite","Tags":null,"Address":"","Port":0},"old":{"ID":"old","Service":"old","Tags":null,"Address":"","Port":0}}`, nil
+	}
+	consulClient.GetDirectoryStateResponse = func() (*consul.DirectoryState, error) {
+		proxyKV := consul.KV{Key: "_wakeful/nodes/981eb8e33da95184/services/proxy", Value: "eyJpbWFnZSI6InBsdW0vd2FrZS1wcm94eTpsYXRlc3QiLCJ0YWdzIjpbXX0="}
+		return &consul.DirectoryState{KVs: []consul.KV{proxyKV}}, nil
+	}
+
+	var out bytes.Buffer
+	code := runPlan(context.Background(), dockerClient, consulClient, bootState(), "text", &out)
+
+	if code != PlanChanges {
+		t.Errorf("Expected exit code %d but was %d", PlanChanges, code)
+	}
+
+	expected := "+ start proxy\n- stop old\n+ register proxy\n- deregister old\n"
+
+	if out.String() != expected {
+		t.Errorf("Expected plan:\n%s\nbut was:\n%s", expected, out.String())
+	}
+
+	if len(startedContainers) != 0 || len(stoppedContainers) != 0 || len(registeredServices) != 0 || len(deregisteredServices) != 0 {
+		t.Error("Expected planning not to change anything")
+	}
+
+	out.Reset()
+	runPlan(context.Background(), dockerClient, consulClient, bootState(), "json", &out)
+	expected = `{"create_network":[],"upgrade":[],"start":["proxy"],"stop":["old"],"recreate":[],"remove_network":[],"register":["proxy"],"deregister":["old"]}` + "\n"
+
+	if out.String() != expected {
+		t.Errorf("Expected plan %s but was %s", expected, out.String())
+	}
+}
+
+func TestPlanWithoutChanges(t *testing.T) {
+	var startedContainers []string
+	var stoppedContainers []string
+	dockerClient := dockerClient(&startedContainers, &stoppedContainers)
+	dockerClient.RunningContainersResponse = func() ([]container.Container, error) {
+		return []container.Container{
+			container.Container{Name: "consul", Image: "plum/wake-consul-agent:latest"},
+			container.Container{Name: "statsite", Image: "plum/wake-statsite:latest"},
+		}, nil
+	}
+
+	var registeredServices []string
+	var deregisteredServices []string
+	consulClient := consulClient(&registeredServices, &deregisteredServices)
+	consulClient.RegisteredServicesResponse = func() (string, error) {
+		return `{"consul":{"ID":"consul","Service":"consul","Tags":[],"Address":"","Port":0},"statsite":{"ID":"statsite","Service":"statsite","Tags":null,"Address":"","Port":0}}`, nil
+	}
+	consulClient.GetDirectoryStateResponse = func() (*consul.DirectoryState, error) {
+		return &consul.DirectoryState{}, nil
+	}
+
+	var out bytes.Buffer
+	code := runPlan(context.Background(), dockerClient, consulClient, bootState(), "text", &out)
+
+	if code != PlanNoChanges {
+		t.Errorf("Expected exit code %d but was %d", PlanNoChanges, code)
+	}
+
+	if out.String() != "No changes.\n" {
+		t.Errorf("Expected no changes but was %s", out.String())
+	}
+}
+
+func TestPlanLeavesOutFailedUpgrades(t *testing.T) {
+	var startedContainers []string
+	var stoppedContainers []string
+	dockerClient := dockerClient(&startedContainers, &stoppedContainers)
+	dockerClient.RunningContainersResponse = func() ([]container.Container, error) {
+		return []container.Container{
+			container.Container{Name: "consul"},
+			container.Container{Name: "statsite", Image: "plum/wake-statsite:old", Labels: managed("statsite")},
+		}, nil
+	}
+
+	var registeredServices []string
+	var deregisteredServices []string
+	consulClient := consulClient(&registeredServices, &deregisteredServices)
+	consulClient.RegisteredServicesResponse = func() (string, error) {
+		return `{"consul":{"ID":"consul","Service":"consul","Tags":[],"Address":"","Port":0},"statsite":{"ID":"statsite","Service":"statsite","Tags":null,"Address":"","Port":0}}`, nil
+	}
+	consulClient.GetDirectoryStateResponse = func() (*consul.DirectoryState, error) {
+		return &consul.DirectoryState{}, nil
+	}
+
+	bootState := bootState()
+	bootState.Services["statsite"].Image = "plum/wake-statsite:new"
+
+	desired, _ := findContainer(stateContainers(bootState, consulClient), "statsite")
+	failure, _ := json.Marshal(consul.UpgradeFailure{Image: desired.Image, Hash: desired.Hash(), Error: "container exited"})
+	consulClient.ListKeysResponse = func(prefix string) ([]consul.KV, error) {
+		if prefix != consul.FailureKey("", "") {
+			return nil, nil
+		}
+		return []consul.KV{consul.KV{Key: consul.FailureKey("", "statsite"), Value: base64.StdEncoding.EncodeToString(failure)}}, nil
+	}
+
+	var out bytes.Buffer
+	code := runPlan(context.Background(), dockerClient, consulClient, bootState, "text", &out)
+
+	if code != PlanNoChanges {
+		t.Errorf("Expected exit code %d but was %d: %s", PlanNoChanges, code, out.String())
+	}
+
+	bootState.Services["statsite"].Image = "plum/wake-statsite:newer"
+	out.Reset()
+	runPlan(context.Background(), dockerClient, consulClient, bootState, "text", &out)
+
+	if out.String() != "^ upgrade statsite\n" {
+		t.Errorf("Expected a changed spec to be planned again but was %s", out.String())
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"github.com/wakeful-deployment/operator/consul"
+	"github.com/wakeful-deployment/operator/logger"
+	"io/ioutil"
+	"strings"
+	"time"
+)
+
+// versionPath is where the image build writes the sha operator was built from
+var versionPath = "/opt/app/sha"
+
+func operatorVersion() string {
+	b, err := ioutil.ReadFile(versionPath)
+
+	if err != nil {
+		return "unknown"
+	}
+
+	return strings.TrimSpace(string(b))
+}
+
+// nodeStatus is the status document for consul, made from the report the
+// http api serves. Missing and drifted services are still being worked on,
+// so they are pending, and a container which exited with an error failed.
+func nodeStatus(report Report, now time.Time) consul.NodeStatus {
+	status := consul.NodeStatus{
+		State:              report.State,
+		Error:              report.Error,
+		LastTick:           now,
+		LastSuccessfulTick: report.LastSuccessfulTick,
+		Version:            operatorVersion(),
+		Services:           make(map[string]consul.ServiceStatus),
+	}
+
+	for _, s := range report.Services {
+		service := consul.ServiceStatus{Status: consul.ServicePending, Error: s.Error, Container: s.Container}
+
+		switch s.Status {
+		case ServiceRunning:
+			service.Status = consul.ServiceRunning
+		case ServiceFailed, ServiceInvalid, ServiceCrashLooping:
+			service.Status = consul.ServiceFailed
+		case ServiceExited:
+			service.Status = consul.ServiceExited
+
+			if s.Error != "" {
+				service.Status = consul.ServiceFailed
+			}
+		}
+
+		status.Services[s.Name] = service
+	}
+
+	return status
+}
+
+// publishStatus writes the status of the node to consul after a tick
+func publishStatus(ctx context.Context, consulClient consul.Client, nodeName string) {
+	err := consul.PostNodeStatus(ctx, consulClient, nodeName, nodeStatus(currentStatus.Report(), time.Now()))
+
+	if err != nil {
+		logger.Error("writing the node status to consul failed", logger.Fields{"error": err})
+	}
+}
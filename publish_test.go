@@ -0,0 +1,55 @@
+package main
+
+import (
+	"github.com/wakeful-deployment/operator/consul"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestNodeStatus(t *testing.T) {
+	f, err := ioutil.TempFile("", "sha")
+
+	if err != nil {
+		t.Fatal("Couldn't create a tmp file for this test")
+	}
+
+	defer os.Remove(f.Name())
+	f.WriteString("c60758244\n")
+
+	versionPath = f.Name()
+	defer func() { versionPath = "/opt/app/sha" }()
+
+	now := time.Date(2016, 1, 2, 3, 4, 5, 0, time.UTC)
+	report := Report{
+		State:              "NormalizingFailed",
+		Error:              "boom",
+		LastSuccessfulTick: &now,
+		Services: []ServiceStatus{
+			ServiceStatus{Name: "consul", Status: ServiceRunning, Container: "921582f62758"},
+			ServiceStatus{Name: "proxy", Status: ServiceFailed, Error: "boom"},
+			ServiceStatus{Name: "statsite", Status: ServiceDrifted, Container: "405bab56d0c7"},
+			ServiceStatus{Name: "typo", Status: ServiceInvalid, Error: "image: is required"},
+		},
+	}
+
+	expected := consul.NodeStatus{
+		State:              "NormalizingFailed",
+		Error:              "boom",
+		LastTick:           now,
+		LastSuccessfulTick: &now,
+		Version:            "c60758244",
+		Services: map[string]consul.ServiceStatus{
+			"consul":   consul.ServiceStatus{Status: consul.ServiceRunning, Container: "921582f62758"},
+			"proxy":    consul.ServiceStatus{Status: consul.ServiceFailed, Error: "boom"},
+			"statsite": consul.ServiceStatus{Status: consul.ServicePending, Container: "405bab56d0c7"},
+			"typo":     consul.ServiceStatus{Status: consul.ServiceFailed, Error: "image: is required"},
+		},
+	}
+
+	if status := nodeStatus(report, now); !reflect.DeepEqual(status, expected) {
+		t.Errorf("Expected %v but got %v", expected, status)
+	}
+}
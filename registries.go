@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/wakeful-deployment/operator/consul"
+	"github.com/wakeful-deployment/operator/container"
+	"github.com/wakeful-deployment/operator/docker"
+	"github.com/wakeful-deployment/operator/logger"
+	"github.com/wakeful-deployment/operator/service"
+	"sort"
+)
+
+// validateRegistries checks the credentials by registry, ex:
+// "registries.registry:5000.username: is required"
+func validateRegistries(prefix string, registries map[string]container.RegistryAuth) service.ValidationErrors {
+	var errs service.ValidationErrors
+	var names []string
+
+	for name := range registries {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		if registries[name].Username == "" {
+			errs = append(errs, service.ValidationError{Field: fmt.Sprintf("%s.%s.username", prefix, name), Message: "is required"})
+		}
+	}
+
+	return errs
+}
+
+// fetchRegistries are the credentials from operator.json, with the ones
+// stored in consul at RegistriesKey on top, ex:
+// {"registry.example.com": {"username": "deploy", "password": "s3cret"}}.
+// When consul's can't be read, operator.json's are used and pulls from
+// other private registries fail.
+func fetchRegistries(ctx context.Context, consulClient consul.Client, state *State) map[string]container.RegistryAuth {
+	registries := make(map[string]container.RegistryAuth)
+
+	for name, auth := range state.Registries {
+		registries[name] = auth
+	}
+
+	if state.RegistriesKey == "" {
+		return registries
+	}
+
+	value, err := consulClient.GetKey(ctx, state.RegistriesKey)
+
+	if err != nil {
+		logger.Error("fetching registry credentials failed", logger.Fields{"key": state.RegistriesKey, "error": err})
+		return registries
+	}
+
+	var stored map[string]container.RegistryAuth
+	err = decodeStrict([]byte(value), &stored)
+
+	if errs := validateRegistries(state.RegistriesKey, stored); err == nil && len(errs) > 0 {
+		err = errs
+	}
+
+	if err != nil {
+		logger.Error("registry credentials are invalid", logger.Fields{"key": state.RegistriesKey, "error": err})
+		return registries
+	}
+
+	for name, auth := range stored {
+		registries[name] = auth
+	}
+
+	return registries
+}
+
+// registryAuth are the credentials for the registry the image comes from,
+// if there are any
+func (s *State) registryAuth(image string) *container.RegistryAuth {
+	auth, ok := s.Registries[docker.Registry(image)]
+
+	if !ok {
+		return nil
+	}
+
+	return &auth
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/wakeful-deployment/operator/backoff"
+	"github.com/wakeful-deployment/operator/docker"
+	"github.com/wakeful-deployment/operator/logger"
+	"time"
+)
+
+// retryPolicy is how the boot, tick and service retries back off. It is set
+// from the config on start.
+var retryPolicy = backoff.DefaultPolicy
+
+// serviceRetry is a service whose container failed to run. It is left alone
+// until At instead of failing again on every tick.
+type serviceRetry struct {
+	backoff *backoff.Backoff
+	At      time.Time
+	Err     error
+}
+
+var serviceRetries = make(map[string]*serviceRetry)
+
+// waitingServices returns the errors of the services which are not due to be
+// retried yet, by name
+func waitingServices(now time.Time) docker.Errors {
+	waiting := docker.Errors{}
+
+	for name, retry := range serviceRetries {
+		if now.Before(retry.At) {
+			waiting[name] = errors.New(fmt.Sprintf("retrying at %s after: %v", retry.At.Format(time.RFC3339), retry.Err))
+		}
+	}
+
+	return waiting
+}
+
+// recordServiceRetries backs off every service which failed to normalize and
+// forgets the ones which were attempted and succeeded
+func recordServiceRetries(waiting docker.Errors, err error, now time.Time) {
+	failed, _ := err.(docker.Errors)
+
+	for name := range serviceRetries {
+		if _, ok := waiting[name]; !ok && failed[name] == nil {
+			delete(serviceRetries, name)
+		}
+	}
+
+	for name, e := range failed {
+		retry, ok := serviceRetries[name]
+
+		if !ok {
+			retry = &serviceRetry{backoff: backoff.New(retryPolicy)}
+			serviceRetries[name] = retry
+		}
+
+		delay := retry.backoff.Next()
+		retry.At = now.Add(delay)
+		retry.Err = e
+
+		logger.Warn("backing off service", logger.Fields{"service": name, "retry_in": delay, "error": e})
+	}
+}
+
+func keys(errs docker.Errors) []string {
+	var result []string
+
+	for name := range errs {
+		result = append(result, name)
+	}
+
+	return result
+}
@@ -0,0 +1,98 @@
+package service
+
+const (
+	HTTPCheck   = "http"
+	TCPCheck    = "tcp"
+	ScriptCheck = "script"
+	DockerCheck = "docker"
+	TTLCheck    = "ttl"
+)
+
+const (
+	DefaultCheckInterval = "10s"
+	DefaultCheckTimeout  = "5s"
+	DefaultCheckShell    = "/bin/sh"
+)
+
+// Check is a consul health check for a service. Which kind of check it is
+// depends on which fields are set:
+//
+//	http:   {"http": "http://localhost:8000/_health"}
+//	tcp:    {"tcp": "localhost:6379"}
+//	script: {"args": ["/usr/local/bin/check_redis"]} (run by the consul agent)
+//	docker: {"docker": true, "args": ["redis-cli", "ping"]} (run inside the service's container)
+//	ttl:    {"ttl": "30s"} (the service must report in to consul itself)
+type Check struct {
+	ID       string   `json:"id"`
+	Name     string   `json:"name"`
+	Notes    string   `json:"notes"`
+	HTTP     string   `json:"http"`
+	TCP      string   `json:"tcp"`
+	Script   string   `json:"script"`
+	Args     []string `json:"args"`
+	Docker   bool     `json:"docker"`
+	Shell    string   `json:"shell"`
+	TTL      string   `json:"ttl"`
+	Interval string   `json:"interval"`
+	Timeout  string   `json:"timeout"`
+}
+
+func NewHTTPCheck(url string) Check {
+	return Check{HTTP: url}.WithDefaults()
+}
+
+func NewTCPCheck(address string) Check {
+	return Check{TCP: address}.WithDefaults()
+}
+
+func NewScriptCheck(args ...string) Check {
+	return Check{Args: args}.WithDefaults()
+}
+
+func NewDockerCheck(args ...string) Check {
+	return Check{Docker: true, Args: args}.WithDefaults()
+}
+
+func NewTTLCheck(ttl string) Check {
+	return Check{TTL: ttl}.WithDefaults()
+}
+
+// Type returns which kind of check this is, or "" if it can't tell
+func (c Check) Type() string {
+	switch {
+	case c.TTL != "":
+		return TTLCheck
+	case c.HTTP != "":
+		return HTTPCheck
+	case c.TCP != "":
+		return TCPCheck
+	case c.Docker && (c.Script != "" || len(c.Args) > 0):
+		return DockerCheck
+	case c.Script != "" || len(c.Args) > 0:
+		return ScriptCheck
+	default:
+		return ""
+	}
+}
+
+// WithDefaults fills in an interval and timeout for checks consul runs
+// itself, and a shell for docker checks
+func (c Check) WithDefaults() Check {
+	if c.Type() == TTLCheck {
+		return c
+	}
+
+	if c.Interval == "" {
+		c.Interval = DefaultCheckInterval
+	}
+
+	if c.Timeout == "" && (c.Type() == HTTPCheck || c.Type() == TCPCheck) {
+		c.Timeout = DefaultCheckTimeout
+	}
+
+	if c.Shell == "" && c.Type() == DockerCheck {
+		c.Shell = DefaultCheckShell
+	}
+
+	return c
+}
@@ -0,0 +1,176 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"github.com/wakeful-deployment/operator/container"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Resources limit what a service's container may use of the node, so one
+// runaway container can't starve the others, ex:
+//
+//	{
+//	  "cpu_shares": 512,
+//	  "cpu_quota": 50000,
+//	  "memory": "512m",
+//	  "memory_reservation": "256m",
+//	  "pids_limit": 100,
+//	  "ulimits": {"nofile": {"soft": 1024, "hard": 4096}}
+//	}
+//
+// Anything left out is not limited.
+type Resources struct {
+	CPUShares         int64             `json:"cpu_shares"`
+	CPUQuota          int64             `json:"cpu_quota"`
+	Memory            string            `json:"memory"`
+	MemoryReservation string            `json:"memory_reservation"`
+	PidsLimit         int64             `json:"pids_limit"`
+	Ulimits           map[string]Ulimit `json:"ulimits"`
+}
+
+type Ulimit struct {
+	Soft int64 `json:"soft"`
+	Hard int64 `json:"hard"`
+}
+
+// the ulimits docker knows about
+var ulimitNames = map[string]bool{
+	"core":       true,
+	"cpu":        true,
+	"data":       true,
+	"fsize":      true,
+	"locks":      true,
+	"memlock":    true,
+	"msgqueue":   true,
+	"nice":       true,
+	"nofile":     true,
+	"nproc":      true,
+	"rss":        true,
+	"rtprio":     true,
+	"rttime":     true,
+	"sigpending": true,
+	"stack":      true,
+}
+
+var byteUnits = map[string]int64{
+	"":   1,
+	"b":  1,
+	"k":  1 << 10,
+	"m":  1 << 20,
+	"g":  1 << 30,
+	"kb": 1 << 10,
+	"mb": 1 << 20,
+	"gb": 1 << 30,
+}
+
+// parseBytes understands the same sizes as `docker run --memory`, ex: "512m"
+// or "512MB"
+func parseBytes(size string) (int64, error) {
+	if size == "" {
+		return 0, nil
+	}
+
+	lower := strings.ToLower(size)
+	number := strings.TrimRight(lower, "bkmg")
+	unit, ok := byteUnits[lower[len(number):]]
+
+	if !ok {
+		return 0, errors.New(fmt.Sprintf("'%s' must be a size, ex: 512m", size))
+	}
+
+	n, err := strconv.ParseInt(number, 10, 64)
+
+	if err != nil || n < 0 {
+		return 0, errors.New(fmt.Sprintf("'%s' must be a size, ex: 512m", size))
+	}
+
+	return n * unit, nil
+}
+
+// Limits are the resources as docker takes them, with sizes in bytes
+func (r Resources) Limits() container.Resources {
+	memory, _ := parseBytes(r.Memory)
+	reservation, _ := parseBytes(r.MemoryReservation)
+
+	limits := container.Resources{
+		CPUShares:         r.CPUShares,
+		CPUQuota:          r.CPUQuota,
+		Memory:            memory,
+		MemoryReservation: reservation,
+		PidsLimit:         r.PidsLimit,
+	}
+
+	for _, name := range r.sortedUlimits() {
+		limits.Ulimits = append(limits.Ulimits, container.Ulimit{Name: name, Soft: r.Ulimits[name].Soft, Hard: r.Ulimits[name].Hard})
+	}
+
+	return limits
+}
+
+func (r Resources) sortedUlimits() []string {
+	var names []string
+
+	for name := range r.Ulimits {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+func (r Resources) validate() ValidationErrors {
+	var errs ValidationErrors
+
+	add := func(field string, format string, args ...interface{}) {
+		errs = append(errs, ValidationError{Field: field, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if r.CPUShares != 0 && r.CPUShares < 2 {
+		add("cpu_shares", "must be at least 2, got %d", r.CPUShares)
+	}
+
+	if r.CPUQuota != 0 && r.CPUQuota < 1000 {
+		add("cpu_quota", "must be at least 1000 (microseconds per 100ms), got %d", r.CPUQuota)
+	}
+
+	memory, err := parseBytes(r.Memory)
+
+	if err != nil {
+		add("memory", "%v", err)
+	} else if memory != 0 && memory < 4<<20 {
+		add("memory", "'%s' must be at least 4m", r.Memory)
+	}
+
+	reservation, err := parseBytes(r.MemoryReservation)
+
+	if err != nil {
+		add("memory_reservation", "%v", err)
+	} else if memory != 0 && reservation > memory {
+		add("memory_reservation", "'%s' must not be more than memory, '%s'", r.MemoryReservation, r.Memory)
+	}
+
+	if r.PidsLimit < 0 {
+		add("pids_limit", "must be 0 or more, got %d", r.PidsLimit)
+	}
+
+	for _, name := range r.sortedUlimits() {
+		ulimit := r.Ulimits[name]
+		field := fmt.Sprintf("ulimits.%s", name)
+
+		if !ulimitNames[name] {
+			add(field, "is not a ulimit docker knows")
+		}
+
+		if ulimit.Soft < 0 || ulimit.Hard < 0 {
+			add(field, "must be 0 or more")
+		} else if ulimit.Soft > ulimit.Hard {
+			add(field, "soft limit %d must not be more than the hard limit %d", ulimit.Soft, ulimit.Hard)
+		}
+	}
+
+	return errs
+}
@@ -3,6 +3,7 @@ package service
 import (
 	"fmt"
 	"github.com/wakeful-deployment/operator/container"
+	"sort"
 )
 
 func Diff(left []Service, right []Service) []Service {
@@ -33,19 +34,34 @@ type PortPair struct {
 	Incoming int  `json:"incoming"`
 	Outgoing int  `json:"outgoing"`
 	UDP      bool `json:"udp"`
+	Service  bool `json:"service"`
 }
 
-// type Check struct{}
-// func NewHTTPHealthCheck(...) HealthCheck { ... return with sane defaults }
-
 type Service struct {
-	Name    string            `json:"name"`
-	Image   string            `json:"image"`
-	Ports   []PortPair        `json:"ports"`
-	Env     map[string]string `json:"env"`
-	Restart string            `json:"restart"`
-	Tags    []string          `json:"tags"`
-	// Checks  []Check           `json:"checks"`
+	Name            string                       `json:"name"`
+	Image           string                       `json:"image"`
+	Ports           []PortPair                   `json:"ports"`
+	Env             map[string]string            `json:"env"`
+	Restart         string                       `json:"restart"`
+	Tags            []string                     `json:"tags"`
+	Checks          []Check                      `json:"checks"`
+	Volumes         []Volume                     `json:"volumes"`
+	Resources       Resources                    `json:"resources"`
+	Command         []string                     `json:"command"`
+	Entrypoint      []string                     `json:"entrypoint"`
+	Workdir         string                       `json:"workdir"`
+	User            string                       `json:"user"`
+	Hostname        string                       `json:"hostname"`
+	NetworkMode     string                       `json:"network_mode"`
+	Networks        map[string]NetworkAttachment `json:"networks"`
+	ImagePullPolicy string                       `json:"image_pull_policy"`
+}
+
+// NetworkAttachment is how a service joins a network declared in
+// operator.json, ex: {"aliases": ["db"]}. Other containers on the network
+// can reach it by its name and its aliases.
+type NetworkAttachment struct {
+	Aliases []string `json:"aliases"`
 }
 
 func (s Service) SimplePorts() []string {
@@ -64,6 +80,22 @@ func (s Service) SimplePorts() []string {
 	return ports
 }
 
+// Port is the host port the service is registered with in consul: the port
+// marked with "service": true, or else the first port
+func (s Service) Port() int {
+	for _, pair := range s.Ports {
+		if pair.Service {
+			return pair.Incoming
+		}
+	}
+
+	if len(s.Ports) > 0 {
+		return s.Ports[0].Incoming
+	}
+
+	return 0
+}
+
 func (s Service) FullEnv(nodeName string, consulHost string) map[string]string {
 	env := make(map[string]string)
 
@@ -78,13 +110,62 @@ func (s Service) FullEnv(nodeName string, consulHost string) map[string]string {
 	return env
 }
 
+func (s Service) Mounts() []container.Mount {
+	var mounts []container.Mount
+
+	for _, v := range s.Volumes {
+		mounts = append(mounts, container.Mount{
+			Type:      v.MountType(),
+			Source:    v.Source,
+			Target:    v.Target,
+			ReadOnly:  v.ReadOnly,
+			Ephemeral: v.Ephemeral,
+		})
+	}
+
+	return mounts
+}
+
+// NetworkNames are the networks the service joins, sorted
+func (s Service) NetworkNames() []string {
+	var names []string
+
+	for name := range s.Networks {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+func (s Service) ContainerNetworks() []container.Network {
+	var networks []container.Network
+
+	for _, name := range s.NetworkNames() {
+		networks = append(networks, container.Network{Name: name, Aliases: s.Networks[name].Aliases})
+	}
+
+	return networks
+}
+
 func (s Service) Container(nodeName string, consulHost string) container.Container {
 	return container.Container{
-		Name:    s.Name,
-		Image:   s.Image,
-		Ports:   s.SimplePorts(),
-		Env:     s.FullEnv(nodeName, consulHost),
-		Restart: s.Restart,
-		Tags:    s.Tags,
+		Name:        s.Name,
+		Image:       s.Image,
+		Ports:       s.SimplePorts(),
+		Env:         s.FullEnv(nodeName, consulHost),
+		Restart:     s.Restart,
+		Tags:        s.Tags,
+		Mounts:      s.Mounts(),
+		Resources:   s.Resources.Limits(),
+		Command:     s.Command,
+		Entrypoint:  s.Entrypoint,
+		Workdir:     s.Workdir,
+		User:        s.User,
+		Hostname:    s.Hostname,
+		NetworkMode: s.NetworkMode,
+		Networks:    s.ContainerNetworks(),
+		PullPolicy:  s.ImagePullPolicy,
 	}
 }
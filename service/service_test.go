@@ -32,6 +32,29 @@ func TestSimplePorts(t *testing.T) {
 	}
 }
 
+func TestPort(t *testing.T) {
+	s := Service{
+		Ports: []PortPair{
+			PortPair{Incoming: 8000, Outgoing: 9000},
+			PortPair{Incoming: 8300, Outgoing: 9300},
+		},
+	}
+
+	if s.Port() != 8000 {
+		t.Errorf("expected the first port 8000, but got %d", s.Port())
+	}
+
+	s.Ports[1].Service = true
+
+	if s.Port() != 8300 {
+		t.Errorf("expected the marked port 8300, but got %d", s.Port())
+	}
+
+	if (Service{}).Port() != 0 {
+		t.Errorf("expected no port, but got %d", (Service{}).Port())
+	}
+}
+
 func TestFullEnv(t *testing.T) {
 	s := Service{
 		Env: map[string]string{
@@ -191,3 +214,96 @@ func TestDiff(t *testing.T) {
 		t.Errorf("expected added to be %v, but was %v", expectedAdded, added)
 	}
 }
+
+func TestCheckType(t *testing.T) {
+	checks := map[string]Check{
+		HTTPCheck:   Check{HTTP: "http://localhost:8000/_health"},
+		TCPCheck:    Check{TCP: "localhost:6379"},
+		ScriptCheck: Check{Args: []string{"/usr/local/bin/check_redis"}},
+		DockerCheck: Check{Docker: true, Script: "redis-cli ping"},
+		TTLCheck:    Check{TTL: "30s"},
+		"":          Check{Docker: true},
+	}
+
+	for expected, check := range checks {
+		if check.Type() != expected {
+			t.Errorf("expected %v to be a %s check, but was %s", check, expected, check.Type())
+		}
+	}
+}
+
+func TestCheckWithDefaults(t *testing.T) {
+	c := NewHTTPCheck("http://localhost:8000/_health")
+
+	if c.Interval != DefaultCheckInterval {
+		t.Errorf("expected interval to be %s, but was %s", DefaultCheckInterval, c.Interval)
+	}
+
+	if c.Timeout != DefaultCheckTimeout {
+		t.Errorf("expected timeout to be %s, but was %s", DefaultCheckTimeout, c.Timeout)
+	}
+
+	ttl := NewTTLCheck("30s")
+
+	if ttl.Interval != "" {
+		t.Errorf("expected a ttl check to have no interval, but was %s", ttl.Interval)
+	}
+
+	docker := NewDockerCheck("redis-cli", "ping")
+
+	if docker.Shell != DefaultCheckShell {
+		t.Errorf("expected shell to be %s, but was %s", DefaultCheckShell, docker.Shell)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	r := Resources{
+		Memory:            "512m",
+		MemoryReservation: "1048576",
+		Ulimits: map[string]Ulimit{
+			"nproc":  Ulimit{Soft: 64, Hard: 128},
+			"nofile": Ulimit{Soft: 1024, Hard: 4096},
+		},
+	}
+
+	limits := r.Limits()
+
+	if limits.Memory != 512*1024*1024 || limits.MemoryReservation != 1024*1024 {
+		t.Errorf("expected memory to be 512m and the reservation 1m in bytes, but got %d and %d", limits.Memory, limits.MemoryReservation)
+	}
+
+	if len(limits.Ulimits) != 2 || limits.Ulimits[0].Name != "nofile" {
+		t.Errorf("expected ulimits sorted by name, but got %v", limits.Ulimits)
+	}
+
+	if _, err := parseBytes("12 gigs"); err == nil {
+		t.Error("expected an invalid size to error, but got none")
+	}
+}
+
+func TestParseBytesSuffixes(t *testing.T) {
+	sizes := map[string]int64{
+		"100":   100,
+		"100b":  100,
+		"2k":    2 << 10,
+		"2KB":   2 << 10,
+		"512m":  512 << 20,
+		"512mb": 512 << 20,
+		"1G":    1 << 30,
+		"1gb":   1 << 30,
+	}
+
+	for size, expected := range sizes {
+		n, err := parseBytes(size)
+
+		if err != nil || n != expected {
+			t.Errorf("expected %s to be %d bytes, but got %d (%v)", size, expected, n, err)
+		}
+	}
+
+	for _, size := range []string{"1bb", "1mm", "1bm", "mb"} {
+		if _, err := parseBytes(size); err == nil {
+			t.Errorf("expected %s to error, but got none", size)
+		}
+	}
+}
@@ -0,0 +1,275 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"github.com/wakeful-deployment/operator/container"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ValidationError is one problem with one field of a service definition,
+// ex: {Field: "ports[1].incoming", Message: "must be between 1 and 65535, got 0"}
+type ValidationError struct {
+	Field   string
+	Message string
+}
+
+func (e ValidationError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Field, e.Message)
+}
+
+// ValidationErrors are all the problems with a service definition
+type ValidationErrors []ValidationError
+
+func (e ValidationErrors) Error() string {
+	var messages []string
+
+	for _, err := range e {
+		messages = append(messages, err.Error())
+	}
+
+	return strings.Join(messages, "; ")
+}
+
+// docker's rule for container names
+var namePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// a single dns label, which is what docker allows as a hostname
+var hostnamePattern = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?$`)
+
+var pullPolicies = map[string]bool{
+	"":                         true,
+	container.PullAlways:       true,
+	container.PullIfNotPresent: true,
+	container.PullNever:        true,
+}
+
+var networkModes = map[string]bool{
+	"":       true,
+	"bridge": true,
+	"host":   true,
+	"none":   true,
+}
+
+var restartPolicies = map[string]bool{
+	"no":             true,
+	"always":         true,
+	"unless-stopped": true,
+	"on-failure":     true,
+}
+
+// Validate checks everything docker and consul would otherwise reject much
+// later, and returns ValidationErrors describing every problem found
+func (s Service) Validate() error {
+	var errs ValidationErrors
+
+	add := func(field string, format string, args ...interface{}) {
+		errs = append(errs, ValidationError{Field: field, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if !namePattern.MatchString(s.Name) {
+		add("name", "'%s' must start with a letter or digit and only contain letters, digits, '_', '.' and '-'", s.Name)
+	}
+
+	if strings.TrimSpace(s.Image) == "" {
+		add("image", "is required")
+	} else if strings.ContainsAny(s.Image, " \t\n") {
+		add("image", "'%s' must not contain whitespace", s.Image)
+	}
+
+	services := 0
+	seen := make(map[string]int)
+
+	for i, pair := range s.Ports {
+		field := fmt.Sprintf("ports[%d]", i)
+
+		if pair.Incoming < 1 || pair.Incoming > 65535 {
+			add(field+".incoming", "must be between 1 and 65535, got %d", pair.Incoming)
+		}
+
+		if pair.Outgoing < 1 || pair.Outgoing > 65535 {
+			add(field+".outgoing", "must be between 1 and 65535, got %d", pair.Outgoing)
+		}
+
+		key := pair.HostPort()
+
+		if j, ok := seen[key]; ok {
+			add(field+".incoming", "%s is already used by ports[%d]", key, j)
+		} else {
+			seen[key] = i
+		}
+
+		if pair.Service {
+			services++
+		}
+	}
+
+	if services > 1 {
+		add("ports", "only one port can be marked as the service port")
+	}
+
+	if !pullPolicies[s.ImagePullPolicy] {
+		add("image_pull_policy", "'%s' must be one of always, if-not-present or never", s.ImagePullPolicy)
+	}
+
+	if err := validateRestart(s.Restart); err != nil {
+		add("restart", "%v", err)
+	}
+
+	for key := range s.Env {
+		if key == "" || strings.ContainsAny(key, "= \t\n") {
+			add("env", "'%s' is not a valid variable name", key)
+		}
+	}
+
+	for i, c := range s.Checks {
+		for _, err := range c.validate() {
+			add(fmt.Sprintf("checks[%d].%s", i, err.Field), "%s", err.Message)
+		}
+	}
+
+	targets := make(map[string]int)
+
+	for i, v := range s.Volumes {
+		for _, err := range v.validate() {
+			add(fmt.Sprintf("volumes[%d].%s", i, err.Field), "%s", err.Message)
+		}
+
+		if j, ok := targets[v.Target]; ok {
+			add(fmt.Sprintf("volumes[%d].target", i), "%s is already used by volumes[%d]", v.Target, j)
+		} else {
+			targets[v.Target] = i
+		}
+	}
+
+	if len(s.Entrypoint) > 0 && s.Entrypoint[0] == "" {
+		add("entrypoint", "must start with the program to run")
+	}
+
+	if s.Workdir != "" && !strings.HasPrefix(s.Workdir, "/") {
+		add("workdir", "'%s' must be an absolute path", s.Workdir)
+	}
+
+	if strings.ContainsAny(s.User, " \t\n") {
+		add("user", "'%s' must not contain whitespace", s.User)
+	}
+
+	if s.Hostname != "" && !hostnamePattern.MatchString(s.Hostname) {
+		add("hostname", "'%s' must only contain letters, digits and '-', and be at most 63 characters", s.Hostname)
+	}
+
+	if !networkModes[s.NetworkMode] {
+		add("network_mode", "'%s' must be one of bridge, host or none", s.NetworkMode)
+	} else if s.NetworkMode == "host" || s.NetworkMode == "none" {
+		if len(s.Networks) > 0 {
+			add("networks", "can't be joined with network_mode %s", s.NetworkMode)
+		}
+
+		if s.Hostname != "" {
+			add("hostname", "can't be set with network_mode %s", s.NetworkMode)
+		}
+	}
+
+	if s.NetworkMode == "host" {
+		for i, pair := range s.Ports {
+			if pair.Incoming != pair.Outgoing {
+				add(fmt.Sprintf("ports[%d].outgoing", i), "must be the same as incoming with network_mode host, got %d", pair.Outgoing)
+			}
+		}
+	}
+
+	for _, name := range s.NetworkNames() {
+		for _, alias := range s.Networks[name].Aliases {
+			if !hostnamePattern.MatchString(alias) {
+				add(fmt.Sprintf("networks.%s.aliases", name), "'%s' must only contain letters, digits and '-', and be at most 63 characters", alias)
+			}
+		}
+	}
+
+	for _, err := range s.Resources.validate() {
+		add(fmt.Sprintf("resources.%s", err.Field), "%s", err.Message)
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+
+	return nil
+}
+
+// HostPort is the port on the host, ex: "8125/udp", which can only be used
+// once on a node
+func (p PortPair) HostPort() string {
+	if p.UDP {
+		return fmt.Sprintf("%d/udp", p.Incoming)
+	}
+
+	return fmt.Sprintf("%d/tcp", p.Incoming)
+}
+
+func validateRestart(restart string) error {
+	if restart == "" {
+		return nil
+	}
+
+	parts := strings.SplitN(restart, ":", 2)
+
+	if !restartPolicies[parts[0]] {
+		return errors.New(fmt.Sprintf("'%s' must be one of no, always, unless-stopped, on-failure or on-failure:N", restart))
+	}
+
+	if len(parts) == 2 {
+		if parts[0] != "on-failure" {
+			return errors.New(fmt.Sprintf("'%s' can only have a retry count with on-failure", restart))
+		}
+
+		if n, err := strconv.Atoi(parts[1]); err != nil || n < 0 {
+			return errors.New(fmt.Sprintf("'%s' must have a retry count of 0 or more", restart))
+		}
+	}
+
+	return nil
+}
+
+func (c Check) validate() ValidationErrors {
+	var errs ValidationErrors
+
+	add := func(field string, format string, args ...interface{}) {
+		errs = append(errs, ValidationError{Field: field, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if c.Type() == "" {
+		add("type", "could not be determined, set one of http, tcp, args or ttl")
+	}
+
+	if c.HTTP != "" {
+		if u, err := url.Parse(c.HTTP); err != nil || u.Scheme == "" || u.Host == "" {
+			add("http", "'%s' must be a full url", c.HTTP)
+		}
+	}
+
+	durations := []struct {
+		field string
+		value string
+	}{
+		{"ttl", c.TTL},
+		{"interval", c.Interval},
+		{"timeout", c.Timeout},
+	}
+
+	for _, d := range durations {
+		if d.value == "" {
+			continue
+		}
+
+		if _, err := time.ParseDuration(d.value); err != nil {
+			add(d.field, "'%s' must be a duration, ex: 10s", d.value)
+		}
+	}
+
+	return errs
+}
@@ -0,0 +1,167 @@
+package service
+
+import (
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	s := Service{Name: "proxy", Image: "wakeful/wake-proxy:latest", Restart: "on-failure:3", Checks: []Check{NewHTTPCheck("http://localhost:8000/_health")}}
+
+	if err := s.Validate(); err != nil {
+		t.Errorf("Expected the service to be valid but got %v", err)
+	}
+}
+
+func TestValidateErrors(t *testing.T) {
+	s := Service{
+		Name:  "proxy",
+		Image: "",
+		Ports: []PortPair{
+			PortPair{Incoming: 8000, Outgoing: 8000, Service: true},
+			PortPair{Incoming: 8000, Outgoing: 0, Service: true},
+		},
+		Env:     map[string]string{"A=B": "c"},
+		Restart: "sometimes",
+		Checks:  []Check{Check{Interval: "often"}},
+	}
+
+	err := s.Validate()
+	errs, ok := err.(ValidationErrors)
+
+	if !ok {
+		t.Fatalf("Expected ValidationErrors but got %v", err)
+	}
+
+	expected := []string{
+		"image: is required",
+		"ports[1].outgoing: must be between 1 and 65535, got 0",
+		"ports[1].incoming: 8000/tcp is already used by ports[0]",
+		"ports: only one port can be marked as the service port",
+		"restart: 'sometimes' must be one of no, always, unless-stopped, on-failure or on-failure:N",
+		"env: 'A=B' is not a valid variable name",
+		"checks[0].type: could not be determined, set one of http, tcp, args or ttl",
+		"checks[0].interval: 'often' must be a duration, ex: 10s",
+	}
+
+	if len(errs) != len(expected) {
+		t.Fatalf("Expected %d errors but got %d: %v", len(expected), len(errs), errs)
+	}
+
+	for i, e := range expected {
+		if errs[i].Error() != e {
+			t.Errorf("Expected error %d to be '%s' but was '%s'", i, e, errs[i].Error())
+		}
+	}
+}
+
+func TestValidateSamePortDifferentProtocols(t *testing.T) {
+	s := Service{
+		Name:  "consul",
+		Image: "wakeful/wake-consul-server:latest",
+		Ports: []PortPair{
+			PortPair{Incoming: 8301, Outgoing: 8301},
+			PortPair{Incoming: 8301, Outgoing: 8301, UDP: true},
+		},
+	}
+
+	if err := s.Validate(); err != nil {
+		t.Errorf("Expected tcp and udp on the same port to be valid but got %v", err)
+	}
+}
+
+func TestValidateVolumes(t *testing.T) {
+	s := Service{
+		Name:  "consul",
+		Image: "wakeful/wake-consul-server:latest",
+		Volumes: []Volume{
+			Volume{Source: "consul-data", Target: "/data"},
+			Volume{Source: "/etc/ssl/certs", Target: "/etc/ssl/certs", ReadOnly: true},
+			Volume{Target: "/tmp"},
+		},
+	}
+
+	if err := s.Validate(); err != nil {
+		t.Fatalf("Expected volumes to be valid but got %v", err)
+	}
+
+	s.Volumes = []Volume{
+		Volume{Source: "consul-data", Target: "data"},
+		Volume{Source: "/etc/ssl/certs", Target: "/data", Ephemeral: true},
+		Volume{Type: "nfs", Source: "share", Target: "/share"},
+	}
+
+	expected := "volumes[0].target: 'data' must be an absolute path; " +
+		"volumes[1].ephemeral: is only allowed for named volumes; " +
+		"volumes[2].type: 'nfs' must be one of volume, bind or tmpfs"
+
+	if err := s.Validate(); err == nil || err.Error() != expected {
+		t.Errorf("Expected %s but got %v", expected, err)
+	}
+}
+
+func TestValidateResources(t *testing.T) {
+	s := Service{
+		Name:  "consul",
+		Image: "wakeful/wake-consul-server:latest",
+		Resources: Resources{
+			CPUShares:         512,
+			Memory:            "512m",
+			MemoryReservation: "1g",
+			PidsLimit:         -1,
+			Ulimits: map[string]Ulimit{
+				"nofile": Ulimit{Soft: 4096, Hard: 1024},
+				"files":  Ulimit{Soft: 1, Hard: 1},
+			},
+		},
+	}
+
+	expected := "resources.memory_reservation: '1g' must not be more than memory, '512m'; " +
+		"resources.pids_limit: must be 0 or more, got -1; " +
+		"resources.ulimits.files: is not a ulimit docker knows; " +
+		"resources.ulimits.nofile: soft limit 4096 must not be more than the hard limit 1024"
+
+	if err := s.Validate(); err == nil || err.Error() != expected {
+		t.Errorf("Expected %s but got %v", expected, err)
+	}
+}
+
+func TestValidateProcess(t *testing.T) {
+	s := Service{
+		Name:       "worker",
+		Image:      "wakeful/app:abc123",
+		Command:    []string{"bundle", "exec", "sidekiq"},
+		Entrypoint: []string{""},
+		Workdir:    "opt/app",
+		User:       "app user",
+		Hostname:   "worker_1",
+	}
+
+	expected := "entrypoint: must start with the program to run; " +
+		"workdir: 'opt/app' must be an absolute path; " +
+		"user: 'app user' must not contain whitespace; " +
+		"hostname: 'worker_1' must only contain letters, digits and '-', and be at most 63 characters"
+
+	if err := s.Validate(); err == nil || err.Error() != expected {
+		t.Errorf("Expected %s but got %v", expected, err)
+	}
+}
+
+func TestValidateNetworkMode(t *testing.T) {
+	s := Service{
+		Name:        "statsite",
+		Image:       "wakeful/wake-statsite:latest",
+		Ports:       []PortPair{PortPair{Incoming: 8125, Outgoing: 8126, UDP: true}},
+		Hostname:    "statsite",
+		NetworkMode: "host",
+		Networks:    map[string]NetworkAttachment{"backend": NetworkAttachment{Aliases: []string{"stats_d"}}},
+	}
+
+	expected := "networks: can't be joined with network_mode host; " +
+		"hostname: can't be set with network_mode host; " +
+		"ports[0].outgoing: must be the same as incoming with network_mode host, got 8126; " +
+		"networks.backend.aliases: 'stats_d' must only contain letters, digits and '-', and be at most 63 characters"
+
+	if err := s.Validate(); err == nil || err.Error() != expected {
+		t.Errorf("Expected %s but got %v", expected, err)
+	}
+}
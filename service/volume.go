@@ -0,0 +1,74 @@
+package service
+
+import (
+	"fmt"
+	"github.com/wakeful-deployment/operator/container"
+	"strings"
+)
+
+// Volume is storage for a service's container. Which kind it is depends on
+// "type", or else on the source:
+//
+//	named volume: {"source": "consul-data", "target": "/data"}
+//	bind mount:   {"source": "/etc/ssl/certs", "target": "/etc/ssl/certs", "read_only": true}
+//	tmpfs:        {"target": "/tmp"}
+//
+// Named volumes outlive the container unless they are ephemeral, in which
+// case they are removed along with the service.
+type Volume struct {
+	Type      string `json:"type"`
+	Source    string `json:"source"`
+	Target    string `json:"target"`
+	ReadOnly  bool   `json:"read_only"`
+	Ephemeral bool   `json:"ephemeral"`
+}
+
+// MountType is the type of the volume, worked out from its source when not
+// given
+func (v Volume) MountType() string {
+	switch {
+	case v.Type != "":
+		return v.Type
+	case v.Source == "":
+		return container.TmpfsMount
+	case strings.HasPrefix(v.Source, "/"):
+		return container.BindMount
+	default:
+		return container.NamedVolume
+	}
+}
+
+func (v Volume) validate() ValidationErrors {
+	var errs ValidationErrors
+
+	add := func(field string, format string, args ...interface{}) {
+		errs = append(errs, ValidationError{Field: field, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if !strings.HasPrefix(v.Target, "/") {
+		add("target", "'%s' must be an absolute path", v.Target)
+	}
+
+	switch v.MountType() {
+	case container.NamedVolume:
+		if !namePattern.MatchString(v.Source) {
+			add("source", "'%s' must start with a letter or digit and only contain letters, digits, '_', '.' and '-'", v.Source)
+		}
+	case container.BindMount:
+		if !strings.HasPrefix(v.Source, "/") {
+			add("source", "'%s' must be an absolute path", v.Source)
+		}
+	case container.TmpfsMount:
+		if v.Source != "" {
+			add("source", "must be empty for tmpfs")
+		}
+	default:
+		add("type", "'%s' must be one of volume, bind or tmpfs", v.Type)
+	}
+
+	if v.Ephemeral && v.MountType() != container.NamedVolume {
+		add("ephemeral", "is only allowed for named volumes")
+	}
+
+	return errs
+}
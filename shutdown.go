@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/wakeful-deployment/operator/consul"
+	"github.com/wakeful-deployment/operator/docker"
+	"github.com/wakeful-deployment/operator/logger"
+	"github.com/wakeful-deployment/operator/service"
+	"sort"
+)
+
+// Shutdown cleans up after the operator according to the config: it can
+// deregister the node's services from consul and stop the containers it
+// manages. Services are deregistered first so nothing is routed to
+// containers which are about to stop.
+func Shutdown(ctx context.Context, dockerClient docker.Client, consulClient consul.Client, state *State) error {
+	var errs []error
+
+	if state.DeregisterOnShutdown {
+		errs = append(errs, deregisterServices(ctx, consulClient, state)...)
+	}
+
+	if state.StopOnShutdown {
+		errs = append(errs, stopManagedContainers(ctx, dockerClient)...)
+	}
+
+	if len(errs) > 0 {
+		return errors.New(fmt.Sprintf("ERROR: At least 1 error shutting down: %v", errs))
+	}
+
+	return nil
+}
+
+// deregisterServices deregisters the services of the last desired state, so
+// services registered by someone else on the same agent are left alone
+func deregisterServices(ctx context.Context, consulClient consul.Client, state *State) []error {
+	var errs []error
+
+	registered, err := consul.RegisteredServices(ctx, consulClient)
+
+	if err != nil {
+		logger.Error("listing services to deregister failed", logger.Fields{"error": err})
+		return []error{err}
+	}
+
+	desired := currentStatus.Report().DesiredState
+
+	if desired == nil {
+		desired = state
+	}
+
+	var names []string
+
+	for name := range desired.Services {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		if !isRegistered(registered, name) {
+			continue
+		}
+
+		logger.Info("deregistering service on shutdown", logger.Fields{"service": name})
+		err := consul.Deregister(ctx, consulClient, service.Service{Name: name})
+
+		if err != nil {
+			logger.Error("deregistering service on shutdown failed", logger.Fields{"service": name, "error": err})
+			errs = append(errs, err)
+		}
+	}
+
+	return errs
+}
+
+func isRegistered(registered []consul.ServiceRepresentation, id string) bool {
+	for _, rep := range registered {
+		if rep.ID == id {
+			return true
+		}
+	}
+
+	return false
+}
+
+func stopManagedContainers(ctx context.Context, dockerClient docker.Client) []error {
+	var errs []error
+
+	containers, err := docker.RunningContainers(ctx, dockerClient)
+
+	if err != nil {
+		logger.Error("listing containers to stop failed", logger.Fields{"error": err})
+		return []error{err}
+	}
+
+	for _, c := range containers {
+		if !docker.Managed(c) {
+			continue
+		}
+
+		logger.Info("stopping container on shutdown", logger.Fields{"container": c.Name})
+		err := docker.Stop(ctx, dockerClient, c)
+
+		if err != nil {
+			logger.Error("stopping container on shutdown failed", logger.Fields{"container": c.Name, "error": err})
+			errs = append(errs, err)
+		}
+	}
+
+	return errs
+}
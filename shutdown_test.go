@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"github.com/wakeful-deployment/operator/consul"
+	"github.com/wakeful-deployment/operator/container"
+	"testing"
+)
+
+func TestShutdownDoesNothingByDefault(t *testing.T) {
+	var startedContainers []string
+	var stoppedContainers []string
+	dockerClient := dockerClient(&startedContainers, &stoppedContainers)
+
+	var registeredServices []string
+	var deregisteredServices []string
+	consulClient := consulClient(&registeredServices, &deregisteredServices)
+
+	err := Shutdown(context.Background(), dockerClient, consulClient, bootState())
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	if len(stoppedContainers) != 0 || len(deregisteredServices) != 0 {
+		t.Errorf("Expected nothing to be stopped or deregistered but stopped %v and deregistered %v", stoppedContainers, deregisteredServices)
+	}
+}
+
+func TestShutdownDeregistersAndStops(t *testing.T) {
+	currentStatus = &status{}
+	defer func() { currentStatus = &status{} }()
+
+	var startedContainers []string
+	var stoppedContainers []string
+	dockerClient := dockerClient(&startedContainers, &stoppedContainers)
+	dockerClient.RunningContainersResponse = func() ([]container.Container, error) {
+		return []container.Container{
+			container.Container{Name: "statsite", Image: "plum/wake-statsite:latest", Labels: managed("statsite")},
+			container.Container{Name: "debugging", Image: "ubuntu:latest"},
+		}, nil
+	}
+
+	var registeredServices []string
+	var deregisteredServices []string
+	consulClient := consulClient(&registeredServices, &deregisteredServices)
+	consulClient.RegisteredServicesResponse = func() (string, error) {
+		return `{"statsite":{"ID":"statsite","Service":"statsite","Tags":null,"Address":"","Port":0},"web":{"ID":"web","Service":"web","Tags":null,"Address":"","Port":80}}`, nil
+	}
+
+	state := bootState()
+	state.DeregisterOnShutdown = true
+	state.StopOnShutdown = true
+
+	err := Shutdown(context.Background(), dockerClient, consulClient, state)
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	if len(deregisteredServices) != 1 || deregisteredServices[0] != "statsite" {
+		t.Errorf("Expected only statsite to be deregistered but deregistered %v", deregisteredServices)
+	}
+
+	if len(stoppedContainers) != 1 || stoppedContainers[0] != "statsite" {
+		t.Errorf("Expected only statsite to be stopped but stopped %v", stoppedContainers)
+	}
+}
+
+func TestLoopStopsWhenCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	var startedContainers []string
+	var stoppedContainers []string
+	dockerClient := dockerClient(&startedContainers, &stoppedContainers)
+
+	var registeredServices []string
+	var deregisteredServices []string
+	consulClient := consulClient(&registeredServices, &deregisteredServices)
+	consulClient.GetDirectoryStateResponse = func() (*consul.DirectoryState, error) {
+		return nil, ctx.Err()
+	}
+
+	Loop(ctx, dockerClient, consulClient, bootState())
+
+	if len(startedContainers) != 0 {
+		t.Errorf("Expected no tick to run but started %v", startedContainers)
+	}
+}
@@ -3,18 +3,97 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/wakeful-deployment/operator/backoff"
 	"github.com/wakeful-deployment/operator/consul"
+	"github.com/wakeful-deployment/operator/container"
+	"github.com/wakeful-deployment/operator/docker"
 	"github.com/wakeful-deployment/operator/service"
 	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
 )
 
 type State struct {
-	Metadata   map[string]string           `json:"metadata"`
-	Services   map[string]*service.Service `json:"services"`
-	NodeName   string                      `json:"node"`
-	ConsulHost string                      `json:"consul"`
-	ShouldLoop bool                        `json:"loop"`
-	Wait       string                      `json:"wait"`
+	Metadata             map[string]string                 `json:"metadata"`
+	Services             map[string]*service.Service       `json:"services"`
+	Networks             map[string]*docker.Network        `json:"networks"`
+	Registries           map[string]container.RegistryAuth `json:"registries"`
+	RegistriesKey        string                            `json:"registries_key"`
+	NodeName             string                            `json:"node"`
+	ConsulHost           string                            `json:"consul"`
+	Address              string                            `json:"address"`
+	DockerHost           string                            `json:"docker"`
+	ShouldLoop           bool                              `json:"loop"`
+	Wait                 string                            `json:"wait"`
+	UpgradeTimeout       string                            `json:"upgrade_timeout"`
+	Resync               string                            `json:"resync"`
+	PullInterval         string                            `json:"pull_interval"`
+	LogLevel             string                            `json:"log_level"`
+	LogFormat            string                            `json:"log_format"`
+	DeregisterOnShutdown bool                              `json:"deregister_on_shutdown"`
+	StopOnShutdown       bool                              `json:"stop_on_shutdown"`
+	Timeouts             Timeouts                          `json:"timeouts"`
+	Backoff              Backoff                           `json:"backoff"`
+	Invalid              map[string]string                 `json:"invalid,omitempty"`
+}
+
+// Timeouts are how long each call to docker or consul may take, ex: "30s".
+// The clients' defaults are used for any left empty.
+type Timeouts struct {
+	Docker     string `json:"docker"`
+	DockerPull string `json:"docker_pull"`
+	Consul     string `json:"consul"`
+}
+
+// Backoff is how retries are spaced out, ex: {"initial": "1s", "max": "1m",
+// "multiplier": 2, "jitter": 0.2}. backoff.DefaultPolicy fills in anything
+// left out.
+type Backoff struct {
+	Initial    string   `json:"initial"`
+	Max        string   `json:"max"`
+	Multiplier float64  `json:"multiplier"`
+	Jitter     *float64 `json:"jitter"`
+}
+
+func (b Backoff) Policy() (backoff.Policy, error) {
+	policy := backoff.DefaultPolicy
+
+	if b.Initial != "" {
+		initial, err := time.ParseDuration(b.Initial)
+
+		if err != nil {
+			return policy, err
+		}
+
+		policy.Initial = initial
+	}
+
+	if b.Max != "" {
+		max, err := time.ParseDuration(b.Max)
+
+		if err != nil {
+			return policy, err
+		}
+
+		policy.Max = max
+	}
+
+	if b.Multiplier != 0 {
+		policy.Multiplier = b.Multiplier
+	}
+
+	if b.Jitter != nil {
+		policy.Jitter = *b.Jitter
+	}
+
+	if policy.Initial <= 0 || policy.Max < policy.Initial || policy.Multiplier < 1 || policy.Jitter < 0 || policy.Jitter > 1 {
+		return policy, errors.New(fmt.Sprintf("invalid backoff: initial %v, max %v, multiplier %v, jitter %v", policy.Initial, policy.Max, policy.Multiplier, policy.Jitter))
+	}
+
+	return policy, nil
 }
 
 func ReadStateFromConfigFile(path string) (*State, error) {
@@ -25,20 +104,154 @@ func ReadStateFromConfigFile(path string) (*State, error) {
 	}
 
 	state := &State{}
-	jsonErr := json.NewDecoder(bytes.NewReader(contents)).Decode(state)
+	err = decodeStrict(contents, state)
 
-	if jsonErr != nil {
-		return nil, jsonErr
+	if err != nil {
+		return nil, err
 	}
 
 	for name, s := range state.Services {
 		s.Name = name
 	}
 
+	for name, n := range state.Networks {
+		if n != nil {
+			n.Name = name
+		}
+	}
+
+	err = state.Validate()
+
+	if err != nil {
+		return nil, err
+	}
+
 	return state, nil
 }
 
-func MergeStates(bootState *State, directoryState *consul.DirectoryState) (*State, error) {
+// decodeStrict decodes json, rejecting any fields which are not part of v
+func decodeStrict(b []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.DisallowUnknownFields()
+
+	return decoder.Decode(v)
+}
+
+// Validate checks every service, and that no two services want the same
+// host port. The fields of the errors are prefixed with the service, ex:
+// "services.proxy.ports[0].incoming".
+func (s *State) Validate() error {
+	var errs service.ValidationErrors
+
+	for _, name := range serviceNames(s.Services) {
+		if s.Services[name] == nil {
+			errs = append(errs, service.ValidationError{Field: "services." + name, Message: "must not be null"})
+			continue
+		}
+
+		if err := s.Services[name].Validate(); err != nil {
+			errs = append(errs, prefixed("services."+name+".", err)...)
+		}
+	}
+
+	errs = append(errs, s.validateNetworks()...)
+	errs = append(errs, validateRegistries("registries", s.Registries)...)
+
+	owners := make(map[string]string)
+
+	for _, name := range serviceNames(s.Services) {
+		if s.Services[name] == nil {
+			continue
+		}
+
+		errs = append(errs, prefixed("services."+name+".", claimPorts(owners, *s.Services[name]))...)
+		errs = append(errs, prefixed("services."+name+".", s.checkNetworks(*s.Services[name]))...)
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+
+	return nil
+}
+
+// claimPorts records the service as the owner of its host ports, unless
+// another service already owns one of them
+func claimPorts(owners map[string]string, s service.Service) error {
+	var errs service.ValidationErrors
+
+	for i, pair := range s.Ports {
+		if owner, ok := owners[pair.HostPort()]; ok && owner != s.Name {
+			errs = append(errs, service.ValidationError{
+				Field:   fmt.Sprintf("ports[%d].incoming", i),
+				Message: fmt.Sprintf("%s is already used by %s", pair.HostPort(), owner),
+			})
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+
+	for _, pair := range s.Ports {
+		owners[pair.HostPort()] = s.Name
+	}
+
+	return nil
+}
+
+func prefixed(prefix string, err error) service.ValidationErrors {
+	if err == nil {
+		return nil
+	}
+
+	errs, ok := err.(service.ValidationErrors)
+
+	if !ok {
+		return service.ValidationErrors{{Field: strings.TrimSuffix(prefix, "."), Message: err.Error()}}
+	}
+
+	var result service.ValidationErrors
+
+	for _, e := range errs {
+		result = append(result, service.ValidationError{Field: prefix + e.Field, Message: e.Message})
+	}
+
+	return result
+}
+
+func serviceNames(services map[string]*service.Service) []string {
+	var names []string
+
+	for name := range services {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+// InvalidNames are the names of the services left out for being invalid
+func (s *State) InvalidNames() []string {
+	var names []string
+
+	for name := range s.Invalid {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+type servicesByName []*service.Service
+
+func (s servicesByName) Len() int           { return len(s) }
+func (s servicesByName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s servicesByName) Less(i, j int) bool { return s[i].Name < s[j].Name }
+
+func MergeStates(bootState *State, directoryState *consul.DirectoryState) *State {
 	newState := &State{}
 	*newState = *bootState // clone
 
@@ -51,15 +264,46 @@ func MergeStates(bootState *State, directoryState *consul.DirectoryState) (*Stat
 		newState.Services[k] = v
 	}
 
-	directoryServices, err := directoryState.Services()
+	// a service in consul which is invalid, wants a host port another
+	// service already has or joins a network which isn't declared is left
+	// out and left alone, so one bad key doesn't stop everything else on
+	// the node from being run
 
-	if err != nil {
-		return nil, err
-	}
+	directoryServices, invalid := directoryState.Services()
 
 	for _, s := range directoryServices {
 		newState.Services[s.Name] = s
 	}
 
-	return newState, nil
+	owners := make(map[string]string)
+
+	for name, s := range bootState.Services {
+		if newState.Services[name] == s {
+			claimPorts(owners, *s)
+		}
+	}
+
+	sort.Sort(servicesByName(directoryServices))
+
+	for _, s := range directoryServices {
+		if err := claimPorts(owners, *s); err != nil {
+			invalid[s.Name] = err
+		} else if err := bootState.checkNetworks(*s); err != nil {
+			invalid[s.Name] = err
+		}
+	}
+
+	for name := range invalid {
+		delete(newState.Services, name)
+	}
+
+	if len(invalid) > 0 {
+		newState.Invalid = make(map[string]string)
+
+		for name, err := range invalid {
+			newState.Invalid[name] = err.Error()
+		}
+	}
+
+	return newState
 }
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/base64"
+	"github.com/wakeful-deployment/operator/backoff"
+	"github.com/wakeful-deployment/operator/consul"
+	"github.com/wakeful-deployment/operator/docker"
+	"github.com/wakeful-deployment/operator/service"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestBackoffPolicy(t *testing.T) {
+	jitter := 0.0
+	policy, err := Backoff{Initial: "2s", Jitter: &jitter}.Policy()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := backoff.Policy{Initial: 2 * time.Second, Max: backoff.DefaultPolicy.Max, Multiplier: backoff.DefaultPolicy.Multiplier, Jitter: 0}
+
+	if policy != expected {
+		t.Errorf("Expected %v but got %v", expected, policy)
+	}
+
+	_, err = Backoff{Initial: "2m", Max: "1m"}.Policy()
+
+	if err == nil {
+		t.Error("Expected a max shorter than the initial backoff to be invalid")
+	}
+}
+
+func TestValidateState(t *testing.T) {
+	state := &State{Services: map[string]*service.Service{
+		"statsite": &service.Service{Name: "statsite", Image: "wakeful/wake-statsite:latest", Ports: []service.PortPair{service.PortPair{Incoming: 8125, Outgoing: 8125}}},
+		"proxy":    &service.Service{Name: "proxy", Image: "wakeful/wake-proxy:latest", Ports: []service.PortPair{service.PortPair{Incoming: 8125, Outgoing: 80}}},
+	}}
+
+	err := state.Validate()
+
+	if err == nil || err.Error() != "services.statsite.ports[0].incoming: 8125/tcp is already used by proxy" {
+		t.Errorf("Expected the shared host port to be reported but got %v", err)
+	}
+}
+
+func TestMergeStatesSkipsInvalidServices(t *testing.T) {
+	bootState := &State{Services: map[string]*service.Service{
+		"statsite": &service.Service{Name: "statsite", Image: "wakeful/wake-statsite:latest", Ports: []service.PortPair{service.PortPair{Incoming: 8125, Outgoing: 8125}}},
+	}}
+
+	encode := func(value string) string {
+		return base64.StdEncoding.EncodeToString([]byte(value))
+	}
+
+	directoryState := &consul.DirectoryState{KVs: []consul.KV{
+		consul.KV{Key: "_wakeful/nodes/node/services/proxy", Value: encode(`{"image": "wakeful/wake-proxy:latest"}`)},
+		consul.KV{Key: "_wakeful/nodes/node/services/typo", Value: encode(`{"image": "wakeful/wake-typo:latest", "prots": []}`)},
+		consul.KV{Key: "_wakeful/nodes/node/services/empty", Value: encode(`{"image": ""}`)},
+		consul.KV{Key: "_wakeful/nodes/node/services/statsd", Value: encode(`{"image": "wakeful/wake-statsd:latest", "ports": [{"incoming": 8125, "outgoing": 8125}]}`)},
+	}}
+
+	state := MergeStates(bootState, directoryState)
+
+	if len(state.Services) != 2 || state.Services["statsite"] == nil || state.Services["proxy"] == nil {
+		t.Errorf("Expected only statsite and proxy to be desired but got %v", state.Services)
+	}
+
+	expected := map[string]string{
+		"typo":   `json: unknown field "prots"`,
+		"empty":  "image: is required",
+		"statsd": "ports[0].incoming: 8125/tcp is already used by statsite",
+	}
+
+	if !reflect.DeepEqual(state.Invalid, expected) {
+		t.Errorf("Expected the invalid services to be %v but got %v", expected, state.Invalid)
+	}
+}
+
+func TestValidateNetworks(t *testing.T) {
+	state := &State{
+		Networks: map[string]*docker.Network{
+			"backend": &docker.Network{Name: "backend"},
+			"bridge":  &docker.Network{Name: "bridge"},
+		},
+		Services: map[string]*service.Service{
+			"proxy": &service.Service{Name: "proxy", Image: "wakeful/wake-proxy:latest", Networks: map[string]service.NetworkAttachment{
+				"backend":  service.NetworkAttachment{Aliases: []string{"web"}},
+				"frontend": service.NetworkAttachment{},
+			}},
+		},
+	}
+
+	expected := "networks.bridge: 'bridge' is one of docker's own networks, use network_mode instead; " +
+		"services.proxy.networks.frontend: is not declared in operator.json"
+
+	if err := state.Validate(); err == nil || err.Error() != expected {
+		t.Errorf("Expected %s but got %v", expected, err)
+	}
+
+	delete(state.Networks, "bridge")
+	delete(state.Services["proxy"].Networks, "frontend")
+
+	if err := state.Validate(); err != nil {
+		t.Errorf("Expected the state to be valid but got %v", err)
+	}
+
+	directoryState := &consul.DirectoryState{KVs: []consul.KV{
+		consul.KV{Key: "_wakeful/nodes/node/services/worker", Value: base64.StdEncoding.EncodeToString([]byte(`{"image": "wakeful/app:latest", "networks": {"jobs": {}}}`))},
+	}}
+
+	merged := MergeStates(state, directoryState)
+
+	if merged.Invalid["worker"] != "networks.jobs: is not declared in operator.json" {
+		t.Errorf("Expected the worker joining an undeclared network to be invalid but got %v", merged.Invalid)
+	}
+
+	if networks := docker.NetworkNames(merged.DesiredNetworks()); len(networks) != 1 || networks[0] != "backend" {
+		t.Errorf("Expected only backend to be desired but got %v", networks)
+	}
+}
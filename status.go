@@ -0,0 +1,254 @@
+package main
+
+import (
+	"fmt"
+	"github.com/wakeful-deployment/operator/consul"
+	"github.com/wakeful-deployment/operator/container"
+	"github.com/wakeful-deployment/operator/docker"
+	"github.com/wakeful-deployment/operator/global"
+	"github.com/wakeful-deployment/operator/node"
+	"github.com/wakeful-deployment/operator/service"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	ServiceRunning = "running"
+	ServiceMissing = "missing"
+	ServiceDrifted = "drifted"
+	ServiceFailed  = "failed"
+	ServiceInvalid = "invalid"
+	// ServiceExited is a container which stopped and which docker won't
+	// restart, ServiceCrashLooping one docker keeps restarting
+	ServiceExited       = "exited"
+	ServiceCrashLooping = "crash_looping"
+	// ServiceUnmanaged is a container operator didn't start which has the
+	// name of a service, which operator leaves alone
+	ServiceUnmanaged = "unmanaged"
+)
+
+// ServiceStatus is how reconciling one service went in the last tick
+type ServiceStatus struct {
+	Name      string     `json:"name"`
+	Status    string     `json:"status"`
+	Container string     `json:"container,omitempty"`
+	Error     string     `json:"error,omitempty"`
+	RetryAt   *time.Time `json:"retry_at,omitempty"`
+}
+
+// Report is everything /api/state returns about the node
+type Report struct {
+	State              string          `json:"state"`
+	Error              string          `json:"error,omitempty"`
+	LastSuccessfulTick *time.Time      `json:"last_successful_tick"`
+	Index              int             `json:"index"`
+	Backoff            string          `json:"backoff"`
+	DesiredState       *State          `json:"desired_state"`
+	NodeState          *node.State     `json:"node_state"`
+	Services           []ServiceStatus `json:"services"`
+	// ServiceStates are the states of the machines of the services
+	// which were upgraded, ex: UpgradeFailed
+	ServiceStates map[string]string `json:"service_states"`
+}
+
+// status is written by the loop and read by the http server, so it is
+// always accessed through its methods
+type status struct {
+	mutex              sync.Mutex
+	lastSuccessfulTick *time.Time
+	index              int
+	backoff            time.Duration
+	desiredState       *State
+	nodeState          *node.State
+	services           []ServiceStatus
+}
+
+var currentStatus = &status{}
+
+func (s *status) recordIndex(index int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.index = index
+}
+
+// recordBackoff is how long we're waiting before trying again, 0 when not
+// retrying
+func (s *status) recordBackoff(d time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.backoff = d
+}
+
+func (s *status) recordTick(desiredState *State, nodeState *node.State, services []ServiceStatus) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.desiredState = desiredState
+	s.nodeState = nodeState
+	s.services = services
+}
+
+func (s *status) recordSuccess(t time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.lastSuccessfulTick = &t
+}
+
+// Report is a snapshot of the status together with the current fsm state
+func (s *status) Report() Report {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	report := Report{
+		State:              global.Machine.CurrentState.Name,
+		LastSuccessfulTick: s.lastSuccessfulTick,
+		Index:              s.index,
+		Backoff:            s.backoff.String(),
+		DesiredState:       redactedState(s.desiredState),
+		NodeState:          s.nodeState,
+		Services:           s.services,
+		ServiceStates:      global.ServiceStates(),
+	}
+
+	if global.Machine.CurrentState.Error != nil {
+		report.Error = global.Machine.CurrentState.Error.Error()
+	}
+
+	if report.Services == nil {
+		report.Services = []ServiceStatus{}
+	}
+
+	return report
+}
+
+// redactedState is the state with the env values of its services left out,
+// since those are often secrets and the report is served to anyone who can
+// reach the node
+func redactedState(state *State) *State {
+	if state == nil {
+		return nil
+	}
+
+	redacted := *state
+	redacted.Services = make(map[string]*service.Service)
+
+	for name, s := range state.Services {
+		if s == nil || s.Env == nil {
+			redacted.Services[name] = s
+			continue
+		}
+
+		copied := *s
+		copied.Env = make(map[string]string)
+
+		for key := range s.Env {
+			copied.Env[key] = container.Redacted
+		}
+
+		redacted.Services[name] = &copied
+	}
+
+	return &redacted
+}
+
+// serviceErrors picks the failures of individual services out of the error
+// normalize returned, by service name
+func serviceErrors(err error) map[string]error {
+	result := make(map[string]error)
+
+	switch errs := err.(type) {
+	case docker.Errors:
+		for name, e := range errs {
+			result[name] = e
+		}
+	case consul.Errors:
+		// services are registered with their name as the ID
+		for id, e := range errs {
+			result[id] = e
+		}
+	case upgradeErrors:
+		for _, e := range errs {
+			if upgradeErr, ok := e.(docker.UpgradeError); ok {
+				result[upgradeErr.Name] = upgradeErr
+			}
+		}
+	}
+
+	return result
+}
+
+// serviceStatuses compares each desired container to what is running now
+func serviceStatuses(desired []container.Container, running []container.Container, err error) []ServiceStatus {
+	errs := serviceErrors(err)
+	var result []ServiceStatus
+
+	for _, d := range desired {
+		s := ServiceStatus{Name: d.Name, Status: ServiceMissing}
+
+		for _, c := range running {
+			if c.Name == d.Name {
+				s.Container = c.ID
+
+				switch {
+				case !docker.Managed(c):
+					s.Status = ServiceUnmanaged
+					s.Error = "is running, but not managed by operator"
+				case !docker.UpToDate(d, c):
+					s.Status = ServiceDrifted
+				case docker.CrashLooping(c):
+					s.Status = ServiceCrashLooping
+					s.Error = fmt.Sprintf("exited with code %d and was restarted %d times", c.ExitCode, c.RestartCount)
+				case !docker.Running(c):
+					s.Status = ServiceExited
+
+					if c.ExitCode != 0 {
+						s.Error = fmt.Sprintf("exited with code %d", c.ExitCode)
+					}
+				default:
+					s.Status = ServiceRunning
+				}
+
+				break
+			}
+		}
+
+		if e, ok := errs[d.Name]; ok {
+			s.Status = ServiceFailed
+			s.Error = e.Error()
+		}
+
+		result = append(result, s)
+	}
+
+	sort.Sort(byName(result))
+
+	return result
+}
+
+// invalidStatuses are the statuses of the services left alone for being
+// invalid, with the container they are still running in, if any
+func invalidStatuses(invalid map[string]string, running []container.Container) []ServiceStatus {
+	var result []ServiceStatus
+
+	for name, message := range invalid {
+		s := ServiceStatus{Name: name, Status: ServiceInvalid, Error: message}
+
+		if c, ok := findContainer(running, name); ok {
+			s.Container = c.ID
+		}
+
+		result = append(result, s)
+	}
+
+	return result
+}
+
+type byName []ServiceStatus
+
+func (s byName) Len() int           { return len(s) }
+func (s byName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byName) Less(i, j int) bool { return s[i].Name < s[j].Name }
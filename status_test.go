@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/wakeful-deployment/operator/container"
+	"github.com/wakeful-deployment/operator/docker"
+	"github.com/wakeful-deployment/operator/global"
+	"strings"
+	"testing"
+)
+
+func TestServiceStatuses(t *testing.T) {
+	proxy := container.Container{Name: "proxy", Image: "plum/wake-proxy:latest"}
+	statsite := container.Container{Name: "statsite", Image: "plum/wake-statsite:latest"}
+	web := container.Container{Name: "web", Image: "plum/web:2"}
+	worker := container.Container{Name: "worker", Image: "plum/worker:latest"}
+	cron := container.Container{Name: "cron", Image: "plum/cron:latest"}
+
+	desired := []container.Container{worker, web, statsite, proxy, cron}
+	running := []container.Container{
+		container.Container{ID: "abc", Name: "proxy", Image: "plum/wake-proxy:latest", Labels: docker.Labels(proxy)},
+		container.Container{ID: "def", Name: "statsite", Image: "plum/wake-statsite:latest", Labels: managed("statsite")},
+		container.Container{ID: "ghi", Name: "web", Image: "plum/web:1", Labels: managed("web")},
+		container.Container{ID: "jkl", Name: "cron", Image: "plum/cron:latest"},
+	}
+	err := upgradeErrors{docker.UpgradeError{Name: "web", Image: "plum/web:2", Err: errors.New("container exited")}}
+
+	statuses := serviceStatuses(desired, running, err)
+
+	expected := []ServiceStatus{
+		ServiceStatus{Name: "cron", Status: ServiceUnmanaged, Container: "jkl", Error: "is running, but not managed by operator"},
+		ServiceStatus{Name: "proxy", Status: ServiceRunning, Container: "abc"},
+		ServiceStatus{Name: "statsite", Status: ServiceDrifted, Container: "def"},
+		ServiceStatus{Name: "web", Status: ServiceFailed, Container: "ghi", Error: err[0].Error()},
+		ServiceStatus{Name: "worker", Status: ServiceMissing},
+	}
+
+	if len(statuses) != len(expected) {
+		t.Fatalf("Expected %d statuses but got %v", len(expected), statuses)
+	}
+
+	for i, s := range statuses {
+		if s != expected[i] {
+			t.Errorf("Expected %v but got %v", expected[i], s)
+		}
+	}
+}
+
+func TestServiceStatusesWithDockerErrors(t *testing.T) {
+	desired := []container.Container{container.Container{Name: "proxy", Image: "plum/wake-proxy:latest"}}
+	err := docker.Errors{"proxy": errors.New("no such image")}
+
+	statuses := serviceStatuses(desired, nil, err)
+
+	if len(statuses) != 1 || statuses[0].Status != ServiceFailed || statuses[0].Error != "no such image" {
+		t.Errorf("Expected proxy to have failed with 'no such image' but got %v", statuses)
+	}
+}
+
+func TestServiceStatusesOfStoppedContainers(t *testing.T) {
+	proxy := container.Container{Name: "proxy", Image: "plum/wake-proxy:latest"}
+	migrate := container.Container{Name: "migrate", Image: "plum/migrate:latest", Restart: "no"}
+	worker := container.Container{Name: "worker", Image: "plum/worker:latest", Restart: "on-failure:3"}
+
+	desired := []container.Container{proxy, migrate, worker}
+	running := []container.Container{
+		container.Container{ID: "abc", Name: "proxy", Labels: docker.Labels(proxy), State: "restarting", ExitCode: 1, RestartCount: 12},
+		container.Container{ID: "def", Name: "migrate", Labels: docker.Labels(migrate), State: "exited"},
+		container.Container{ID: "ghi", Name: "worker", Labels: docker.Labels(worker), State: "exited", ExitCode: 2},
+	}
+
+	statuses := serviceStatuses(desired, running, nil)
+
+	expected := []ServiceStatus{
+		ServiceStatus{Name: "migrate", Status: ServiceExited, Container: "def"},
+		ServiceStatus{Name: "proxy", Status: ServiceCrashLooping, Container: "abc", Error: "exited with code 1 and was restarted 12 times"},
+		ServiceStatus{Name: "worker", Status: ServiceExited, Container: "ghi", Error: "exited with code 2"},
+	}
+
+	if len(statuses) != len(expected) {
+		t.Fatalf("Expected %d statuses but got %v", len(expected), statuses)
+	}
+
+	for i, s := range statuses {
+		if s != expected[i] {
+			t.Errorf("Expected %v but got %v", expected[i], s)
+		}
+	}
+}
+
+func TestReport(t *testing.T) {
+	global.Machine.ForceTransition(global.NormalizingFailed, errors.New("boom"))
+	defer global.Machine.ForceTransition(global.Initial, nil)
+
+	s := &status{}
+	s.recordIndex(42)
+
+	var b bytes.Buffer
+	err := json.NewEncoder(&b).Encode(s.Report())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `{"state":"NormalizingFailed","error":"boom","last_successful_tick":null,"index":42,"backoff":"0s","desired_state":null,"node_state":null,"services":[],"service_states":{}}`
+
+	if strings.TrimSpace(b.String()) != expected {
+		t.Errorf("Expected %s but got %s", expected, b.String())
+	}
+}
+
+func TestReportRedactsEnv(t *testing.T) {
+	state := bootState()
+	state.Services["statsite"].Env = map[string]string{"API_KEY": "s3cret"}
+
+	s := &status{}
+	s.recordTick(state, nil, nil)
+
+	b, err := json.Marshal(s.Report())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(string(b), "s3cret") || !strings.Contains(string(b), `"API_KEY":"\u003credacted\u003e"`) {
+		t.Errorf("Expected the env value to be redacted but got %s", b)
+	}
+
+	if state.Services["statsite"].Env["API_KEY"] != "s3cret" {
+		t.Errorf("Expected the desired state itself to be left alone but was %v", state.Services["statsite"].Env)
+	}
+}
@@ -1,44 +1,75 @@
 package test
 
 import (
+	"context"
 	"github.com/wakeful-deployment/operator/consul"
 	"github.com/wakeful-deployment/operator/service"
 )
 
 type ConsulClient struct {
 	RegisteredServicesResponse func() (string, error)
+	ChecksResponse             func() (string, error)
 	RegisterResponse           func(service.Service) error
 	DeregisterResponse         func(service.Service) error
 	PostMetadataResponse       func() error
+	PutKeyResponse             func(string, string) error
+	GetKeyResponse             func(string) (string, error)
+	DeleteKeyResponse          func(string) error
+	ListKeysResponse           func(string) ([]consul.KV, error)
 	DetectResponse             func() error
 	GetDirectoryStateResponse  func() (*consul.DirectoryState, error)
 	ConsulHostResponse         func() string
+	NodeAddressResponse        func() string
 }
 
-func (t ConsulClient) RegisteredServices() (string, error) {
+func (t ConsulClient) RegisteredServices(ctx context.Context) (string, error) {
 	return t.RegisteredServicesResponse()
 }
 
-func (t ConsulClient) Register(s service.Service) error {
+func (t ConsulClient) Checks(ctx context.Context) (string, error) {
+	return t.ChecksResponse()
+}
+
+func (t ConsulClient) Register(ctx context.Context, s service.Service) error {
 	return t.RegisterResponse(s)
 }
 
-func (t ConsulClient) Deregister(s service.Service) error {
+func (t ConsulClient) Deregister(ctx context.Context, s service.Service) error {
 	return t.DeregisterResponse(s)
 }
 
-func (t ConsulClient) PostMetadata(nodeName string, data map[string]string) error {
+func (t ConsulClient) PostMetadata(ctx context.Context, nodeName string, data map[string]string) error {
 	return t.PostMetadataResponse()
 }
 
-func (t ConsulClient) Detect() error {
+func (t ConsulClient) PutKey(ctx context.Context, key string, value string) error {
+	return t.PutKeyResponse(key, value)
+}
+
+func (t ConsulClient) GetKey(ctx context.Context, key string) (string, error) {
+	return t.GetKeyResponse(key)
+}
+
+func (t ConsulClient) DeleteKey(ctx context.Context, key string) error {
+	return t.DeleteKeyResponse(key)
+}
+
+func (t ConsulClient) ListKeys(ctx context.Context, prefix string) ([]consul.KV, error) {
+	return t.ListKeysResponse(prefix)
+}
+
+func (t ConsulClient) Detect(ctx context.Context) error {
 	return t.DetectResponse()
 }
 
-func (t ConsulClient) GetDirectoryState(nodeName string, index int, wait string) (*consul.DirectoryState, error) {
+func (t ConsulClient) GetDirectoryState(ctx context.Context, nodeName string, index int, wait string) (*consul.DirectoryState, error) {
 	return t.GetDirectoryStateResponse()
 }
 
 func (t ConsulClient) ConsulHost() string {
 	return t.ConsulHostResponse()
 }
+
+func (t ConsulClient) NodeAddress() string {
+	return t.NodeAddressResponse()
+}
@@ -1,29 +1,71 @@
 package test
 
 import (
+	"context"
 	"github.com/wakeful-deployment/operator/container"
+	"github.com/wakeful-deployment/operator/docker"
 )
 
 type DockerClient struct {
 	RunResponse               func(container.Container) error
 	StopResponse              func(container.Container) error
-	RunningContainersResponse func() (string, error)
+	RunningContainersResponse func() ([]container.Container, error)
+	InspectResponse           func(container.Container) (container.Container, error)
+	EventsResponse            func() (<-chan docker.Event, error)
+	RemoveVolumesResponse     func(string) error
+	NetworksResponse          func() ([]docker.Network, error)
+	CreateNetworkResponse     func(docker.Network) error
+	RemoveNetworkResponse     func(string) error
+	ImageIDResponse           func(string) (string, error)
+	PullResponse              func(container.Container) error
 }
 
-func (d DockerClient) Run(c container.Container) error {
+func (d DockerClient) Run(ctx context.Context, c container.Container) error {
 	return d.RunResponse(c)
 }
 
-func (d DockerClient) Stop(c container.Container) error {
+func (d DockerClient) Stop(ctx context.Context, c container.Container) error {
 	return d.StopResponse(c)
 }
 
-func (d DockerClient) RunningContainers() (string, error) {
+func (d DockerClient) RunningContainers(ctx context.Context) ([]container.Container, error) {
 	result, err := d.RunningContainersResponse()
 
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	return result, nil
 }
+
+func (d DockerClient) Inspect(ctx context.Context, c container.Container) (container.Container, error) {
+	return d.InspectResponse(c)
+}
+
+func (d DockerClient) Events(ctx context.Context) (<-chan docker.Event, error) {
+	return d.EventsResponse()
+}
+
+func (d DockerClient) RemoveEphemeralVolumes(ctx context.Context, name string) error {
+	return d.RemoveVolumesResponse(name)
+}
+
+func (d DockerClient) Networks(ctx context.Context) ([]docker.Network, error) {
+	return d.NetworksResponse()
+}
+
+func (d DockerClient) CreateNetwork(ctx context.Context, n docker.Network) error {
+	return d.CreateNetworkResponse(n)
+}
+
+func (d DockerClient) RemoveNetwork(ctx context.Context, name string) error {
+	return d.RemoveNetworkResponse(name)
+}
+
+func (d DockerClient) ImageID(ctx context.Context, image string) (string, error) {
+	return d.ImageIDResponse(image)
+}
+
+func (d DockerClient) Pull(ctx context.Context, c container.Container) error {
+	return d.PullResponse(c)
+}
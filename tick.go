@@ -1,82 +1,205 @@
 package main
 
 import (
-	"fmt"
+	"context"
+	"github.com/wakeful-deployment/operator/backoff"
 	"github.com/wakeful-deployment/operator/consul"
 	"github.com/wakeful-deployment/operator/container"
 	"github.com/wakeful-deployment/operator/docker"
 	"github.com/wakeful-deployment/operator/global"
 	"github.com/wakeful-deployment/operator/logger"
+	"github.com/wakeful-deployment/operator/metrics"
 	"github.com/wakeful-deployment/operator/node"
 	"github.com/wakeful-deployment/operator/service"
+	"sort"
 	"time"
 )
 
-func Once(dockerClient docker.Client, consulClient consul.Client, bootState *State) {
-	directoryState := GetDirectoryState(consulClient, bootState.NodeName, 0, "0s")
-	Tick(dockerClient, consulClient, bootState, directoryState)
+func Once(ctx context.Context, dockerClient docker.Client, consulClient consul.Client, bootState *State) {
+	directoryState := GetDirectoryState(ctx, consulClient, bootState.NodeName, consul.NewWatch("0s"))
+
+	if directoryState == nil {
+		return
+	}
+
+	Tick(ctx, dockerClient, consulClient, bootState, directoryState)
 }
 
-func Loop(dockerClient docker.Client, consulClient consul.Client, bootState *State) {
-	index := 0
+// Loop ticks on every change to the directory, every resyncInterval and
+// shortly after a managed container dies, until ctx is cancelled. A tick
+// which already started is always allowed to finish. After a failed tick
+// it backs off, and only a change to the directory ticks again sooner.
+func Loop(ctx context.Context, dockerClient docker.Client, consulClient consul.Client, bootState *State) {
+	results := make(chan directoryResult)
+	go watchDirectory(ctx, consulClient, bootState.NodeName, bootState.Wait, results)
+
+	changed := make(chan struct{}, 1)
+	go watchContainers(ctx, dockerClient, changed)
+
+	var resync <-chan time.Time
+
+	if resyncInterval > 0 {
+		ticker := time.NewTicker(resyncInterval)
+		defer ticker.Stop()
+		resync = ticker.C
+	}
+
+	var directoryState *consul.DirectoryState
+	var retry, settled <-chan time.Time
+	retries := backoff.New(retryPolicy)
 
 	for {
-		directoryState := GetDirectoryState(consulClient, bootState.NodeName, index, bootState.Wait)
-		Tick(dockerClient, consulClient, bootState, directoryState)
+		select {
+		case <-ctx.Done():
+			logger.Info("stopping the loop")
+			return
+		case result := <-results:
+			if result.err != nil {
+				logger.Error("fetching directory state failed", logger.Fields{"error": result.err})
+				global.Machine.Transition(global.FetchingDirectoryStateFailed, result.err)
+				continue
+			}
+
+			logger.Debug("succesfully fetched directory state", logger.Fields{"index": result.state.Index, "keys": len(result.state.KVs)})
+			directoryState = result.state
+			metrics.ConsulIndex.Set(float64(directoryState.Index))
+			currentStatus.recordIndex(directoryState.Index)
+		case <-resync:
+			if directoryState == nil || retry != nil {
+				continue
+			}
+
+			logger.Debug("resyncing")
+		case <-changed:
+			settled = time.After(eventDelay)
+			continue
+		case <-settled:
+			settled = nil
+
+			if directoryState == nil || retry != nil {
+				continue
+			}
+
+			logger.Info("reconciling after container events")
+		case <-retry:
+			retry = nil
+		}
+
+		// ticks don't get ctx, so a signal lets the current tick finish
+		Tick(context.Background(), dockerClient, consulClient, bootState, directoryState)
 
 		if global.Machine.IsCurrently(global.Running) {
-			logger.Info(fmt.Sprintf("iteration complete - setting index to %d and then sleeping", directoryState.Index))
-			index = directoryState.Index
-			time.Sleep(time.Second)
+			logger.Info("iteration complete", logger.Fields{"index": directoryState.Index})
+			retries.Reset()
+			currentStatus.recordBackoff(0)
+			retry = nil
 		} else {
-			logger.Info(fmt.Sprintf("iteration complete - machine is not running state but rather %v. Sleeping now.", global.Machine.CurrentState))
-			time.Sleep(6 * time.Second)
+			logger.Warn("iteration complete - machine is not in the running state", logger.Fields{"error": global.Machine.CurrentState.Error})
+			retry = time.After(nextBackoff(retries))
 		}
 	}
 }
 
-func GetDirectoryState(consulClient consul.Client, nodeName string, index int, wait string) *consul.DirectoryState {
-	logger.Info("getting directory state...")
-	directoryState, err := consulClient.GetDirectoryState(nodeName, index, wait) // this will block for some time
+// wait sleeps for the next backoff
+func wait(ctx context.Context, retries *backoff.Backoff) {
+	sleep(ctx, nextBackoff(retries))
+}
+
+// nextBackoff is how long to back off for, which is reported in the status
+func nextBackoff(retries *backoff.Backoff) time.Duration {
+	delay := retries.Next()
+	currentStatus.recordBackoff(delay)
+	logger.Info("backing off", logger.Fields{"retry_in": delay, "attempts": retries.Attempts()})
+
+	return delay
+}
+
+// sleep returns early when ctx is cancelled
+func sleep(ctx context.Context, d time.Duration) {
+	select {
+	case <-ctx.Done():
+	case <-time.After(d):
+	}
+}
+
+// GetDirectoryState blocks until the services of the node change after the
+// watch's index, or the watch's wait passes
+func GetDirectoryState(ctx context.Context, consulClient consul.Client, nodeName string, watch *consul.Watch) *consul.DirectoryState {
+	logger.Debug("getting directory state...", logger.Fields{"index": watch.Index()})
+
+	var directoryState *consul.DirectoryState
+	err := watch.Query(ctx, func(ctx context.Context, index int, wait string) error {
+		var err error
+		directoryState, err = consulClient.GetDirectoryState(ctx, nodeName, index, wait) // this will block for some time
+		return err
+	})
+
+	if ctx.Err() != nil {
+		logger.Debug("fetching directory state was cancelled")
+		return nil
+	}
 
 	if err != nil {
-		logger.Error(fmt.Sprintf("fetching directory state failed with error: %v", err))
+		logger.Error("fetching directory state failed", logger.Fields{"error": err})
 		global.Machine.Transition(global.FetchingDirectoryStateFailed, err)
 		return nil
 	}
-	logger.Info(fmt.Sprintf("succesfully fetched directoryState: %v", directoryState))
+	logger.Debug("succesfully fetched directory state", logger.Fields{"index": directoryState.Index, "keys": len(directoryState.KVs)})
 
 	return directoryState
 }
 
-func Tick(dockerClient docker.Client, consulClient consul.Client, bootState *State, directoryState *consul.DirectoryState) {
+// tickID numbers each tick so all the log lines of one tick can be found
+var tickID = 0
+
+func Tick(ctx context.Context, dockerClient docker.Client, consulClient consul.Client, bootState *State, directoryState *consul.DirectoryState) {
+	tickID++
+	logger.SetField("tick_id", tickID)
+	defer logger.ClearField("tick_id")
+
+	start := time.Now()
+	defer func() {
+		metrics.TickDuration.Observe(time.Since(start).Seconds())
+		metrics.Ticks.Inc(global.Machine.CurrentState.Name)
+	}()
+
+	// whatever happened, let anyone watching consul know
+	defer publishStatus(ctx, consulClient, bootState.NodeName)
+
 	if !global.Machine.IsCurrently(global.Running) && !global.Machine.IsCurrently(global.Booted) {
 		global.Machine.Transition(global.AttemptingToRecover, global.Machine.CurrentState.Error)
 	}
 
-	logger.Info(fmt.Sprintf("merging states - bootState=%v and directoryState=%v", bootState, directoryState))
-	desiredState, err := MergeStates(bootState, directoryState)
+	logger.Debug("merging states", logger.Fields{"boot_state": bootState, "directory_state": directoryState})
+	desiredState := MergeStates(bootState, directoryState)
+	reportInvalidServices(ctx, consulClient, desiredState.NodeName, desiredState.Invalid)
+	desiredState.Registries = fetchRegistries(ctx, consulClient, bootState)
 
-	if err != nil {
-		logger.Error(fmt.Sprintf("merging states failed with error: %v", err))
-		global.Machine.Transition(global.MergingStateFailed, err)
-		return
-	}
-
-	logger.Info("getting current node state")
-	currentNodeState, err := node.CurrentState(dockerClient, consulClient)
+	logger.Debug("getting current node state")
+	currentNodeState, err := node.CurrentState(ctx, dockerClient, consulClient)
 
 	if err != nil {
-		logger.Error(fmt.Sprintf("getting current node state failed with error: %v", err))
+		logger.Error("getting current node state failed", logger.Fields{"error": err})
 		global.Machine.Transition(global.FetchingNodeStateFailed, err)
 		return
 	}
 
-	logger.Info(fmt.Sprintf("normalizing states - desiredState=%v and currentNodeState=%v", desiredState, currentNodeState))
-	err = normalize(dockerClient, consulClient, desiredState, currentNodeState)
+	metrics.DesiredContainers.Set(float64(len(desiredState.Services)))
+	metrics.RunningContainers.Set(float64(len(runningContainers(currentNodeState.Containers))))
+
+	logger.Debug("normalizing states", logger.Fields{"desired_state": desiredState, "current_state": currentNodeState})
+	err = normalize(ctx, dockerClient, consulClient, desiredState, currentNodeState)
+	recordStatus(ctx, dockerClient, consulClient, desiredState, currentNodeState, err)
+
+	// a failed upgrade only fails its service, which the status and the
+	// service's failure key show. The rest of the node is as desired.
+	if _, ok := err.(upgradeErrors); ok {
+		logger.Error("normalizing succeeded, but upgrading failed", logger.Fields{"error": err})
+		err = nil
+	}
 
 	if err != nil {
-		logger.Error(fmt.Sprintf("normalizing failed with error: %v", err))
+		logger.Error("normalizing failed", logger.Fields{"error": err})
 		global.Machine.Transition(global.NormalizingFailed, err)
 		return
 	}
@@ -84,37 +207,188 @@ func Tick(dockerClient docker.Client, consulClient consul.Client, bootState *Sta
 	if !global.Machine.IsCurrently(global.Running) {
 		global.Machine.Transition(global.Running, nil)
 	}
+
+	currentStatus.recordSuccess(time.Now())
+}
+
+// recordStatus looks at the containers again after normalizing, so the
+// status reflects what normalizing actually achieved
+func recordStatus(ctx context.Context, dockerClient docker.Client, consulClient consul.Client, desiredState *State, currentNodeState *node.State, err error) {
+	nodeState := *currentNodeState
+	running, listErr := docker.RunningContainers(ctx, dockerClient)
+
+	if listErr != nil {
+		logger.Warn("listing containers after normalizing failed, reporting the earlier list", logger.Fields{"error": listErr})
+	} else {
+		nodeState.Containers = running
+	}
+
+	services := serviceStatuses(stateContainers(desiredState, consulClient), nodeState.Containers, err)
+	services = append(services, invalidStatuses(desiredState.Invalid, nodeState.Containers)...)
+	sort.Sort(byName(services))
+
+	crashLooping := 0
+
+	for _, s := range services {
+		if s.Status == ServiceCrashLooping {
+			logger.Warn("container is crash looping", logger.Fields{"container": s.Name, "error": s.Error})
+			crashLooping++
+		}
+	}
+
+	metrics.CrashLooping.Set(float64(crashLooping))
+
+	for i, s := range services {
+		if retry, ok := serviceRetries[s.Name]; ok {
+			at := retry.At
+			services[i].RetryAt = &at
+		}
+	}
+
+	currentStatus.recordTick(desiredState, &nodeState, services)
+}
+
+func runningContainers(containers []container.Container) []container.Container {
+	var result []container.Container
+
+	for _, c := range containers {
+		if docker.Running(c) {
+			result = append(result, c)
+		}
+	}
+
+	return result
+}
+
+// stateContainers are the containers the services of the state run in
+func stateContainers(desiredState *State, consulClient consul.Client) []container.Container {
+	var result []container.Container
+
+	for _, service := range desiredState.Services {
+		c := service.Container(desiredState.NodeName, consulClient.ConsulHost())
+		c.Auth = desiredState.registryAuth(c.Image)
+		result = append(result, c)
+	}
+
+	return result
 }
 
 // reconcile the desired config with the current state
-func normalize(dockerClient docker.Client, consulClient consul.Client, desiredState *State, currentNodeState *node.State) error {
+func normalize(ctx context.Context, dockerClient docker.Client, consulClient consul.Client, desiredState *State, currentNodeState *node.State) error {
+	// invalid services are left as they are, rather than being stopped and
+	// deregistered as if they were no longer wanted
+
+	currentNodeState = currentNodeState.Without(desiredState.InvalidNames())
+
+	// networks have to exist before containers can join them
+
+	networks, err := docker.PlanNetworks(ctx, dockerClient, desiredState.DesiredNetworks())
+
+	if err != nil {
+		return err
+	}
+
+	err = docker.CreateNetworks(ctx, dockerClient, networks)
+
+	if err != nil {
+		return err
+	}
+
 	// always try to fix the containers before fixing the registrations
 
-	var desiredContainers []container.Container
+	desiredContainers := stateContainers(desiredState, consulClient)
 
-	for _, service := range desiredState.Services {
-		desiredContainers = append(desiredContainers, service.Container(desiredState.NodeName, consulClient.ConsulHost()))
+	// services with a new image, or whose tag was pushed again, are
+	// upgraded one by one, gated on the health of the new container, and
+	// then left out of the normal pass
+
+	currentContainers := currentNodeState.Containers
+	stale := docker.StaleImages(ctx, dockerClient, desiredContainers, currentContainers)
+	upgrades := append(docker.PendingUpgrades(desiredContainers, currentContainers), stale...)
+	upgraded, upgradeErrs, err := upgradeContainers(ctx, dockerClient, consulClient, desiredState, upgrades, docker.Names(stale), currentContainers)
+
+	if err != nil {
+		return err
 	}
 
-	err := docker.NormalizeContainers(dockerClient, desiredContainers, currentNodeState.Containers)
+	global.KeepServices(append(docker.Names(desiredContainers), desiredState.InvalidNames()...))
+	desiredContainers = withoutContainers(desiredContainers, upgraded)
+	currentContainers = withoutContainers(currentContainers, upgraded)
+
+	// services which recently failed are left alone until their backoff
+	// is over, but still count as failing
+
+	waiting := waitingServices(time.Now())
+	desiredContainers = withoutContainers(desiredContainers, keys(waiting))
+	currentContainers = withoutContainers(currentContainers, keys(waiting))
+
+	err = docker.NormalizeContainers(ctx, dockerClient, desiredContainers, currentContainers)
+	recordServiceRetries(waiting, err, time.Now())
+
+	if errs, ok := err.(docker.Errors); ok {
+		for name, e := range waiting {
+			errs[name] = e
+		}
+	}
 
 	if err != nil {
 		return err
 	}
 
-	// then try to register everything correctly in consul
+	// and can only be removed once no container is attached anymore
+
+	docker.RemoveNetworks(ctx, dockerClient, networks)
+
+	// then try to register everything correctly in consul. The
+	// registrations of services which are backing off are left alone too.
 
 	var desiredServices []service.Service
 
 	for _, s := range desiredState.Services {
-		desiredServices = append(desiredServices, *s)
+		if _, ok := waiting[s.Name]; !ok {
+			desiredServices = append(desiredServices, *s)
+		}
 	}
 
-	err = consul.NormalizeServices(consulClient, desiredServices, currentNodeState.Services)
+	currentServices := currentNodeState.Without(keys(waiting)).Services
+	err = consul.NormalizeServices(ctx, consulClient, desiredServices, currentServices)
+
+	// services which are backing off still fail the tick, along with
+	// whatever else failed
+	if len(waiting) > 0 {
+		return mergeErrors(waiting, err, upgradeErrs)
+	}
 
 	if err != nil {
 		return err
 	}
 
+	if len(upgradeErrs) > 0 {
+		return upgradeErrs
+	}
+
 	return nil
 }
+
+// mergeErrors adds the registration and upgrade errors of a tick to the
+// errors of the services which are backing off. Errors which aren't about
+// one service are kept under a key no service can have.
+func mergeErrors(waiting docker.Errors, registerErr error, upgradeErrs upgradeErrors) docker.Errors {
+	if errs, ok := registerErr.(consul.Errors); ok {
+		for id, e := range errs {
+			waiting[id] = e
+		}
+	} else if registerErr != nil {
+		waiting["(registering services)"] = registerErr
+	}
+
+	for _, e := range upgradeErrs {
+		if upgradeErr, ok := e.(docker.UpgradeError); ok {
+			waiting[upgradeErr.Name] = upgradeErr
+		} else {
+			waiting["(upgrading)"] = e
+		}
+	}
+
+	return waiting
+}
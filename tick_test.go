@@ -1,13 +1,19 @@
 package main
 
 import (
+	"context"
+	"encoding/base64"
 	"errors"
 	"github.com/wakeful-deployment/operator/consul"
 	"github.com/wakeful-deployment/operator/container"
+	"github.com/wakeful-deployment/operator/docker"
 	"github.com/wakeful-deployment/operator/global"
 	"github.com/wakeful-deployment/operator/service"
 	"github.com/wakeful-deployment/operator/test"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestSuccessfulTickWithStart(t *testing.T) {
@@ -17,19 +23,19 @@ func TestSuccessfulTickWithStart(t *testing.T) {
 	var startedContainers []string
 	var stoppedContainers []string
 	dockerClient := dockerClient(&startedContainers, &stoppedContainers)
-	dockerClient.RunningContainersResponse = func() (string, error) {
-		return `
-		operator plum/wake-operator:c60758244
-		consul plum/wake-consul-agent:latest
-		statsite plum/wake-statsite:latest
-		`, nil
+	dockerClient.RunningContainersResponse = func() ([]container.Container, error) {
+		return []container.Container{
+			container.Container{Name: "operator", Image: "plum/wake-operator:c60758244"},
+			container.Container{Name: "consul", Image: "plum/wake-consul-agent:latest"},
+			container.Container{Name: "statsite", Image: "plum/wake-statsite:latest"},
+		}, nil
 	}
 
 	var registeredServices []string
 	var deregisteredServices []string
 	consulClient := consulClient(&registeredServices, &deregisteredServices)
 	consulClient.RegisteredServicesResponse = func() (string, error) {
-		return `{"consul":{"ID":"consul","Service":"consul","Tags":[],"Address":"","Port":8300},"statsite":{"ID":"statsite","Service":"statsite","Tags":null,"Address":"10.1.0.9","Port":0}}`, nil
+		return `{"consul":{"ID":"consul","Service":"consul","Tags":[],"Address":"","Port":0},"statsite":{"ID":"statsite","Service":"statsite","Tags":null,"Address":"","Port":0}}`, nil
 	}
 
 	proxyKV := consul.KV{Key: "_wakeful/nodes/981eb8e33da95184/services/proxy", Value: "eyJpbWFnZSI6InBsdW0vd2FrZS1wcm94eTpsYXRlc3QiLCJ0YWdzIjpbXX0="}
@@ -38,7 +44,7 @@ func TestSuccessfulTickWithStart(t *testing.T) {
 	bootState := bootState()
 
 	bootStateServicesNamesBefore := bootStateServicesNames(*bootState)
-	Tick(dockerClient, consulClient, bootState, directoryState)
+	Tick(context.Background(), dockerClient, consulClient, bootState, directoryState)
 	bootStateServicesNamesAfter := bootStateServicesNames(*bootState)
 
 	if !global.Machine.IsCurrently(global.Running) {
@@ -73,51 +79,1019 @@ func TestSuccessfulTickWithStop(t *testing.T) {
 	var startedContainers []string
 	var stoppedContainers []string
 	dockerClient := dockerClient(&startedContainers, &stoppedContainers)
-	dockerClient.RunningContainersResponse = func() (string, error) {
-		return `
-operator plum/wake-operator:c60758244
-consul plum/wake-consul-agent:latest
-statsite plum/wake-statsite:latest
-proxy plum/wake-proxy:latest
-		`, nil
+	var removedVolumes []string
+	dockerClient.RemoveVolumesResponse = func(name string) error {
+		removedVolumes = append(removedVolumes, name)
+		return nil
+	}
+	dockerClient.RunningContainersResponse = func() ([]container.Container, error) {
+		return []container.Container{
+			container.Container{Name: "operator", Image: "plum/wake-operator:c60758244"},
+			container.Container{Name: "consul", Image: "plum/wake-consul-agent:latest"},
+			container.Container{Name: "statsite", Image: "plum/wake-statsite:latest"},
+			container.Container{Name: "proxy", Image: "plum/wake-proxy:latest", Labels: managed("proxy")},
+			container.Container{Name: "debugging", Image: "ubuntu:latest"},
+		}, nil
+	}
+
+	var registeredServices []string
+	var deregisteredServices []string
+	consulClient := consulClient(&registeredServices, &deregisteredServices)
+	consulClient.RegisteredServicesResponse = func() (string, error) {
+		return `{"consul":{"ID":"consul","Service":"consul","Tags":[],"Address":"","Port":0},"statsite":{"ID":"statsite","Service":"statsite","Tags":null,"Address":"","Port":0}, "proxy":{"ID":"proxy","Service":"proxy","Tags":[],"Address":"","Port":8000}}`, nil
+	}
+
+	bootState := bootState()
+	directoryState := &consul.DirectoryState{}
+
+	bootStateServicesNamesBefore := bootStateServicesNames(*bootState)
+	Tick(context.Background(), dockerClient, consulClient, bootState, directoryState)
+	bootStateServicesNamesAfter := bootStateServicesNames(*bootState)
+
+	if !global.Machine.IsCurrently(global.Running) {
+		t.Errorf("Expected machine to be %s but was %v", global.Running, global.Machine.CurrentState)
+	}
+
+	if len(bootStateServicesNamesBefore) != len(bootStateServicesNamesAfter) {
+		t.Errorf("Expected bootstate to remain the same: before=%v after=%v", bootStateServicesNamesBefore, bootStateServicesNamesAfter)
+	}
+
+	if len(startedContainers) != 0 {
+		t.Errorf("Expected docker start to be called %d times but was called %d times", 0, len(startedContainers))
+	}
+
+	if len(stoppedContainers) != 1 {
+		t.Errorf("Expected docker stop to be called %d times but was called %d times", 1, len(stoppedContainers))
+	}
+
+	if strings.Join(removedVolumes, ",") != "proxy,proxy-next" {
+		t.Errorf("Expected the ephemeral volumes of proxy to be removed but removed those of %v", removedVolumes)
+	}
+
+	if len(registeredServices) != 0 {
+		t.Errorf("Expected to register %d services but %d were registered", 0, len(registeredServices))
+	}
+
+	if len(deregisteredServices) != 1 {
+		t.Errorf("Expected to deregister %d services but %d were deregistered", 1, len(deregisteredServices))
+	}
+}
+
+func TestTickCreatesAndRemovesNetworks(t *testing.T) {
+	global.Machine.ForceTransition(global.Booted, nil)
+	defer global.Machine.ForceTransition(global.Initial, nil)
+
+	var startedContainers []string
+	var stoppedContainers []string
+	var events []string
+	dockerClient := dockerClient(&startedContainers, &stoppedContainers)
+	dockerClient.RunningContainersResponse = func() ([]container.Container, error) {
+		return []container.Container{
+			container.Container{Name: "consul"},
+			container.Container{Name: "statsite"},
+		}, nil
+	}
+	dockerClient.NetworksResponse = func() ([]docker.Network, error) {
+		return []docker.Network{
+			docker.Network{Name: "bridge", Driver: "bridge"},
+			docker.Network{Name: "frontend", Driver: "bridge"},
+			docker.Network{Name: "old", Managed: true},
+		}, nil
+	}
+	dockerClient.CreateNetworkResponse = func(n docker.Network) error {
+		events = append(events, "create "+n.Name)
+		return nil
+	}
+	dockerClient.RemoveNetworkResponse = func(name string) error {
+		events = append(events, "remove "+name)
+		return nil
+	}
+	dockerClient.RunResponse = func(c container.Container) error {
+		events = append(events, "run "+c.Name)
+		return nil
+	}
+
+	var registeredServices []string
+	var deregisteredServices []string
+	consulClient := consulClient(&registeredServices, &deregisteredServices)
+	consulClient.RegisteredServicesResponse = func() (string, error) {
+		return `{"consul":{"ID":"consul","Service":"consul","Tags":[],"Address":"","Port":0},"statsite":{"ID":"statsite","Service":"statsite","Tags":null,"Address":"","Port":0}}`, nil
+	}
+
+	bootState := bootState()
+	bootState.Networks = map[string]*docker.Network{
+		"backend":  &docker.Network{Name: "backend"},
+		"frontend": &docker.Network{Name: "frontend"},
+		"unused":   &docker.Network{Name: "unused"},
+	}
+
+	proxyKV := consul.KV{Key: "_wakeful/nodes/981eb8e33da95184/services/proxy", Value: base64.StdEncoding.EncodeToString([]byte(`{"image": "plum/wake-proxy:latest", "networks": {"backend": {"aliases": ["web"]}, "frontend": {}}}`))}
+	Tick(context.Background(), dockerClient, consulClient, bootState, &consul.DirectoryState{KVs: []consul.KV{proxyKV}})
+
+	if !global.Machine.IsCurrently(global.Running) {
+		t.Errorf("Expected machine to be %s but was %v", global.Running, global.Machine.CurrentState)
+	}
+
+	expected := "create backend, run proxy, remove old"
+
+	if strings.Join(events, ", ") != expected {
+		t.Errorf("Expected %s but got %s", expected, strings.Join(events, ", "))
+	}
+}
+
+func TestTickRejectsChangedNetworks(t *testing.T) {
+	global.Machine.ForceTransition(global.Booted, nil)
+	defer global.Machine.ForceTransition(global.Initial, nil)
+
+	var startedContainers []string
+	var stoppedContainers []string
+	var created []string
+	dockerClient := dockerClient(&startedContainers, &stoppedContainers)
+	dockerClient.RunningContainersResponse = func() ([]container.Container, error) {
+		return []container.Container{container.Container{Name: "consul"}, container.Container{Name: "statsite"}}, nil
+	}
+	dockerClient.NetworksResponse = func() ([]docker.Network, error) {
+		return []docker.Network{docker.Network{Name: "backend", Driver: "bridge", Managed: true}}, nil
+	}
+	dockerClient.CreateNetworkResponse = func(n docker.Network) error {
+		created = append(created, n.Name)
+		return nil
+	}
+
+	var registeredServices []string
+	var deregisteredServices []string
+	consulClient := consulClient(&registeredServices, &deregisteredServices)
+	consulClient.RegisteredServicesResponse = func() (string, error) {
+		return `{"consul":{"ID":"consul","Service":"consul","Tags":[],"Address":"","Port":0},"statsite":{"ID":"statsite","Service":"statsite","Tags":null,"Address":"","Port":0}}`, nil
+	}
+
+	bootState := bootState()
+	bootState.Networks = map[string]*docker.Network{"backend": &docker.Network{Name: "backend", Internal: true}}
+
+	proxyKV := consul.KV{Key: "_wakeful/nodes/981eb8e33da95184/services/proxy", Value: base64.StdEncoding.EncodeToString([]byte(`{"image": "plum/wake-proxy:latest", "networks": {"backend": {}}}`))}
+	Tick(context.Background(), dockerClient, consulClient, bootState, &consul.DirectoryState{KVs: []consul.KV{proxyKV}})
+
+	if global.Machine.IsCurrently(global.Running) {
+		t.Fatal("Expected the tick to fail on a network which can't be changed in place")
+	}
+
+	if !strings.Contains(global.Machine.CurrentState.Error.Error(), "network 'backend' exists with driver bridge and internal false") {
+		t.Errorf("Expected the error to name the network but was %v", global.Machine.CurrentState.Error)
+	}
+
+	if len(created) != 0 || len(startedContainers) != 0 {
+		t.Errorf("Expected nothing to change but created %v and started %v", created, startedContainers)
+	}
+}
+
+func TestTickLeavesExitedContainersAlone(t *testing.T) {
+	global.Machine.ForceTransition(global.Booted, nil)
+	defer global.Machine.ForceTransition(global.Initial, nil)
+
+	migrate := service.Service{Name: "migrate", Image: "plum/migrate:latest", Restart: "no"}.Container("", "127.0.0.1")
+
+	var startedContainers []string
+	var stoppedContainers []string
+	dockerClient := dockerClient(&startedContainers, &stoppedContainers)
+	dockerClient.RunningContainersResponse = func() ([]container.Container, error) {
+		return []container.Container{
+			container.Container{Name: "consul", Image: "plum/wake-consul-agent:latest"},
+			container.Container{Name: "statsite", Image: "plum/wake-statsite:latest"},
+			container.Container{ID: "abc", Name: "migrate", Image: "plum/migrate:latest", Labels: docker.Labels(migrate), State: "exited"},
+		}, nil
+	}
+	dockerClient.InspectResponse = func(c container.Container) (container.Container, error) {
+		if c.Name != "migrate" {
+			return inspected(c), nil
+		}
+
+		c.ExitCode = 0
+		c.Restart = "no"
+		return c, nil
+	}
+
+	var registeredServices []string
+	var deregisteredServices []string
+	consulClient := consulClient(&registeredServices, &deregisteredServices)
+	consulClient.RegisteredServicesResponse = func() (string, error) {
+		return `{"consul":{"ID":"consul","Service":"consul","Tags":[],"Address":"","Port":0},"statsite":{"ID":"statsite","Service":"statsite","Tags":null,"Address":"","Port":0},"migrate":{"ID":"migrate","Service":"migrate","Tags":null,"Address":"","Port":0}}`, nil
+	}
+
+	// {"image":"plum/migrate:latest","restart":"no"}
+	migrateKV := consul.KV{Key: "_wakeful/nodes/981eb8e33da95184/services/migrate", Value: "eyJpbWFnZSI6InBsdW0vbWlncmF0ZTpsYXRlc3QiLCJyZXN0YXJ0Ijoibm8ifQ=="}
+
+	Tick(context.Background(), dockerClient, consulClient, bootState(), &consul.DirectoryState{KVs: []consul.KV{migrateKV}})
+
+	if !global.Machine.IsCurrently(global.Running) {
+		t.Errorf("Expected machine to be %s but was %v", global.Running, global.Machine.CurrentState)
+	}
+
+	if len(startedContainers) != 0 || len(stoppedContainers) != 0 {
+		t.Errorf("Expected the exited migrate container to be left alone but started %v and stopped %v", startedContainers, stoppedContainers)
+	}
+
+	report := currentStatus.Report()
+
+	if len(report.Services) != 3 || report.Services[1].Name != "migrate" || report.Services[1].Status != ServiceExited {
+		t.Errorf("Expected migrate to be reported as exited but got %v", report.Services)
+	}
+}
+
+func TestTickStartsStoppedContainersAgain(t *testing.T) {
+	global.Machine.ForceTransition(global.Booted, nil)
+	defer global.Machine.ForceTransition(global.Initial, nil)
+
+	worker := service.Service{Name: "worker", Image: "plum/worker:latest"}.Container("", "127.0.0.1")
+	web := service.Service{Name: "web", Image: "plum/web:latest"}.Container("", "127.0.0.1")
+
+	var startedContainers []string
+	var stoppedContainers []string
+	dockerClient := dockerClient(&startedContainers, &stoppedContainers)
+	dockerClient.RunningContainersResponse = func() ([]container.Container, error) {
+		return []container.Container{
+			container.Container{Name: "consul", Image: "plum/wake-consul-agent:latest"},
+			container.Container{Name: "statsite", Image: "plum/wake-statsite:latest"},
+			container.Container{ID: "abc", Name: "worker", Image: "plum/worker:latest", Labels: docker.Labels(worker), State: "exited"},
+			container.Container{ID: "def", Name: "web", Image: "plum/web:latest", Labels: docker.Labels(web), State: "created"},
+		}, nil
+	}
+	dockerClient.InspectResponse = func(c container.Container) (container.Container, error) {
+		if c.Name != "worker" && c.Name != "web" {
+			return inspected(c), nil
+		}
+
+		c.Restart = "always"
+		return c, nil
+	}
+
+	var registeredServices []string
+	var deregisteredServices []string
+	consulClient := consulClient(&registeredServices, &deregisteredServices)
+	consulClient.RegisteredServicesResponse = func() (string, error) {
+		return `{"consul":{"ID":"consul","Service":"consul","Tags":[],"Address":"","Port":0},"statsite":{"ID":"statsite","Service":"statsite","Tags":null,"Address":"","Port":0},"worker":{"ID":"worker","Service":"worker","Tags":null,"Address":"","Port":0},"web":{"ID":"web","Service":"web","Tags":null,"Address":"","Port":0}}`, nil
+	}
+
+	// {"image":"plum/worker:latest"} and {"image":"plum/web:latest"}
+	workerKV := consul.KV{Key: "_wakeful/nodes/981eb8e33da95184/services/worker", Value: "eyJpbWFnZSI6InBsdW0vd29ya2VyOmxhdGVzdCJ9"}
+	webKV := consul.KV{Key: "_wakeful/nodes/981eb8e33da95184/services/web", Value: "eyJpbWFnZSI6InBsdW0vd2ViOmxhdGVzdCJ9"}
+
+	Tick(context.Background(), dockerClient, consulClient, bootState(), &consul.DirectoryState{KVs: []consul.KV{workerKV, webKV}})
+
+	if !global.Machine.IsCurrently(global.Running) {
+		t.Errorf("Expected machine to be %s but was %v", global.Running, global.Machine.CurrentState)
+	}
+
+	sort.Strings(startedContainers)
+	sort.Strings(stoppedContainers)
+
+	if strings.Join(startedContainers, ",") != "web,worker" || strings.Join(stoppedContainers, ",") != "web,worker" {
+		t.Errorf("Expected the stopped containers to be recreated but started %v and stopped %v", startedContainers, stoppedContainers)
+	}
+}
+
+func TestTickLeavesInvalidServicesAlone(t *testing.T) {
+	global.Machine.ForceTransition(global.Booted, nil)
+	defer global.Machine.ForceTransition(global.Initial, nil)
+
+	var startedContainers []string
+	var stoppedContainers []string
+	dockerClient := dockerClient(&startedContainers, &stoppedContainers)
+	dockerClient.RunningContainersResponse = func() ([]container.Container, error) {
+		return []container.Container{
+			container.Container{Name: "consul", Image: "plum/wake-consul-agent:latest"},
+			container.Container{Name: "statsite", Image: "plum/wake-statsite:latest"},
+			container.Container{Name: "proxy", Image: "plum/wake-proxy:latest", Labels: managed("proxy")},
+		}, nil
+	}
+
+	var registeredServices []string
+	var deregisteredServices []string
+	consulClient := consulClient(&registeredServices, &deregisteredServices)
+	consulClient.RegisteredServicesResponse = func() (string, error) {
+		return `{"consul":{"ID":"consul","Service":"consul","Tags":[],"Address":"","Port":0},"statsite":{"ID":"statsite","Service":"statsite","Tags":null,"Address":"","Port":0}, "proxy":{"ID":"proxy","Service":"proxy","Tags":[],"Address":"","Port":8000}}`, nil
+	}
+
+	putKeys := make(map[string]string)
+	var deletedKeys []string
+	consulClient.PutKeyResponse = func(key string, value string) error {
+		putKeys[key] = value
+		return nil
+	}
+	consulClient.DeleteKeyResponse = func(key string) error {
+		deletedKeys = append(deletedKeys, key)
+		return nil
+	}
+
+	defer func() { reportedInvalid = make(map[string]string) }()
+
+	// {"image":"plum/wake-proxy:latest","prots":[]}
+	proxyKV := consul.KV{Key: "_wakeful/nodes/981eb8e33da95184/services/proxy", Value: "eyJpbWFnZSI6InBsdW0vd2FrZS1wcm94eTpsYXRlc3QiLCJwcm90cyI6W119"}
+	directoryState := &consul.DirectoryState{KVs: []consul.KV{proxyKV}}
+
+	bootState := bootState()
+	bootState.NodeName = "981eb8e33da95184"
+	dockerClient.InspectResponse = func(c container.Container) (container.Container, error) {
+		return inspectedIn(bootState, c), nil
+	}
+
+	Tick(context.Background(), dockerClient, consulClient, bootState, directoryState)
+
+	if !global.Machine.IsCurrently(global.Running) {
+		t.Errorf("Expected machine to be %s but was %v", global.Running, global.Machine.CurrentState)
+	}
+
+	if len(stoppedContainers) != 0 {
+		t.Errorf("Expected the invalid proxy to be left running but %v were stopped", stoppedContainers)
+	}
+
+	if len(deregisteredServices) != 0 {
+		t.Errorf("Expected the invalid proxy to stay registered but %v were deregistered", deregisteredServices)
+	}
+
+	if !strings.Contains(putKeys["_wakeful/nodes/981eb8e33da95184/invalid/proxy"], `unknown field \"prots\"`) {
+		t.Errorf("Expected the invalid proxy to be written back to consul but got %v", putKeys)
+	}
+
+	report := currentStatus.Report()
+
+	if len(report.Services) != 3 || report.Services[1].Name != "proxy" || report.Services[1].Status != ServiceInvalid {
+		t.Errorf("Expected the proxy to be reported as invalid but got %v", report.Services)
+	}
+
+	// {"image":"plum/wake-proxy:latest"}
+	proxyKV.Value = "eyJpbWFnZSI6InBsdW0vd2FrZS1wcm94eTpsYXRlc3QifQ=="
+	directoryState = &consul.DirectoryState{KVs: []consul.KV{proxyKV}}
+
+	Tick(context.Background(), dockerClient, consulClient, bootState, directoryState)
+
+	if len(deletedKeys) != 1 || deletedKeys[0] != "_wakeful/nodes/981eb8e33da95184/invalid/proxy" {
+		t.Errorf("Expected the invalid key to be deleted once the proxy was fixed but got %v", deletedKeys)
+	}
+}
+
+func TestSuccessfulTickWithDrift(t *testing.T) {
+	global.Machine.ForceTransition(global.Booted, nil)
+	defer global.Machine.ForceTransition(global.Initial, nil)
+
+	var startedContainers []string
+	var stoppedContainers []string
+	dockerClient := dockerClient(&startedContainers, &stoppedContainers)
+	dockerClient.RunningContainersResponse = func() ([]container.Container, error) {
+		return []container.Container{
+			container.Container{Name: "consul"},
+			container.Container{Name: "statsite", Labels: managed("statsite")},
+		}, nil
+	}
+	dockerClient.InspectResponse = func(c container.Container) (container.Container, error) {
+		c = inspected(c)
+
+		if c.Name == "statsite" {
+			c.Image = "plum/wake-statsite:old"
+		}
+
+		return c, nil
+	}
+	dockerClient.RemoveVolumesResponse = func(name string) error {
+		t.Errorf("Expected volumes to be kept when recreating but removed those of %s", name)
+		return nil
+	}
+
+	var registeredServices []string
+	var deregisteredServices []string
+	consulClient := consulClient(&registeredServices, &deregisteredServices)
+	consulClient.RegisteredServicesResponse = func() (string, error) {
+		return `{"consul":{"ID":"consul","Service":"consul","Tags":[],"Address":"","Port":0},"statsite":{"ID":"statsite","Service":"statsite","Tags":null,"Address":"","Port":0}}`, nil
+	}
+
+	Tick(context.Background(), dockerClient, consulClient, bootState(), &consul.DirectoryState{})
+
+	if !global.Machine.IsCurrently(global.Running) {
+		t.Errorf("Expected machine to be %s but was %v", global.Running, global.Machine.CurrentState)
+	}
+
+	if len(stoppedContainers) != 1 || stoppedContainers[0] != "statsite" {
+		t.Errorf("Expected statsite to be stopped but stopped %v", stoppedContainers)
+	}
+
+	if len(startedContainers) != 1 || startedContainers[0] != "statsite" {
+		t.Errorf("Expected statsite to be started but started %v", startedContainers)
+	}
+}
+
+func TestTickLeavesUnlabeledContainersAlone(t *testing.T) {
+	global.Machine.ForceTransition(global.Booted, nil)
+	defer global.Machine.ForceTransition(global.Initial, nil)
+
+	var startedContainers []string
+	var stoppedContainers []string
+	dockerClient := dockerClient(&startedContainers, &stoppedContainers)
+	dockerClient.RunningContainersResponse = func() ([]container.Container, error) {
+		return []container.Container{
+			container.Container{Name: "consul"},
+			container.Container{Name: "statsite", Image: "plum/wake-statsite:old"},
+			container.Container{Name: "proxy", Image: "plum/wake-proxy:latest", State: "exited"},
+		}, nil
+	}
+	var registeredServices []string
+	var deregisteredServices []string
+	consulClient := consulClient(&registeredServices, &deregisteredServices)
+	consulClient.RegisteredServicesResponse = func() (string, error) {
+		return `{"consul":{"ID":"consul","Service":"consul","Tags":[],"Address":"","Port":0},"statsite":{"ID":"statsite","Service":"statsite","Tags":null,"Address":"","Port":0},"proxy":{"ID":"proxy","Service":"proxy","Tags":null,"Address":"","Port":0}}`, nil
+	}
+
+	desiredState := bootState()
+	desiredState.Services["proxy"] = &service.Service{Name: "proxy", Image: "plum/wake-proxy:latest"}
+
+	Tick(context.Background(), dockerClient, consulClient, desiredState, &consul.DirectoryState{})
+
+	if !global.Machine.IsCurrently(global.Running) {
+		t.Errorf("Expected machine to be %s but was %v", global.Running, global.Machine.CurrentState)
+	}
+
+	if len(stoppedContainers) != 0 || len(startedContainers) != 0 {
+		t.Errorf("Expected unlabeled containers to be left alone but stopped %v and started %v", stoppedContainers, startedContainers)
+	}
+}
+
+func TestTickKeepsContainerWhenPullFails(t *testing.T) {
+	global.Machine.ForceTransition(global.Booted, nil)
+	defer global.Machine.ForceTransition(global.Initial, nil)
+	defer func() { serviceRetries = make(map[string]*serviceRetry) }()
+
+	var startedContainers []string
+	var stoppedContainers []string
+	var pulled []container.Container
+	dockerClient := dockerClient(&startedContainers, &stoppedContainers)
+	dockerClient.RunningContainersResponse = func() ([]container.Container, error) {
+		return []container.Container{
+			container.Container{Name: "consul"},
+			container.Container{Name: "statsite", Image: "registry:5000/statsite", Labels: managed("statsite")},
+		}, nil
+	}
+	dockerClient.PullResponse = func(c container.Container) error {
+		pulled = append(pulled, c)
+		return errors.New("unauthorized")
+	}
+
+	var registeredServices []string
+	var deregisteredServices []string
+	consulClient := consulClient(&registeredServices, &deregisteredServices)
+	consulClient.RegisteredServicesResponse = func() (string, error) {
+		return `{"consul":{"ID":"consul","Service":"consul","Tags":[],"Address":"","Port":0},"statsite":{"ID":"statsite","Service":"statsite","Tags":null,"Address":"","Port":0}}`, nil
+	}
+	consulClient.GetKeyResponse = func(key string) (string, error) {
+		return `{"registry:5000": {"username": "deploy", "password": "s3cret"}}`, nil
+	}
+
+	bootState := bootState()
+	bootState.RegistriesKey = "_wakeful/registries"
+	bootState.Services["statsite"] = &service.Service{Name: "statsite", Image: "registry:5000/statsite", ImagePullPolicy: container.PullAlways}
+
+	Tick(context.Background(), dockerClient, consulClient, bootState, &consul.DirectoryState{})
+
+	if !global.Machine.IsCurrently(global.NormalizingFailed) {
+		t.Errorf("Expected machine to be %s but was %v", global.NormalizingFailed, global.Machine.CurrentState)
+	}
+
+	if len(pulled) != 1 || pulled[0].Auth == nil || pulled[0].Auth.Username != "deploy" {
+		t.Errorf("Expected statsite to be pulled with the credentials from consul but pulled %v", pulled)
+	}
+
+	if len(stoppedContainers) != 0 || len(startedContainers) != 0 {
+		t.Errorf("Expected statsite to be left running but stopped %v and started %v", stoppedContainers, startedContainers)
+	}
+}
+
+func TestSuccessfulTickWithUpgrade(t *testing.T) {
+	global.Machine.ForceTransition(global.Booted, nil)
+	defer global.Machine.ForceTransition(global.Initial, nil)
+
+	docker.UpgradePollInterval = time.Millisecond
+	defer func() { docker.UpgradePollInterval = time.Second }()
+
+	var startedContainers []string
+	var stoppedContainers []string
+	dockerClient := dockerClient(&startedContainers, &stoppedContainers)
+	dockerClient.RunningContainersResponse = func() ([]container.Container, error) {
+		return []container.Container{
+			container.Container{Name: "consul"},
+			container.Container{Name: "statsite", Image: "plum/wake-statsite:old", Labels: managed("statsite")},
+		}, nil
+	}
+	dockerClient.InspectResponse = func(c container.Container) (container.Container, error) {
+		c = inspected(c)
+		c.State = "running"
+		c.Health = "healthy"
+		return c, nil
+	}
+
+	var registeredServices []string
+	var deregisteredServices []string
+	consulClient := consulClient(&registeredServices, &deregisteredServices)
+	consulClient.RegisteredServicesResponse = func() (string, error) {
+		return `{"consul":{"ID":"consul","Service":"consul","Tags":[],"Address":"","Port":0},"statsite":{"ID":"statsite","Service":"statsite","Tags":null,"Address":"","Port":0}}`, nil
+	}
+
+	bootState := bootState()
+	bootState.Services["statsite"].Image = "plum/wake-statsite:new"
+
+	Tick(context.Background(), dockerClient, consulClient, bootState, &consul.DirectoryState{})
+
+	if !global.Machine.IsCurrently(global.Running) {
+		t.Errorf("Expected machine to be %s but was %v", global.Running, global.Machine.CurrentState)
+	}
+
+	expected := []string{"statsite-next", "statsite"}
+
+	if strings.Join(startedContainers, ",") != strings.Join(expected, ",") {
+		t.Errorf("Expected %v to be started but started %v", expected, startedContainers)
+	}
+
+	if strings.Join(stoppedContainers, ",") != strings.Join(expected, ",") {
+		t.Errorf("Expected %v to be stopped but stopped %v", expected, stoppedContainers)
+	}
+}
+
+func TestTickUpgradeWaitsForConsulChecks(t *testing.T) {
+	global.Machine.ForceTransition(global.Booted, nil)
+	defer global.Machine.ForceTransition(global.Initial, nil)
+	defer func() {
+		failedUpgrades = make(map[string]failedUpgrade)
+		global.KeepServices(nil)
+	}()
+
+	docker.UpgradePollInterval = time.Millisecond
+	docker.UpgradeTimeout = 50 * time.Millisecond
+	defer func() {
+		docker.UpgradePollInterval = time.Second
+		docker.UpgradeTimeout = time.Minute
+	}()
+
+	var startedContainers []string
+	var stoppedContainers []string
+	dockerClient := dockerClient(&startedContainers, &stoppedContainers)
+	dockerClient.RunningContainersResponse = func() ([]container.Container, error) {
+		return []container.Container{
+			container.Container{Name: "consul"},
+			container.Container{Name: "statsite", Image: "plum/wake-statsite:old", Labels: managed("statsite")},
+		}, nil
+	}
+	dockerClient.InspectResponse = func(c container.Container) (container.Container, error) {
+		c = inspected(c)
+		c.State = "running"
+		c.Health = "healthy"
+		return c, nil
+	}
+
+	var registeredServices []string
+	var deregisteredServices []string
+	consulClient := consulClient(&registeredServices, &deregisteredServices)
+	consulClient.RegisteredServicesResponse = func() (string, error) {
+		return `{"consul":{"ID":"consul","Service":"consul","Tags":[],"Address":"","Port":0},"statsite":{"ID":"statsite","Service":"statsite","Tags":null,"Address":"","Port":0}}`, nil
+	}
+
+	checkStatus := "critical"
+	consulClient.ChecksResponse = func() (string, error) {
+		return `{"service:statsite":{"CheckID":"service:statsite","ServiceID":"statsite","Status":"` + checkStatus + `"}}`, nil
+	}
+
+	bootState := bootState()
+	bootState.Services["statsite"].Image = "plum/wake-statsite:new"
+	bootState.Services["statsite"].Checks = []service.Check{service.Check{TCP: "localhost:8125", Interval: "1ms"}}
+
+	Tick(context.Background(), dockerClient, consulClient, bootState, &consul.DirectoryState{})
+
+	// docker says the candidate and the new container are healthy, but
+	// the checks never pass, so the old container is run again
+
+	expected := []string{"statsite-next", "statsite", "statsite"}
+
+	if strings.Join(startedContainers, ",") != strings.Join(expected, ",") {
+		t.Errorf("Expected %v to be started but started %v", expected, startedContainers)
+	}
+
+	if state := global.ServiceState("statsite"); !state.Equal(global.ServiceUpgradeFailed) {
+		t.Errorf("Expected statsite to be %s but was %v", global.ServiceUpgradeFailed, state)
+	}
+
+	if !global.Machine.IsCurrently(global.Running) {
+		t.Errorf("Expected machine to be %s but was %v", global.Running, global.Machine.CurrentState)
+	}
+
+	// a new spec is tried again, and goes through once the checks pass
+
+	checkStatus = consul.CheckPassing
+	startedContainers = nil
+	bootState.Services["statsite"].Image = "plum/wake-statsite:newer"
+
+	Tick(context.Background(), dockerClient, consulClient, bootState, &consul.DirectoryState{})
+
+	expected = []string{"statsite-next", "statsite"}
+
+	if strings.Join(startedContainers, ",") != strings.Join(expected, ",") {
+		t.Errorf("Expected %v to be started but started %v", expected, startedContainers)
+	}
+
+	if state := global.ServiceState("statsite"); !state.Equal(global.ServiceRunning) {
+		t.Errorf("Expected statsite to be %s but was %v", global.ServiceRunning, state)
+	}
+}
+
+func TestTickUpgradesServicesWithNamedVolumesInPlace(t *testing.T) {
+	global.Machine.ForceTransition(global.Booted, nil)
+	defer global.Machine.ForceTransition(global.Initial, nil)
+
+	docker.UpgradePollInterval = time.Millisecond
+	defer func() { docker.UpgradePollInterval = time.Second }()
+
+	var startedContainers []string
+	var stoppedContainers []string
+	dockerClient := dockerClient(&startedContainers, &stoppedContainers)
+	dockerClient.RunningContainersResponse = func() ([]container.Container, error) {
+		return []container.Container{
+			container.Container{Name: "consul"},
+			container.Container{Name: "statsite", Image: "plum/wake-statsite:old", Labels: managed("statsite")},
+		}, nil
+	}
+	dockerClient.InspectResponse = func(c container.Container) (container.Container, error) {
+		c = inspected(c)
+		c.State = "running"
+		c.Health = "healthy"
+		return c, nil
+	}
+
+	var registeredServices []string
+	var deregisteredServices []string
+	consulClient := consulClient(&registeredServices, &deregisteredServices)
+	consulClient.RegisteredServicesResponse = func() (string, error) {
+		return `{"consul":{"ID":"consul","Service":"consul","Tags":[],"Address":"","Port":0},"statsite":{"ID":"statsite","Service":"statsite","Tags":null,"Address":"","Port":0}}`, nil
+	}
+
+	bootState := bootState()
+	bootState.Services["statsite"].Image = "plum/wake-statsite:new"
+	bootState.Services["statsite"].Volumes = []service.Volume{service.Volume{Source: "statsite-data", Target: "/data"}}
+
+	Tick(context.Background(), dockerClient, consulClient, bootState, &consul.DirectoryState{})
+
+	if !global.Machine.IsCurrently(global.Running) {
+		t.Errorf("Expected machine to be %s but was %v", global.Running, global.Machine.CurrentState)
+	}
+
+	if strings.Join(startedContainers, ",") != "statsite" || strings.Join(stoppedContainers, ",") != "statsite" {
+		t.Errorf("Expected statsite to be replaced without a candidate but started %v and stopped %v", startedContainers, stoppedContainers)
+	}
+}
+
+func TestTickUpgradesWithoutCandidateAliasesOrHostPorts(t *testing.T) {
+	global.Machine.ForceTransition(global.Booted, nil)
+	defer global.Machine.ForceTransition(global.Initial, nil)
+
+	docker.UpgradePollInterval = time.Millisecond
+	defer func() { docker.UpgradePollInterval = time.Second }()
+
+	var startedContainers []string
+	var stoppedContainers []string
+	var started []container.Container
+	dockerClient := dockerClient(&startedContainers, &stoppedContainers)
+	dockerClient.RunningContainersResponse = func() ([]container.Container, error) {
+		return []container.Container{
+			container.Container{Name: "consul", Image: "plum/wake-consul-agent:old", Labels: managed("consul")},
+			container.Container{Name: "statsite", Image: "plum/wake-statsite:old", Labels: managed("statsite")},
+		}, nil
+	}
+	dockerClient.InspectResponse = func(c container.Container) (container.Container, error) {
+		c.State = "running"
+		c.Health = "healthy"
+		return c, nil
+	}
+	dockerClient.RunResponse = func(c container.Container) error {
+		started = append(started, c)
+		return nil
 	}
 
 	var registeredServices []string
 	var deregisteredServices []string
 	consulClient := consulClient(&registeredServices, &deregisteredServices)
 	consulClient.RegisteredServicesResponse = func() (string, error) {
-		return `{"consul":{"ID":"consul","Service":"consul","Tags":[],"Address":"","Port":8300},"statsite":{"ID":"statsite","Service":"statsite","Tags":null,"Address":"10.1.0.9","Port":0}, "proxy":{"ID":"proxy","Service":"proxy","Tags":[],"Address":"","Port":8000}}`, nil
+		return `{"consul":{"ID":"consul","Service":"consul","Tags":[],"Address":"","Port":0},"statsite":{"ID":"statsite","Service":"statsite","Tags":null,"Address":"","Port":0}}`, nil
 	}
 
 	bootState := bootState()
-	directoryState := &consul.DirectoryState{}
+	bootState.Networks = map[string]*docker.Network{"backend": &docker.Network{Name: "backend"}}
+	bootState.Services["consul"].Image = "plum/wake-consul-agent:new"
+	bootState.Services["consul"].NetworkMode = "host"
+	bootState.Services["statsite"].Image = "plum/wake-statsite:new"
+	bootState.Services["statsite"].Networks = map[string]service.NetworkAttachment{"backend": service.NetworkAttachment{Aliases: []string{"stats"}}}
 
-	bootStateServicesNamesBefore := bootStateServicesNames(*bootState)
-	Tick(dockerClient, consulClient, bootState, directoryState)
-	bootStateServicesNamesAfter := bootStateServicesNames(*bootState)
+	Tick(context.Background(), dockerClient, consulClient, bootState, &consul.DirectoryState{})
 
 	if !global.Machine.IsCurrently(global.Running) {
 		t.Errorf("Expected machine to be %s but was %v", global.Running, global.Machine.CurrentState)
 	}
 
-	if len(bootStateServicesNamesBefore) != len(bootStateServicesNamesAfter) {
-		t.Errorf("Expected bootstate to remain the same: before=%v after=%v", bootStateServicesNamesBefore, bootStateServicesNamesAfter)
+	var names []string
+
+	for _, c := range started {
+		names = append(names, c.Name)
+
+		if c.Name == "statsite-next" && (len(c.Networks) != 1 || len(c.Networks[0].Aliases) != 0) {
+			t.Errorf("Expected the candidate to join backend without aliases but joined %v", c.Networks)
+		}
+	}
+
+	sort.Strings(names)
+
+	if strings.Join(names, ",") != "consul,statsite,statsite-next" {
+		t.Errorf("Expected consul to be upgraded without a candidate but started %v", names)
+	}
+}
+
+func TestTickUpgradesWhenAnAlwaysPulledTagMoves(t *testing.T) {
+	global.Machine.ForceTransition(global.Booted, nil)
+	defer global.Machine.ForceTransition(global.Initial, nil)
+
+	docker.UpgradePollInterval = time.Millisecond
+	defer func() { docker.UpgradePollInterval = time.Second }()
+
+	var registeredServices []string
+	var deregisteredServices []string
+	consulClient := consulClient(&registeredServices, &deregisteredServices)
+	consulClient.RegisteredServicesResponse = func() (string, error) {
+		return `{"consul":{"ID":"consul","Service":"consul","Tags":[],"Address":"","Port":0},"statsite":{"ID":"statsite","Service":"statsite","Tags":null,"Address":"","Port":0}}`, nil
+	}
+
+	bootState := bootState()
+	bootState.Services["statsite"].Image = "plum/wake-statsite:latest"
+	bootState.Services["statsite"].ImagePullPolicy = container.PullAlways
+	statsite, _ := findContainer(stateContainers(bootState, consulClient), "statsite")
+
+	var startedContainers []string
+	var stoppedContainers []string
+	var pulled []string
+	dockerClient := dockerClient(&startedContainers, &stoppedContainers)
+	dockerClient.RunningContainersResponse = func() ([]container.Container, error) {
+		return []container.Container{
+			container.Container{Name: "consul"},
+			container.Container{Name: "statsite", Image: "plum/wake-statsite:latest", Labels: docker.Labels(statsite)},
+		}, nil
+	}
+	dockerClient.InspectResponse = func(c container.Container) (container.Container, error) {
+		c = inspected(c)
+		c.State = "running"
+		c.Health = "healthy"
+		c.ImageID = "sha256:old"
+		return c, nil
+	}
+	dockerClient.PullResponse = func(c container.Container) error {
+		pulled = append(pulled, c.Image)
+		return nil
+	}
+	dockerClient.ImageIDResponse = func(image string) (string, error) {
+		return "sha256:new", nil
+	}
+
+	docker.PullInterval = 0
+	defer func() { docker.PullInterval = 5 * time.Minute }()
+
+	Tick(context.Background(), dockerClient, consulClient, bootState, &consul.DirectoryState{})
+
+	if !global.Machine.IsCurrently(global.Running) {
+		t.Errorf("Expected machine to be %s but was %v", global.Running, global.Machine.CurrentState)
+	}
+
+	if len(pulled) != 1 {
+		t.Errorf("Expected the image to be pulled once, and not again by the upgrade, but pulled %v", pulled)
+	}
+
+	if strings.Join(startedContainers, ",") != "statsite-next,statsite" {
+		t.Errorf("Expected statsite to be upgraded to the new image but started %v", startedContainers)
+	}
+
+	startedContainers = nil
+	pulled = nil
+	docker.PullInterval = time.Hour
+	dockerClient.ImageIDResponse = func(image string) (string, error) {
+		return "sha256:old", nil
 	}
 
+	Tick(context.Background(), dockerClient, consulClient, bootState, &consul.DirectoryState{})
+
 	if len(startedContainers) != 0 {
-		t.Errorf("Expected docker start to be called %d times but was called %d times", 0, len(startedContainers))
+		t.Errorf("Expected statsite to be left alone while its image is the same but started %v", startedContainers)
 	}
 
-	if len(stoppedContainers) != 1 {
-		t.Errorf("Expected docker stop to be called %d times but was called %d times", 1, len(stoppedContainers))
+	if len(pulled) != 0 {
+		t.Errorf("Expected the image not to be pulled again within the pull interval but pulled %v", pulled)
 	}
+}
 
-	if len(registeredServices) != 0 {
-		t.Errorf("Expected to register %d services but %d were registered", 0, len(registeredServices))
+func TestFailedTickWithUpgrade(t *testing.T) {
+	global.Machine.ForceTransition(global.Booted, nil)
+	defer global.Machine.ForceTransition(global.Initial, nil)
+	defer func() {
+		failedUpgrades = make(map[string]failedUpgrade)
+		global.KeepServices(nil)
+	}()
+
+	docker.UpgradePollInterval = time.Millisecond
+	defer func() { docker.UpgradePollInterval = time.Second }()
+
+	var startedContainers []string
+	var stoppedContainers []string
+	dockerClient := dockerClient(&startedContainers, &stoppedContainers)
+	dockerClient.RunningContainersResponse = func() ([]container.Container, error) {
+		return []container.Container{
+			container.Container{Name: "consul"},
+			container.Container{Name: "statsite", Image: "plum/wake-statsite:old", Labels: managed("statsite")},
+		}, nil
+	}
+	dockerClient.InspectResponse = func(c container.Container) (container.Container, error) {
+		c = inspected(c)
+		c.State = "running"
+		c.Health = "unhealthy"
+		return c, nil
 	}
 
-	if len(deregisteredServices) != 1 {
-		t.Errorf("Expected to deregister %d services but %d were deregistered", 1, len(deregisteredServices))
+	var registeredServices []string
+	var deregisteredServices []string
+	consulClient := consulClient(&registeredServices, &deregisteredServices)
+	consulClient.RegisteredServicesResponse = func() (string, error) {
+		return `{"consul":{"ID":"consul","Service":"consul","Tags":[],"Address":"","Port":0},"statsite":{"ID":"statsite","Service":"statsite","Tags":null,"Address":"","Port":0}}`, nil
+	}
+
+	var failureKeys []string
+	consulClient.PutKeyResponse = func(key string, value string) error {
+		if key != consul.StatusKey("") {
+			failureKeys = append(failureKeys, key)
+		}
+		return nil
+	}
+
+	bootState := bootState()
+	bootState.Services["statsite"].Image = "plum/wake-statsite:new"
+
+	Tick(context.Background(), dockerClient, consulClient, bootState, &consul.DirectoryState{})
+
+	if !global.Machine.IsCurrently(global.Running) {
+		t.Errorf("Expected machine to be %s but was %v", global.Running, global.Machine.CurrentState)
+	}
+
+	report := currentStatus.Report()
+
+	if len(report.Services) != 2 || report.Services[1].Name != "statsite" || report.Services[1].Status != ServiceFailed {
+		t.Errorf("Expected statsite to be reported as failed but got %v", report.Services)
+	}
+
+	if len(startedContainers) != 1 || startedContainers[0] != "statsite-next" {
+		t.Errorf("Expected only statsite-next to be started but started %v", startedContainers)
+	}
+
+	if len(stoppedContainers) != 1 || stoppedContainers[0] != "statsite-next" {
+		t.Errorf("Expected only statsite-next to be stopped but stopped %v", stoppedContainers)
+	}
+
+	if len(failureKeys) != 1 || failureKeys[0] != consul.FailureKey("", "statsite") {
+		t.Errorf("Expected the failure to be recorded in consul, but put %v", failureKeys)
+	}
+
+	if state := global.ServiceState("statsite"); !state.Equal(global.ServiceUpgradeFailed) || report.ServiceStates["statsite"] != "UpgradeFailed" {
+		t.Errorf("Expected statsite to be %s but was %v", global.ServiceUpgradeFailed, state)
+	}
+
+	// the same broken image should not be tried again on the next tick
+
+	Tick(context.Background(), dockerClient, consulClient, bootState, &consul.DirectoryState{})
+
+	if len(startedContainers) != 1 {
+		t.Errorf("Expected the failed upgrade to not be retried but started %v", startedContainers)
+	}
+
+	// and changing the image back clears the failure
+
+	bootState.Services["statsite"].Image = "plum/wake-statsite:old"
+	Tick(context.Background(), dockerClient, consulClient, bootState, &consul.DirectoryState{})
+
+	if state := global.ServiceState("statsite"); !state.Equal(global.ServiceRunning) {
+		t.Errorf("Expected statsite to be %s again but was %v", global.ServiceRunning, state)
+	}
+}
+
+func TestFailedTickWithUpgradeRollsBack(t *testing.T) {
+	global.Machine.ForceTransition(global.Booted, nil)
+	defer global.Machine.ForceTransition(global.Initial, nil)
+	defer func() {
+		failedUpgrades = make(map[string]failedUpgrade)
+		global.KeepServices(nil)
+	}()
+
+	docker.UpgradePollInterval = time.Millisecond
+	defer func() { docker.UpgradePollInterval = time.Second }()
+
+	var startedContainers []string
+	var stoppedContainers []string
+	var started []container.Container
+	dockerClient := dockerClient(&startedContainers, &stoppedContainers)
+	dockerClient.RunningContainersResponse = func() ([]container.Container, error) {
+		return []container.Container{
+			container.Container{Name: "consul"},
+			container.Container{Name: "statsite", Image: "plum/wake-statsite:old", Labels: managed("statsite")},
+		}, nil
+	}
+	dockerClient.RunResponse = func(c container.Container) error {
+		startedContainers = append(startedContainers, c.Name)
+		started = append(started, c)
+		return nil
+	}
+	// the candidate is healthy, but the new statsite isn't once it
+	// replaced the old one
+	dockerClient.InspectResponse = func(c container.Container) (container.Container, error) {
+		switch {
+		case c.Name == "statsite" && c.Image == "plum/wake-statsite:old":
+			return c, nil
+		case c.Name == "statsite":
+			c.State = "running"
+			c.Health = "unhealthy"
+		case c.Name == "statsite-next":
+			c.State = "running"
+			c.Health = "healthy"
+		default:
+			c = inspected(c)
+		}
+
+		return c, nil
+	}
+
+	var registeredServices []string
+	var deregisteredServices []string
+	consulClient := consulClient(&registeredServices, &deregisteredServices)
+	consulClient.RegisteredServicesResponse = func() (string, error) {
+		return `{"consul":{"ID":"consul","Service":"consul","Tags":[],"Address":"","Port":0},"statsite":{"ID":"statsite","Service":"statsite","Tags":null,"Address":"","Port":0}}`, nil
+	}
+
+	bootState := bootState()
+	bootState.Services["statsite"].Image = "plum/wake-statsite:new"
+
+	Tick(context.Background(), dockerClient, consulClient, bootState, &consul.DirectoryState{})
+
+	if !global.Machine.IsCurrently(global.Running) {
+		t.Errorf("Expected machine to be %s but was %v", global.Running, global.Machine.CurrentState)
+	}
+
+	expected := "statsite-next,statsite,statsite"
+
+	if strings.Join(startedContainers, ",") != expected || strings.Join(stoppedContainers, ",") != expected {
+		t.Errorf("Expected %s to be started and stopped but started %v and stopped %v", expected, startedContainers, stoppedContainers)
+	}
+
+	if len(started) != 3 || started[2].Image != "plum/wake-statsite:old" {
+		t.Errorf("Expected the old statsite to be run again but started %v", started)
+	}
+
+	if _, ok := failedUpgrades["statsite"]; !ok {
+		t.Errorf("Expected the failed upgrade to be remembered but was %v", failedUpgrades)
+	}
+}
+
+func TestSuccessfulTickWithReregister(t *testing.T) {
+	global.Machine.ForceTransition(global.Booted, nil)
+	defer global.Machine.ForceTransition(global.Initial, nil)
+
+	var startedContainers []string
+	var stoppedContainers []string
+	dockerClient := dockerClient(&startedContainers, &stoppedContainers)
+	dockerClient.RunningContainersResponse = func() ([]container.Container, error) {
+		return []container.Container{
+			container.Container{Name: "consul"},
+			container.Container{Name: "statsite"},
+		}, nil
+	}
+
+	var registeredServices []string
+	var deregisteredServices []string
+	consulClient := consulClient(&registeredServices, &deregisteredServices)
+	consulClient.RegisteredServicesResponse = func() (string, error) {
+		return `{"consul":{"ID":"consul","Service":"consul","Tags":[],"Address":"","Port":0},"statsite":{"ID":"statsite","Service":"statsite","Tags":["statsd"],"Address":"","Port":8125}}`, nil
+	}
+
+	bootState := bootState()
+	bootState.Services["statsite"].Tags = []string{"statsd", "udp"}
+	bootState.Services["statsite"].Ports = []service.PortPair{service.PortPair{Incoming: 8125, Outgoing: 8125, UDP: true}}
+	dockerClient.InspectResponse = func(c container.Container) (container.Container, error) {
+		return inspectedIn(bootState, c), nil
+	}
+
+	Tick(context.Background(), dockerClient, consulClient, bootState, &consul.DirectoryState{})
+
+	if !global.Machine.IsCurrently(global.Running) {
+		t.Errorf("Expected machine to be %s but was %v", global.Running, global.Machine.CurrentState)
+	}
+
+	if len(registeredServices) != 1 || registeredServices[0] != "statsite" {
+		t.Errorf("Expected statsite to be registered again, but registered %v", registeredServices)
+	}
+
+	if len(deregisteredServices) != 0 {
+		t.Errorf("Expected to deregister %d services but %d were deregistered", 0, len(deregisteredServices))
 	}
 }
 
@@ -128,14 +1102,14 @@ func TestFailedTickDockerFailed(t *testing.T) {
 	var startedContainers []string
 	var stoppedContainers []string
 	dockerClient := dockerClient(&startedContainers, &stoppedContainers)
-	dockerClient.RunningContainersResponse = func() (string, error) { return "", errors.New("Docker failed") }
+	dockerClient.RunningContainersResponse = func() ([]container.Container, error) { return nil, errors.New("Docker failed") }
 
 	var registeredServices []string
 	var deregisteredServices []string
 	consulClient := consulClient(&registeredServices, &deregisteredServices)
 	consulClient.RegisteredServicesResponse = func() (string, error) { return "", nil }
 
-	Tick(dockerClient, consulClient, bootState(), &consul.DirectoryState{})
+	Tick(context.Background(), dockerClient, consulClient, bootState(), &consul.DirectoryState{})
 
 	if !global.Machine.IsCurrently(global.FetchingNodeStateFailed) {
 		t.Errorf("Expected machine to be %s but was %v", global.FetchingNodeStateFailed, global.Machine.CurrentState)
@@ -158,6 +1132,79 @@ func TestFailedTickDockerFailed(t *testing.T) {
 	}
 }
 
+func TestFailedTickRunBacksOff(t *testing.T) {
+	global.Machine.ForceTransition(global.Booted, nil)
+	defer global.Machine.ForceTransition(global.Initial, nil)
+	defer func() { serviceRetries = make(map[string]*serviceRetry) }()
+
+	var startedContainers []string
+	var stoppedContainers []string
+	dockerClient := dockerClient(&startedContainers, &stoppedContainers)
+	dockerClient.RunResponse = func(c container.Container) error {
+		startedContainers = append(startedContainers, c.Name)
+		return errors.New("no such image")
+	}
+	dockerClient.RunningContainersResponse = func() ([]container.Container, error) {
+		return []container.Container{
+			container.Container{Name: "consul", Image: "plum/wake-consul-agent:latest"},
+			container.Container{Name: "statsite", Image: "plum/wake-statsite:latest"},
+		}, nil
+	}
+
+	var registeredServices []string
+	var deregisteredServices []string
+	consulClient := consulClient(&registeredServices, &deregisteredServices)
+	consulClient.RegisteredServicesResponse = func() (string, error) { return "", nil }
+
+	proxyKV := consul.KV{Key: "_wakeful/nodes/981eb8e33da95184/services/proxy", Value: "eyJpbWFnZSI6InBsdW0vd2FrZS1wcm94eTpsYXRlc3QiLCJ0YWdzIjpbXX0="}
+	directoryState := &consul.DirectoryState{KVs: []consul.KV{proxyKV}}
+
+	Tick(context.Background(), dockerClient, consulClient, bootState(), directoryState)
+	Tick(context.Background(), dockerClient, consulClient, bootState(), directoryState)
+
+	if !global.Machine.IsCurrently(global.NormalizingFailed) {
+		t.Errorf("Expected machine to be %s but was %v", global.NormalizingFailed, global.Machine.CurrentState)
+	}
+
+	if len(startedContainers) != 1 {
+		t.Errorf("Expected docker start to be called once and then backed off but was called %d times", len(startedContainers))
+	}
+
+	sort.Strings(registeredServices)
+
+	if strings.Join(registeredServices, ",") != "consul,statsite" {
+		t.Errorf("Expected the other services to be registered while proxy backs off but registered %v", registeredServices)
+	}
+
+	retry, ok := serviceRetries["proxy"]
+
+	if !ok || !retry.At.After(time.Now()) {
+		t.Errorf("Expected proxy to be waiting to be retried but was %v", retry)
+	}
+}
+
+func TestMergeErrorsKeepsEveryFailure(t *testing.T) {
+	waiting := docker.Errors{"proxy": errors.New("retrying later")}
+	upgradeErrs := upgradeErrors{
+		docker.UpgradeError{Name: "web", Image: "plum/web:2", Err: errors.New("container exited")},
+		errors.New("docker went away"),
+	}
+
+	errs := mergeErrors(waiting, errors.New("connection refused"), upgradeErrs)
+
+	for _, name := range []string{"proxy", "web", "(registering services)", "(upgrading)"} {
+		if _, ok := errs[name]; !ok {
+			t.Errorf("Expected an error for %s but got %v", name, errs)
+		}
+	}
+
+	errs = mergeErrors(docker.Errors{}, consul.Errors{"statsite": errors.New("500")}, nil)
+
+	if len(errs) != 1 || errs["statsite"] == nil {
+		t.Errorf("Expected the registration error of statsite but got %v", errs)
+	}
+}
+
 func TestFailedTickConsulFailed(t *testing.T) {
 	global.Machine.ForceTransition(global.Booted, nil)
 	defer global.Machine.ForceTransition(global.Initial, nil)
@@ -165,14 +1212,14 @@ func TestFailedTickConsulFailed(t *testing.T) {
 	var startedContainers []string
 	var stoppedContainers []string
 	dockerClient := dockerClient(&startedContainers, &stoppedContainers)
-	dockerClient.RunningContainersResponse = func() (string, error) { return "", nil }
+	dockerClient.RunningContainersResponse = func() ([]container.Container, error) { return nil, nil }
 
 	var registeredServices []string
 	var deregisteredServices []string
 	consulClient := consulClient(&registeredServices, &deregisteredServices)
 	consulClient.RegisteredServicesResponse = func() (string, error) { return "", errors.New("Consul Failed") }
 
-	Tick(dockerClient, consulClient, bootState(), &consul.DirectoryState{})
+	Tick(context.Background(), dockerClient, consulClient, bootState(), &consul.DirectoryState{})
 
 	if !global.Machine.IsCurrently(global.FetchingNodeStateFailed) {
 		t.Errorf("Expected machine to be %s but was %v", global.FetchingNodeStateFailed, global.Machine.CurrentState)
@@ -195,6 +1242,91 @@ func TestFailedTickConsulFailed(t *testing.T) {
 	}
 }
 
+func TestLoopTicksOnContainerEvents(t *testing.T) {
+	global.Machine.ForceTransition(global.Booted, nil)
+	defer global.Machine.ForceTransition(global.Initial, nil)
+
+	eventDelay = 20 * time.Millisecond
+	defer func() { eventDelay = 2 * time.Second }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var startedContainers []string
+	var stoppedContainers []string
+	dockerClient := dockerClient(&startedContainers, &stoppedContainers)
+	dockerClient.RunningContainersResponse = func() ([]container.Container, error) {
+		return []container.Container{
+			container.Container{Name: "consul", Image: "plum/wake-consul-agent:latest"},
+			container.Container{Name: "statsite", Image: "plum/wake-statsite:latest"},
+		}, nil
+	}
+
+	events := make(chan docker.Event)
+	dockerClient.EventsResponse = func() (<-chan docker.Event, error) {
+		return events, nil
+	}
+
+	var registeredServices []string
+	var deregisteredServices []string
+	consulClient := consulClient(&registeredServices, &deregisteredServices)
+	consulClient.RegisteredServicesResponse = func() (string, error) {
+		return `{"consul":{"ID":"consul","Service":"consul","Tags":[],"Address":"","Port":0},"statsite":{"ID":"statsite","Service":"statsite","Tags":null,"Address":"","Port":0}}`, nil
+	}
+
+	queried := false
+	consulClient.GetDirectoryStateResponse = func() (*consul.DirectoryState, error) {
+		if !queried {
+			queried = true
+			return &consul.DirectoryState{Index: 1}, nil
+		}
+
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+
+	// every tick ends by writing the status of the node
+	ticked := make(chan struct{}, 10)
+	consulClient.PutKeyResponse = func(key string, value string) error {
+		if key == consul.StatusKey("") {
+			ticked <- struct{}{}
+		}
+		return nil
+	}
+
+	done := make(chan struct{})
+
+	go func() {
+		Loop(ctx, dockerClient, consulClient, bootState())
+		close(done)
+	}()
+
+	expectTick := func(reason string) {
+		select {
+		case <-ticked:
+		case <-time.After(time.Second):
+			t.Fatalf("Expected a tick %s", reason)
+		}
+	}
+
+	expectTick("for the directory state")
+
+	// a burst of events causes one tick
+	events <- docker.Event{Action: "die", Name: "proxy"}
+	events <- docker.Event{Action: "destroy", Name: "proxy"}
+
+	expectTick("after the container events")
+
+	select {
+	case <-ticked:
+		t.Error("Expected the burst of events to only cause one tick")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	cancel()
+	<-done
+}
+
 func TestSuccessfulGetDirectoryState(t *testing.T) {
 	global.Machine.ForceTransition(global.Booted, nil)
 	defer global.Machine.ForceTransition(global.Initial, nil)
@@ -207,7 +1339,7 @@ func TestSuccessfulGetDirectoryState(t *testing.T) {
 		return &consul.DirectoryState{Index: index}, nil
 	}
 
-	directoryState := GetDirectoryState(consulClient, "abc123", 0, "5m")
+	directoryState := GetDirectoryState(context.Background(), consulClient, "abc123", consul.NewWatch("5m"))
 
 	if !global.Machine.IsCurrently(global.Booted) {
 		t.Errorf("Expected machine to be %s but was %v", global.Booted, global.Machine.CurrentState)
@@ -229,7 +1361,7 @@ func TestFailedGetDirectoryState(t *testing.T) {
 		return nil, errors.New("Fetching directory state failed")
 	}
 
-	directoryState := GetDirectoryState(consulClient, "abc123", 0, "5m")
+	directoryState := GetDirectoryState(context.Background(), consulClient, "abc123", consul.NewWatch("5m"))
 
 	if !global.Machine.IsCurrently(global.FetchingDirectoryStateFailed) {
 		t.Errorf("Expected machine to be %s but was %v", global.FetchingDirectoryStateFailed, global.Machine.CurrentState)
@@ -264,7 +1396,59 @@ func dockerClient(startedContainers *[]string, stoppedContainers *[]string) test
 			*stoppedContainers = append(*stoppedContainers, c.Name)
 			return nil
 		},
+		InspectResponse: func(c container.Container) (container.Container, error) {
+			return inspected(c), nil
+		},
+		EventsResponse: func() (<-chan docker.Event, error) {
+			return make(chan docker.Event), nil
+		},
+		RemoveVolumesResponse: func(name string) error {
+			return nil
+		},
+		NetworksResponse: func() ([]docker.Network, error) {
+			return nil, nil
+		},
+		CreateNetworkResponse: func(n docker.Network) error {
+			return nil
+		},
+		RemoveNetworkResponse: func(name string) error {
+			return nil
+		},
+		ImageIDResponse: func(image string) (string, error) {
+			return "sha256:abc", nil
+		},
+		PullResponse: func(c container.Container) error {
+			return nil
+		},
+	}
+}
+
+// managed returns the labels operator would have put on the container,
+// except with an out of date spec hash
+func managed(name string) map[string]string {
+	return map[string]string{
+		docker.ManagedLabel:  "true",
+		docker.ServiceLabel:  name,
+		docker.SpecHashLabel: "stale",
+	}
+}
+
+// inspected pretends any container which is in the boot state is running
+// exactly as desired
+func inspected(c container.Container) container.Container {
+	return inspectedIn(bootState(), c)
+}
+
+// inspectedIn pretends any container which is in the state is running
+// exactly as desired
+func inspectedIn(state *State, c container.Container) container.Container {
+	s, ok := state.Services[c.Name]
+
+	if !ok {
+		return c
 	}
+
+	return s.Container(state.NodeName, "127.0.0.1")
 }
 
 func consulClient(registeredServices *[]string, deregisteredServices *[]string) test.ConsulClient {
@@ -278,6 +1462,10 @@ func consulClient(registeredServices *[]string, deregisteredServices *[]string)
 			return nil
 		},
 		PostMetadataResponse: func() error { return nil },
+		PutKeyResponse:       func(string, string) error { return nil },
+		DeleteKeyResponse:    func(string) error { return nil },
+		ListKeysResponse:     func(string) ([]consul.KV, error) { return nil, nil },
 		ConsulHostResponse:   func() string { return "127.0.0.1" },
+		NodeAddressResponse:  func() string { return "" },
 	}
 }
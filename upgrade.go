@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/wakeful-deployment/operator/consul"
+	"github.com/wakeful-deployment/operator/container"
+	"github.com/wakeful-deployment/operator/docker"
+	"github.com/wakeful-deployment/operator/global"
+	"github.com/wakeful-deployment/operator/logger"
+	"github.com/wakeful-deployment/operator/service"
+	"time"
+)
+
+type failedUpgrade struct {
+	Hash string
+	Err  error
+}
+
+// failedUpgrades remembers which spec of each service failed to upgrade, so
+// we keep the old container instead of retrying the same broken image every
+// tick. Changing the service in consul again will trigger a new attempt.
+var failedUpgrades = make(map[string]failedUpgrade)
+
+// upgradeErrors are the per-service upgrade failures of a tick. The rest of
+// the node was normalized successfully when this is returned.
+type upgradeErrors []error
+
+func (e upgradeErrors) Error() string {
+	return fmt.Sprintf("ERROR: At least 1 service failed to upgrade: %v", []error(e))
+}
+
+// upgradeContainers moves every service with a new image over to it, one at
+// a time, and returns the names of the services it took care of. The images
+// of the pulled services were just pulled and aren't pulled again. Each
+// service goes through its own machine, which ends up UpgradeFailed rather
+// than failing the node when its upgrade fails.
+func upgradeContainers(ctx context.Context, dockerClient docker.Client, consulClient consul.Client, desiredState *State, upgrades []container.Container, pulled []string, current []container.Container) ([]string, upgradeErrors, error) {
+	nodeName := desiredState.NodeName
+	var handled []string
+	var failures upgradeErrors
+	failing := make(map[string]bool)
+
+	for _, c := range upgrades {
+		handled = append(handled, c.Name)
+
+		if failed, ok := failedUpgrades[c.Name]; ok && failed.Hash == c.Hash() {
+			logger.Warn("not retrying an upgrade which already failed", logger.Fields{"service": c.Name, "image": c.Image})
+			failures = append(failures, failed.Err)
+			failing[c.Name] = true
+			continue
+		}
+
+		global.TransitionService(c.Name, global.ServiceUpgrading, nil)
+
+		running, _ := findContainer(current, c.Name)
+		gate := checksGate(consulClient, desiredState.Services[c.Name])
+		err := docker.Upgrade(ctx, dockerClient, c, running, contains(pulled, c.Name), gate)
+
+		if upgradeErr, ok := err.(docker.UpgradeError); ok {
+			global.TransitionService(c.Name, global.ServiceUpgradeFailed, upgradeErr)
+			failedUpgrades[c.Name] = failedUpgrade{Hash: c.Hash(), Err: upgradeErr}
+			failures = append(failures, upgradeErr)
+			failing[c.Name] = true
+
+			failure := consul.UpgradeFailure{Image: c.Image, Hash: c.Hash(), Error: upgradeErr.Err.Error(), Time: time.Now()}
+			err = consul.PostUpgradeFailure(ctx, consulClient, nodeName, c.Name, failure)
+
+			if err != nil {
+				logger.Error("recording the failed upgrade in consul failed", logger.Fields{"service": c.Name, "error": err})
+			}
+
+			continue
+		}
+
+		global.TransitionService(c.Name, global.ServiceRunning, nil)
+
+		if err != nil {
+			return handled, failures, err
+		}
+	}
+
+	// forget failures for services which are no longer being upgraded,
+	// either because it finally worked or the image was changed back
+	for name := range failedUpgrades {
+		if failing[name] {
+			continue
+		}
+
+		delete(failedUpgrades, name)
+
+		if global.ServiceState(name).Equal(global.ServiceUpgradeFailed) {
+			global.TransitionService(name, global.ServiceRunning, nil)
+		}
+
+		err := consul.ClearUpgradeFailure(ctx, consulClient, nodeName, name)
+
+		if err != nil {
+			logger.Error("clearing the failed upgrade in consul failed", logger.Fields{"service": name, "error": err})
+		}
+	}
+
+	return handled, failures, nil
+}
+
+// recallFailedUpgrades picks up the failures written to consul before a
+// restart, so failed upgrades aren't retried and the next tick deletes the
+// keys of services which are no longer being upgraded
+func recallFailedUpgrades(ctx context.Context, consulClient consul.Client, nodeName string) {
+	failures, err := consul.UpgradeFailures(ctx, consulClient, nodeName)
+
+	if err != nil {
+		logger.Error("could not list the failed upgrades in consul", logger.Fields{"error": err})
+		return
+	}
+
+	for name, failure := range failures {
+		err := docker.UpgradeError{Name: name, Image: failure.Image, Err: errors.New(failure.Error)}
+		failedUpgrades[name] = failedUpgrade{Hash: failure.Hash, Err: err}
+		global.ForceServiceTransition(name, global.ServiceUpgradeFailed, err)
+	}
+}
+
+// checksGate gates an upgrade on the consul checks of the service. A check
+// may still report how the old container did, so they are only trusted once
+// the longest of them has had the time to run against the new container.
+// Services without checks are only gated on what docker can tell.
+func checksGate(consulClient consul.Client, s *service.Service) docker.Gate {
+	if s == nil || len(s.Checks) == 0 {
+		return nil
+	}
+
+	settle := checksSettle(s.Checks)
+
+	return func(ctx context.Context, since time.Time) (bool, error) {
+		if time.Since(since) < settle {
+			return false, nil
+		}
+
+		checks, err := consul.ServiceChecks(ctx, consulClient, s.Name)
+
+		if err != nil {
+			return false, err
+		}
+
+		for _, c := range checks {
+			if c.Status != consul.CheckPassing {
+				logger.Debug("waiting for the service's check to pass", logger.Fields{"service": s.Name, "check": c.CheckID, "status": c.Status, "output": c.Output})
+				return false, nil
+			}
+		}
+
+		return true, nil
+	}
+}
+
+// checksSettle is the longest interval, or ttl, of the checks
+func checksSettle(checks []service.Check) time.Duration {
+	var settle time.Duration
+
+	for _, c := range checks {
+		c = c.WithDefaults()
+		every := c.Interval
+
+		if c.Type() == service.TTLCheck {
+			every = c.TTL
+		}
+
+		// the service was validated, so its durations parse
+		d, err := time.ParseDuration(every)
+
+		if err == nil && d > settle {
+			settle = d
+		}
+	}
+
+	return settle
+}
+
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+func withoutContainers(containers []container.Container, names []string) []container.Container {
+	var result []container.Container
+
+	for _, c := range containers {
+		if !contains(names, c.Name) {
+			result = append(result, c)
+		}
+	}
+
+	return result
+}
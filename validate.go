@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/wakeful-deployment/operator/consul"
+	"github.com/wakeful-deployment/operator/service"
+	"os"
+)
+
+// validateCommand checks operator.json, and the service definitions in
+// consul when -node and -consul are given, without running anything. It
+// prints every problem found and exits with 1 if there were any.
+func validateCommand(args []string) int {
+	flags := flag.NewFlagSet("validate", flag.ExitOnError)
+	configPath := flags.String("config", "./operator.json", "The path to the operator.json to check")
+	nodeName := flags.String("node", "", "Also check the services in consul for this node")
+	consulHost := flags.String("consul", "", "The name or ip of the consul host to check the services in")
+	flags.Parse(args)
+
+	problems := validateConfigFile(*configPath)
+
+	if *nodeName != "" && *consulHost != "" {
+		client := consul.HttpClient{Host: *consulHost}
+		problems = append(problems, validateDirectory(context.Background(), client, *nodeName)...)
+	}
+
+	for _, problem := range problems {
+		fmt.Fprintln(os.Stdout, problem)
+	}
+
+	if len(problems) > 0 {
+		return 1
+	}
+
+	fmt.Fprintln(os.Stdout, "ok")
+
+	return 0
+}
+
+func validateConfigFile(path string) []string {
+	_, err := ReadStateFromConfigFile(path)
+
+	return problems(path, err)
+}
+
+func validateDirectory(ctx context.Context, client consul.Client, nodeName string) []string {
+	directoryState, err := client.GetDirectoryState(ctx, nodeName, 0, "0s")
+
+	if err != nil {
+		return []string{fmt.Sprintf("fetching the services of %s failed: %v", nodeName, err)}
+	}
+
+	var result []string
+
+	for _, kv := range directoryState.KVs {
+		_, err := kv.DecodeService()
+		result = append(result, problems(kv.Key, err)...)
+	}
+
+	return result
+}
+
+// problems turns an error into one line per problem, ex:
+// "operator.json: services.proxy.image is required"
+func problems(source string, err error) []string {
+	if err == nil {
+		return nil
+	}
+
+	errs, ok := err.(service.ValidationErrors)
+
+	if !ok {
+		return []string{fmt.Sprintf("%s: %v", source, err)}
+	}
+
+	var result []string
+
+	for _, e := range errs {
+		result = append(result, fmt.Sprintf("%s: %v", source, e))
+	}
+
+	return result
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestValidateConfigFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "operator-json")
+
+	if err != nil {
+		t.Fatal("Couldn't create a tmp file for this test")
+	}
+
+	defer os.Remove(f.Name())
+
+	_, err = f.WriteString(`{
+	"services": {
+		"statsite": {"image": "wakeful/wake-statsite:latest"},
+		"proxy": {"env": {}}
+	}
+}`)
+
+	if err != nil {
+		t.Fatal("Couldn't write to the tmp file")
+	}
+
+	problems := validateConfigFile(f.Name())
+
+	if len(problems) != 1 || problems[0] != f.Name()+": services.proxy.image: is required" {
+		t.Errorf("Expected the missing proxy image to be reported but got %v", problems)
+	}
+}
+
+func TestValidateConfigFileWithUnknownFields(t *testing.T) {
+	f, err := ioutil.TempFile("", "operator-json")
+
+	if err != nil {
+		t.Fatal("Couldn't create a tmp file for this test")
+	}
+
+	defer os.Remove(f.Name())
+
+	_, err = f.WriteString(`{"services": {"statsite": {"image": "wakeful/wake-statsite:latest", "prots": []}}}`)
+
+	if err != nil {
+		t.Fatal("Couldn't write to the tmp file")
+	}
+
+	problems := validateConfigFile(f.Name())
+
+	if len(problems) != 1 {
+		t.Errorf("Expected the unknown field to be reported but got %v", problems)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"github.com/wakeful-deployment/operator/backoff"
+	"github.com/wakeful-deployment/operator/consul"
+	"github.com/wakeful-deployment/operator/docker"
+	"github.com/wakeful-deployment/operator/logger"
+	"time"
+)
+
+// resyncInterval is how often the loop ticks even when nothing changed in
+// consul, so a container which died or a service deregistered by hand is
+// fixed. 0 turns it off.
+var resyncInterval = time.Minute
+
+// eventDelay is how long the loop waits after a container event for more
+// to follow, so a burst of events causes one tick
+var eventDelay = 2 * time.Second
+
+// directoryResult is one response of the blocking query on the node's
+// services
+type directoryResult struct {
+	state *consul.DirectoryState
+	err   error
+}
+
+// watchDirectory sends the services of the node every time they change,
+// or the wait passes, until ctx is cancelled. Failed queries are retried
+// with a backoff.
+func watchDirectory(ctx context.Context, consulClient consul.Client, nodeName string, wait string, results chan<- directoryResult) {
+	watch := consul.NewWatch(wait)
+	retries := backoff.New(retryPolicy)
+
+	for {
+		var directoryState *consul.DirectoryState
+
+		logger.Debug("getting directory state...", logger.Fields{"index": watch.Index()})
+		err := watch.Query(ctx, func(ctx context.Context, index int, wait string) error {
+			var err error
+			directoryState, err = consulClient.GetDirectoryState(ctx, nodeName, index, wait) // this will block for some time
+			return err
+		})
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		select {
+		case results <- directoryResult{state: directoryState, err: err}:
+		case <-ctx.Done():
+			return
+		}
+
+		if err != nil {
+			delay := retries.Next()
+			logger.Info("backing off before querying consul again", logger.Fields{"retry_in": delay, "attempts": retries.Attempts()})
+			sleep(ctx, delay)
+			continue
+		}
+
+		retries.Reset()
+		watch.Advance(directoryState.Index)
+	}
+}
+
+// watchContainers signals changed whenever a managed container dies, stops
+// or is destroyed, until ctx is cancelled. A broken event stream is
+// subscribed to again with a backoff.
+func watchContainers(ctx context.Context, dockerClient docker.Client, changed chan<- struct{}) {
+	retries := backoff.New(retryPolicy)
+
+	for {
+		events, err := dockerClient.Events(ctx)
+
+		if err == nil {
+			for event := range events {
+				retries.Reset()
+				logger.Info("container event", logger.Fields{"container": event.Name, "action": event.Action})
+
+				// changed holds one signal, which is all the loop needs
+				select {
+				case changed <- struct{}{}:
+				default:
+				}
+			}
+		}
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		delay := retries.Next()
+		logger.Warn("docker events stopped, subscribing again", logger.Fields{"error": err, "retry_in": delay})
+		sleep(ctx, delay)
+	}
+}